@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	defaultTTLAdaptInterval = time.Second * 5
+	// the adaptive ttl covers this many keepalive round trips
+	adaptiveRTTFactor = 30
+	// probes in a row wanting a shorter ttl before it is halved
+	adaptiveStableProbes = 3
+)
+
+// ttlAdapter picks the lease ttl in seconds from keepalive round trips, it
+// lengthens at once and shortens by halves once the network stayed stable
+type ttlAdapter struct {
+	min, max int64
+	ttl      int64
+	stable   int
+}
+
+func newTTLAdapter(min, max time.Duration) *ttlAdapter {
+	lo := int64(min / time.Second)
+	return &ttlAdapter{min: lo, max: int64(max / time.Second), ttl: lo}
+}
+
+// next returns the ttl after a keepalive round trip of rtt
+func (a *ttlAdapter) next(rtt time.Duration) int64 {
+	want := int64(math.Ceil((rtt * adaptiveRTTFactor).Seconds()))
+	if want < a.min {
+		want = a.min
+	}
+	if want > a.max {
+		want = a.max
+	}
+	switch {
+	case want > a.ttl:
+		a.ttl, a.stable = want, 0
+	case want < a.ttl:
+		a.stable++
+		if a.stable >= adaptiveStableProbes {
+			a.ttl, a.stable = a.ttl/2, 0
+			if a.ttl < want {
+				a.ttl = want
+			}
+		}
+	default:
+		a.stable = 0
+	}
+	return a.ttl
+}
+
+// adaptive reports whether MinGrantTTL and MaxGrantTTL are set
+func (c *Config) adaptive() bool {
+	return c.MinGrantTTL > 0
+}
+
+// adaptTTL times a keepalive of one kept lease every TTLAdaptInterval and
+// sets the ttl of the leases granted from then on accordingly
+func (e *Etcd) adaptTTL() {
+	defer e.keepers.Done()
+	a := newTTLAdapter(e.cfg.MinGrantTTL, e.cfg.MaxGrantTTL)
+	ticker := time.NewTicker(e.cfg.TTLAdaptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		id, ok := e.anyLease()
+		if !ok {
+			continue
+		}
+		ctx, cancel := e.opContext(e.ctx)
+		start := time.Now()
+		_, err := e.cli().KeepAliveOnce(ctx, id)
+		rtt := time.Since(start)
+		timedOut := ctx.Err() != nil
+		cancel()
+		if err != nil && !timedOut {
+			// e.g. revoked meanwhile, that says nothing about the network
+			e.log().Debugf("Etcd.adaptTTL lease=%x %v", id, err)
+			continue
+		}
+		ttl := a.next(rtt)
+		if old := atomic.SwapInt64(&e.leaseTTL, ttl); old != ttl {
+			e.log().Infof("Etcd.adaptTTL keepalive took %v, lease ttl %ds -> %ds", rtt, old, ttl)
+			adaptiveTTLGauge.Set(float64(ttl))
+		}
+	}
+}
+
+// anyLease returns the id of a lease this instance keeps alive
+func (e *Etcd) anyLease() (clientv3.LeaseID, bool) {
+	e.liveKeyIDLock.RLock()
+	defer e.liveKeyIDLock.RUnlock()
+	for _, lk := range e.liveKeyID {
+		return lk.lease.id, true
+	}
+	for _, l := range e.shared {
+		return l.id, true
+	}
+	return 0, false
+}
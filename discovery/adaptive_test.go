@@ -0,0 +1,105 @@
+package discovery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+func TestTTLAdapter(t *testing.T) {
+	a := newTTLAdapter(2*time.Second, 20*time.Second)
+	steps := []struct {
+		rtt  time.Duration
+		want int64
+	}{
+		{10 * time.Millisecond, 2},
+		// 300ms covered 30 times
+		{300 * time.Millisecond, 9},
+		{time.Second, 20},
+		// shortens by halves after three stable probes only
+		{10 * time.Millisecond, 20},
+		{10 * time.Millisecond, 20},
+		{10 * time.Millisecond, 10},
+		// wanting the current ttl starts over
+		{330 * time.Millisecond, 10},
+		{10 * time.Millisecond, 10},
+		{10 * time.Millisecond, 10},
+		{10 * time.Millisecond, 5},
+		{10 * time.Millisecond, 5},
+		{10 * time.Millisecond, 5},
+		{10 * time.Millisecond, 2},
+	}
+	for i, s := range steps {
+		if got := a.next(s.rtt); got != s.want {
+			t.Fatalf("step %d rtt %v: ttl %d, want %d", i, s.rtt, got, s.want)
+		}
+	}
+}
+
+// slowStream delays every message received on a lease keepalive stream
+type slowStream struct {
+	grpc.ClientStream
+	delay *int64
+}
+
+func (s slowStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	time.Sleep(time.Duration(atomic.LoadInt64(s.delay)))
+	return err
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	var delay int64
+	slow := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil || method != "/etcdserverpb.Lease/LeaseKeepAlive" {
+			return s, err
+		}
+		return slowStream{s, &delay}, nil
+	}
+	e := newTestEtcd(t, Config{
+		MinGrantTTL:      time.Second,
+		MaxGrantTTL:      4 * time.Second,
+		TTLAdaptInterval: 50 * time.Millisecond,
+		DialOptions:      []grpc.DialOption{grpc.WithChainStreamInterceptor(slow)},
+	})
+	if ttl := e.grantTTL(); ttl != 1 {
+		t.Fatalf("starting ttl %d, want MinGrantTTL", ttl)
+	}
+	if err := e.keep("ion://test/adaptive/a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	waitTTL := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for e.grantTTL() != want {
+			if ttl := e.grantTTL(); ttl < 1 || ttl > 4 {
+				t.Fatalf("ttl %d out of bounds", ttl)
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ttl %d, want %d", e.grantTTL(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if g := testutil.ToFloat64(adaptiveTTLGauge); g != float64(want) {
+			t.Fatalf("gauge %v, want %d", g, want)
+		}
+	}
+
+	// 200ms round trips want 6s, bounded by MaxGrantTTL
+	atomic.StoreInt64(&delay, int64(200*time.Millisecond))
+	waitTTL(4)
+	if err := e.keep("ion://test/adaptive/b", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := e.TimeToLive("ion://test/adaptive/b"); err != nil || d < 3*time.Second {
+		t.Fatalf("new lease ttl %v, %v, want the adapted 4s", d, err)
+	}
+
+	atomic.StoreInt64(&delay, 0)
+	waitTTL(1)
+}
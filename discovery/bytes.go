@@ -0,0 +1,17 @@
+package discovery
+
+// putBytes is keep of a binary value such as an encoded protobuf, stored
+// byte for byte without any text encoding
+func (e *Etcd) putBytes(key string, v []byte) error {
+	return e.keep(key, string(v))
+}
+
+// getBytes is get of a value written by putBytes, or any other one, as the
+// bytes stored
+func (e *Etcd) getBytes(key string) ([]byte, error) {
+	v, err := e.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
@@ -0,0 +1,42 @@
+package discovery
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBytes(t *testing.T) {
+	// invalid UTF-8, a NUL and the gzip magic, all lost by text handling
+	payload := []byte{0xff, 0xfe, 0x00, 0x1f, 0x8b, 0x80, 'i', 'o', 'n', 0xc3}
+	if utf8.Valid(payload) {
+		t.Fatal("payload is valid UTF-8")
+	}
+	for _, cfg := range []Config{{}, {CompressThreshold: 4}} {
+		e := newTestEtcd(t, cfg)
+		events, cancel, err := e.Subscribe("ion://test/bytes/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cancel()
+		for _, v := range [][]byte{payload, append([]byte{compressedHeader}, payload...), {0x00}} {
+			key := "ion://test/bytes/proto"
+			if err := e.putBytes(key, v); err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.getBytes(key)
+			if err != nil || !bytes.Equal(got, v) {
+				t.Fatalf("threshold %d: getBytes = %x, %v, want %x", cfg.CompressThreshold, got, err, v)
+			}
+			select {
+			case ev := <-events:
+				if !bytes.Equal(ev.Bytes, v) || ev.Value != string(v) {
+					t.Fatalf("threshold %d: event bytes %x, want %x", cfg.CompressThreshold, ev.Bytes, v)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event")
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+)
+
+// CachedView is a local copy of every key under a prefix, read once and then
+// kept up to date by a watch, so Get and List cost no etcd round trip. Reads
+// may lag etcd by the watch delay, and by more while Stale.
+type CachedView struct {
+	mu     sync.RWMutex
+	items  map[string]string
+	stale  bool
+	cancel func()
+}
+
+// NewCachedView reads prefix and watches it until Close
+func (e *Etcd) NewCachedView(prefix string) (v *CachedView, err error) {
+	defer observe(opWatch, time.Now(), &err)
+	_, span := e.span(e.ctx, "watch", prefix)
+	defer endSpan(span, &err)
+	items, rev, err := e.snapshot(prefix, true, false)
+	if err != nil {
+		return nil, err
+	}
+	v = &CachedView{items: items}
+	v.cancel = e.watchWithHooks(prefix, true, rev, v.apply, watchHooks{
+		onResync: v.reset,
+		onState:  v.setConnected,
+	})
+	return v, nil
+}
+
+func (v *CachedView) apply(typ EventType, key, value string) {
+	v.mu.Lock()
+	if typ == EventDelete {
+		delete(v.items, key)
+	} else {
+		v.items[key] = value
+	}
+	v.mu.Unlock()
+}
+
+// reset replaces the copy after its watch revision got compacted
+func (v *CachedView) reset(items map[string]string) {
+	v.mu.Lock()
+	v.items = items
+	v.mu.Unlock()
+}
+
+func (v *CachedView) setConnected(connected bool) {
+	v.mu.Lock()
+	v.stale = !connected
+	v.mu.Unlock()
+}
+
+// Get returns the cached value of key, ErrKeyNotFound if it has none
+func (v *CachedView) Get(key string) (string, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	value, ok := v.items[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// List returns a copy of every cached key
+func (v *CachedView) List() map[string]string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	m := make(map[string]string, len(v.items))
+	for k, value := range v.items {
+		m[k] = value
+	}
+	return m
+}
+
+// Stale reports whether the watch is down, from when its channel closes
+// until a new one is established; the changes missed meanwhile come first
+// on the new one
+func (v *CachedView) Stale() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.stale
+}
+
+// Close stops the watch, the view keeps its last content
+func (v *CachedView) Close() {
+	v.cancel()
+}
@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedView(t *testing.T) {
+	e := newTestEtcd(t, Config{HealthCheckInterval: time.Hour})
+	e.PutJSONStatic("ion://test/cache/a", "a")
+	v, err := e.NewCachedView("ion://test/cache/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if got, err := v.Get("ion://test/cache/a"); err != nil || got != `"a"` {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	e.keep("ion://test/cache/b", "b")
+	e.del("ion://test/cache/a")
+	waitFor("convergence", func() bool {
+		m := v.List()
+		return len(m) == 1 && m["ion://test/cache/b"] == "b"
+	})
+	if v.Stale() {
+		t.Fatal("stale with a live watch")
+	}
+
+	// closing the client drops the watch until a new client is swapped in
+	e.cli().Close()
+	waitFor("stale", v.Stale)
+	cli, err := dial(e.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.swapClient(cli, false)
+	waitFor("not stale", func() bool { return !v.Stale() })
+	e.keep("ion://test/cache/c", "c")
+	waitFor("change after the resume", func() bool {
+		_, err := v.Get("ion://test/cache/c")
+		return err == nil
+	})
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+)
+
+// ClusterInfo is the topology of the etcd cluster as its members report it,
+// for diagnostics without etcdctl
+type ClusterInfo struct {
+	ClusterID uint64
+	// Leader is the member id most reachable members report, the lowest of
+	// those reported equally often, 0 when none answered or they know of no
+	// leader
+	Leader  uint64
+	Members []MemberInfo
+}
+
+// MemberInfo is one member of the cluster
+type MemberInfo struct {
+	ID uint64
+	// Name and ClientURLs are empty for a member added but never started
+	Name       string
+	PeerURLs   []string
+	ClientURLs []string
+	Leader     bool
+	// Reachable is a member answering Status on one of its ClientURLs, Err
+	// is why it did not otherwise
+	Reachable bool
+	Err       error
+	Version   string
+	DBSize    int64
+}
+
+// ClusterInfo lists the members of the cluster and asks each of them for
+// its status, all at once and each within OperationTimeout. It fails only
+// when the member list cannot be read; an unreachable member is reported.
+func (e *Etcd) ClusterInfo(ctx context.Context) (info *ClusterInfo, err error) {
+	ctx, span := e.span(ctx, "cluster", "")
+	defer endSpan(span, &err)
+	cli := e.cli()
+	opCtx, cancel := e.opContext(ctx)
+	resp, err := cli.MemberList(opCtx)
+	cancel()
+	if err != nil {
+		return nil, etcdError(err)
+	}
+	info = &ClusterInfo{ClusterID: resp.Header.ClusterId, Members: make([]MemberInfo, len(resp.Members))}
+	leaders := make([]uint64, len(resp.Members))
+	var wg sync.WaitGroup
+	for i, m := range resp.Members {
+		info.Members[i] = MemberInfo{ID: m.ID, Name: m.Name, PeerURLs: m.PeerURLs, ClientURLs: m.ClientURLs}
+		if len(m.ClientURLs) == 0 {
+			info.Members[i].Err = ErrUnavailable
+			continue
+		}
+		wg.Add(1)
+		go func(mi *MemberInfo, leader *uint64) {
+			defer wg.Done()
+			for _, u := range mi.ClientURLs {
+				opCtx, cancel := e.opContext(ctx)
+				st, err := cli.Status(opCtx, u)
+				cancel()
+				if err != nil {
+					mi.Err = etcdError(err)
+					continue
+				}
+				mi.Reachable, mi.Err = true, nil
+				mi.Version, mi.DBSize = st.Version, st.DbSize
+				*leader = st.Leader
+				return
+			}
+		}(&info.Members[i], &leaders[i])
+	}
+	wg.Wait()
+	info.Leader = electedLeader(leaders)
+	for i := range info.Members {
+		info.Members[i].Leader = info.Leader != 0 && info.Members[i].ID == info.Leader
+	}
+	return info, nil
+}
+
+// electedLeader is the leader most of leaders name, the lowest id on a tie
+// so a split report gives the same answer every time, 0 when none is named
+func electedLeader(leaders []uint64) uint64 {
+	votes := make(map[uint64]int)
+	for _, l := range leaders {
+		if l != 0 {
+			votes[l]++
+		}
+	}
+	var leader uint64
+	for l, n := range votes {
+		if n > votes[leader] || (n == votes[leader] && l < leader) {
+			leader = l
+		}
+	}
+	return leader
+}
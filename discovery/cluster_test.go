@@ -0,0 +1,134 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+// startCluster runs an etcd cluster of n members for the duration of the
+// test and returns them with their client endpoints
+func startCluster(t *testing.T, n int) ([]*embed.Etcd, []string) {
+	cfgs := make([]*embed.Config, n)
+	var initial []string
+	for i := range cfgs {
+		dir, err := ioutil.TempDir("", "ion-etcd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		cfg := embed.NewConfig()
+		cfg.Name = fmt.Sprintf("member-%d", i)
+		cfg.Dir = dir
+		cu, pu := freeURL(t, "http"), freeURL(t, "http")
+		cfg.LCUrls, cfg.ACUrls = []url.URL{cu}, []url.URL{cu}
+		cfg.LPUrls, cfg.APUrls = []url.URL{pu}, []url.URL{pu}
+		cfgs[i] = cfg
+		initial = append(initial, cfg.Name+"="+pu.String())
+	}
+	srvs := make([]*embed.Etcd, n)
+	eps := make([]string, n)
+	for i, cfg := range cfgs {
+		cfg.InitialCluster = strings.Join(initial, ",")
+		srv, err := embed.StartEtcd(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(srv.Close)
+		srvs[i], eps[i] = srv, cfg.ACUrls[0].Host
+	}
+	for _, srv := range srvs {
+		select {
+		case <-srv.Server.ReadyNotify():
+		case <-time.After(10 * time.Second):
+			t.Fatal("etcd cluster not ready")
+		}
+	}
+	return srvs, eps
+}
+
+func TestClusterInfo(t *testing.T) {
+	srvs, eps := startCluster(t, 3)
+	e := newTestEtcd(t, Config{Endpoints: eps})
+	info, err := e.ClusterInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Members) != 3 || info.ClusterID != uint64(srvs[0].Server.Cluster().ID()) {
+		t.Fatalf("ClusterInfo = %+v, want the 3 members of cluster %x", info, srvs[0].Server.Cluster().ID())
+	}
+	leader := uint64(srvs[0].Server.Leader())
+	if info.Leader != leader {
+		t.Fatalf("leader %x, want %x", info.Leader, leader)
+	}
+	byID := make(map[uint64]MemberInfo)
+	for _, m := range info.Members {
+		byID[m.ID] = m
+	}
+	for i, srv := range srvs {
+		m, ok := byID[uint64(srv.Server.ID())]
+		if !ok {
+			t.Fatalf("member %x missing from %+v", srv.Server.ID(), info.Members)
+		}
+		if m.Name != fmt.Sprintf("member-%d", i) || !m.Reachable || m.Err != nil || m.Version == "" {
+			t.Fatalf("member %d = %+v", i, m)
+		}
+		if len(m.ClientURLs) != 1 || m.ClientURLs[0] != "http://"+eps[i] || len(m.PeerURLs) != 1 {
+			t.Fatalf("member %d urls %v %v, want client %s", i, m.ClientURLs, m.PeerURLs, eps[i])
+		}
+		if m.Leader != (m.ID == leader) {
+			t.Fatalf("member %d leader = %v", i, m.Leader)
+		}
+	}
+
+	// a follower down is reported unreachable, the others still answer
+	down := 0
+	if uint64(srvs[0].Server.ID()) == leader {
+		down = 1
+	}
+	downID := uint64(srvs[down].Server.ID())
+	srvs[down].Close()
+	e = newTestEtcd(t, Config{Endpoints: []string{eps[(down+1)%3]}, OperationTimeout: time.Second})
+	info, err = e.ClusterInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range info.Members {
+		if m.Reachable == (m.ID == downID) {
+			t.Fatalf("member %+v reachable = %v with %x down", m, m.Reachable, downID)
+		}
+	}
+	if info.Leader != leader {
+		t.Fatalf("leader %x after a follower stopped, want %x", info.Leader, leader)
+	}
+}
+
+func TestElectedLeader(t *testing.T) {
+	cases := []struct {
+		leaders []uint64
+		want    uint64
+	}{
+		{nil, 0},
+		{[]uint64{0, 0}, 0},
+		{[]uint64{7, 0, 7}, 7},
+		{[]uint64{9, 7, 9}, 9},
+		// a tie goes to the lowest id, whatever the map order
+		{[]uint64{9, 7}, 7},
+		{[]uint64{9, 3, 7, 0}, 3},
+		{[]uint64{9, 9, 3, 3, 7}, 3},
+	}
+	for _, c := range cases {
+		for i := 0; i < 20; i++ {
+			if got := electedLeader(c.leaders); got != c.want {
+				t.Fatalf("electedLeader(%v) = %d, want %d", c.leaders, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"strings"
+	"time"
+)
+
+// pendingUpdate is the latest value of a key given to update within
+// UpdateWindow, the timer writes it
+type pendingUpdate struct {
+	value string
+	timer *time.Timer
+	// tracked is a key kept when the window started, one no longer kept
+	// when it ends got deleted or revoked and is not written again
+	tracked bool
+}
+
+// coalesce records value as the latest of key, the first call of a window
+// schedules the put of whatever value is latest when it ends
+func (e *Etcd) coalesce(key, value string) {
+	tracked := e.tracked(key)
+	e.pendingLock.Lock()
+	defer e.pendingLock.Unlock()
+	if p, ok := e.pending[key]; ok {
+		p.value = value
+		return
+	}
+	p := &pendingUpdate{value: value, tracked: tracked}
+	p.timer = time.AfterFunc(e.cfg.UpdateWindow, func() { e.flushPending(key, p) })
+	e.pending[key] = p
+}
+
+// flushPending writes the latest value of key unless p got dropped meanwhile
+func (e *Etcd) flushPending(key string, p *pendingUpdate) {
+	e.pendingLock.Lock()
+	if e.pending[key] != p {
+		e.pendingLock.Unlock()
+		return
+	}
+	delete(e.pending, key)
+	value := p.value
+	e.pendingLock.Unlock()
+	if p.tracked && !e.tracked(key) {
+		e.log().Infof("Etcd.Update %s no longer kept, dropping its pending value", key)
+		return
+	}
+	if err := e.updateCtx(e.ctx, key, value); err != nil {
+		e.log().Errorf("Etcd.Update %s %v", key, err)
+	}
+}
+
+// dropPending forgets the pending update of key, so a deleted key is not
+// written again when the window ends
+func (e *Etcd) dropPending(key string) {
+	e.pendingLock.Lock()
+	if p, ok := e.pending[key]; ok {
+		p.timer.Stop()
+		delete(e.pending, key)
+	}
+	e.pendingLock.Unlock()
+}
+
+// dropPendingPrefix is dropPending of every key under prefix
+func (e *Etcd) dropPendingPrefix(prefix string) {
+	e.pendingLock.Lock()
+	for key, p := range e.pending {
+		if strings.HasPrefix(key, prefix) {
+			p.timer.Stop()
+			delete(e.pending, key)
+		}
+	}
+	e.pendingLock.Unlock()
+}
+
+// tracked reports whether this instance keeps key
+func (e *Etcd) tracked(key string) bool {
+	e.liveKeyIDLock.RLock()
+	_, ok := e.liveKeyID[key]
+	e.liveKeyIDLock.RUnlock()
+	return ok
+}
+
+// stopPending drops every pending update on close
+func (e *Etcd) stopPending() {
+	e.pendingLock.Lock()
+	for key, p := range e.pending {
+		p.timer.Stop()
+		delete(e.pending, key)
+	}
+	e.pendingLock.Unlock()
+}
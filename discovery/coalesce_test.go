@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUpdateWindow(t *testing.T) {
+	e := newTestEtcd(t, Config{UpdateWindow: 100 * time.Millisecond})
+	key := "ion://test/coalesce/load"
+	if err := e.keep(key, "start"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := e.update(key, strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	resp, err := e.cli().Get(context.Background(), key)
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("get = %v, %v", resp, err)
+	}
+	kv := resp.Kvs[0]
+	if string(kv.Value) != "49" {
+		t.Fatalf("value %q, want the last update", kv.Value)
+	}
+	// version 1 is the keep, every later put bumps it
+	if puts := kv.Version - 1; puts < 1 || puts > 3 {
+		t.Fatalf("%d puts for 50 updates", puts)
+	}
+
+	// a delete within the window is not undone by the pending update
+	e.update(key, "stale")
+	e.del(key)
+	time.Sleep(200 * time.Millisecond)
+	if _, err := e.get(key); err != ErrKeyNotFound {
+		t.Fatalf("get after del = %v", err)
+	}
+
+	// nor by a delete of the other kinds
+	dels := map[string]func(key string){
+		"delByPrefix": func(key string) { e.delByPrefix(key) },
+		"CompareAndDelete": func(key string) {
+			if ok, err := e.CompareAndDelete(key, "v"); !ok || err != nil {
+				t.Fatalf("CompareAndDelete = %v, %v", ok, err)
+			}
+		},
+		"DeleteIf": func(key string) {
+			if ok, err := e.DeleteIf(key, "other"); ok || err != nil {
+				t.Fatalf("DeleteIf = %v, %v", ok, err)
+			}
+			e.cli().Delete(context.Background(), key)
+		},
+		"Txn": func(key string) {
+			if _, err := e.Txn().Then(OpDelete(key)).Commit(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, del := range dels {
+		key := "ion://test/coalesce/" + name
+		if err := e.keep(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+		e.update(key, "stale")
+		del(key)
+		time.Sleep(200 * time.Millisecond)
+		if _, err := e.get(key); err != ErrKeyNotFound {
+			t.Fatalf("get after %s = %v", name, err)
+		}
+	}
+
+	// a pending update of a key revoked meanwhile is dropped when flushed
+	key = "ion://test/coalesce/revoked"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.update(key, "stale")
+	e.liveKeyIDLock.Lock()
+	e.untrack(key)
+	e.liveKeyIDLock.Unlock()
+	e.cli().Delete(context.Background(), key)
+	time.Sleep(200 * time.Millisecond)
+	if _, err := e.get(key); err != ErrKeyNotFound {
+		t.Fatalf("get after untrack = %v", err)
+	}
+}
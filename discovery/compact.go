@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	defaultCompactInterval  = time.Minute * 5
+	defaultCompactRetention = 1000
+)
+
+// CompactorConfig configures a Compactor, zero fields take the defaults
+type CompactorConfig struct {
+	// Interval between compactions, default 5m
+	Interval time.Duration
+	// Retention is how many revisions are kept before the current one,
+	// default 1000. Watches and reads further behind fail with ErrCompacted.
+	Retention int64
+	// Physical waits for the compacted history to be removed from the
+	// backend before returning, so it is gone from disk too
+	Physical bool
+	// Election restricts compacting to its leader when set, the caller
+	// campaigns on it. Without it every instance running a Compactor
+	// compacts, which is harmless but wasteful.
+	Election *Election
+}
+
+// Compactor compacts the etcd history on a schedule, etcd otherwise keeps
+// every revision unless the cluster runs with --auto-compaction
+type Compactor struct {
+	etcd   *Etcd
+	cfg    CompactorConfig
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	compacted int64
+}
+
+// NewCompactor starts compacting every Interval until Close
+func (e *Etcd) NewCompactor(cfg CompactorConfig) (*Compactor, error) {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultCompactInterval
+	}
+	if cfg.Retention == 0 {
+		cfg.Retention = defaultCompactRetention
+	}
+	if cfg.Interval < 0 || cfg.Retention < 0 {
+		return nil, fmt.Errorf("invalid compactor interval %v or retention %d", cfg.Interval, cfg.Retention)
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	c := &Compactor{etcd: e, cfg: cfg, cancel: cancel}
+	c.wg.Add(1)
+	go c.run(ctx)
+	return c, nil
+}
+
+func (c *Compactor) run(ctx context.Context) {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.Interval):
+		}
+		if _, err := c.Compact(ctx); err != nil && ctx.Err() == nil {
+			c.etcd.log().Errorf("Compactor %v", err)
+		}
+	}
+}
+
+// Compact compacts the history older than Retention now and returns the
+// revision compacted at. It returns 0 without compacting when this instance
+// is not the leader of Election or nothing new is older than Retention.
+func (c *Compactor) Compact(ctx context.Context) (int64, error) {
+	e := c.etcd
+	if c.cfg.Election != nil {
+		leader, err := c.cfg.Election.IsLeader(ctx)
+		if err != nil || !leader {
+			return 0, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before, err := e.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rev := before.Revision - c.cfg.Retention
+	if rev <= c.compacted {
+		return 0, nil
+	}
+	var opts []clientv3.CompactOption
+	if c.cfg.Physical {
+		opts = append(opts, clientv3.WithCompactPhysical())
+	}
+	opCtx, cancel := e.opContext(ctx)
+	_, err = e.cli().Compact(opCtx, rev, opts...)
+	cancel()
+	if err = etcdError(err); errors.Is(err, ErrCompacted) {
+		// another instance compacted further already
+		c.compacted = rev
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.compacted = rev
+	// the backend only shrinks on disk once defragmented, the size tells
+	// what the compaction freed after that
+	if after, err := e.Status(ctx); err == nil {
+		e.log().Infof("Compactor compacted at revision %d, db size %d -> %d bytes", rev, before.DBSize, after.DBSize)
+	} else {
+		e.log().Infof("Compactor compacted at revision %d", rev)
+	}
+	return rev, nil
+}
+
+// Close stops compacting
+func (c *Compactor) Close() {
+	c.cancel()
+	c.wg.Wait()
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompactor(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	ctx := context.Background()
+	key := "ion://test/compact"
+	if err := e.PutStatic(key, "0"); err != nil {
+		t.Fatal(err)
+	}
+	kvs, _ := e.getByPrefixKV(key)
+	first := kvs[0].ModRevision
+	for i := 1; i < 5; i++ {
+		e.PutStatic(key, fmt.Sprint(i))
+	}
+
+	el, err := e.NewElection("ion://test/compactor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	c, err := e.NewCompactor(CompactorConfig{Interval: time.Hour, Retention: 1, Physical: true, Election: el})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if rev, err := c.Compact(ctx); err != nil || rev != 0 {
+		t.Fatalf("compact before being elected = %d, %v", rev, err)
+	}
+	if _, err := e.getAtRevision(key, first); err != nil {
+		t.Fatalf("read before compacting err = %v", err)
+	}
+
+	if err := el.Campaign(ctx, "compactor"); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := c.Compact(ctx)
+	if err != nil || rev <= first {
+		t.Fatalf("compact = %d, %v", rev, err)
+	}
+	if _, err := e.getAtRevision(key, rev-1); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("read below the compacted revision err = %v, want ErrCompacted", err)
+	}
+	if v, err := e.get(key); err != nil || v != "4" {
+		t.Fatalf("current value = %q, %v", v, err)
+	}
+	if rev, err := c.Compact(ctx); err != nil || rev != 0 {
+		t.Fatalf("compact without new revisions = %d, %v", rev, err)
+	}
+}
+
+func TestCompactorSchedule(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/compact"
+	e.PutStatic(key, "0")
+	kvs, _ := e.getByPrefixKV(key)
+	first := kvs[0].ModRevision
+	e.PutStatic(key, "1")
+	e.PutStatic(key, "2")
+
+	c, err := e.NewCompactor(CompactorConfig{Interval: 20 * time.Millisecond, Retention: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := e.getAtRevision(key, first)
+		if errors.Is(err, ErrCompacted) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not compacted, read err = %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := e.NewCompactor(CompactorConfig{Retention: -1}); err == nil {
+		t.Fatal("negative retention accepted")
+	}
+}
@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// compressedHeader starts a gzipped value, plain text never starts with it
+// unless written that way on purpose
+const compressedHeader = 0x00
+
+// encodeValue gzips value behind compressedHeader from CompressThreshold
+// bytes on. A shorter value starting with the header is gzipped too, so it
+// is not mistaken for a compressed one.
+func (e *Etcd) encodeValue(value string) string {
+	t := e.cfg.CompressThreshold
+	if t == 0 || (len(value) < t && (value == "" || value[0] != compressedHeader)) {
+		return value
+	}
+	var b bytes.Buffer
+	b.WriteByte(compressedHeader)
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(value))
+	w.Close()
+	return b.String()
+}
+
+// decodeValue returns b decompressed when encodeValue gzipped it, as is
+// otherwise
+func decodeValue(b []byte) string {
+	if len(b) == 0 || b[0] != compressedHeader {
+		return string(b)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b[1:]))
+	if err != nil {
+		return string(b)
+	}
+	v, err := ioutil.ReadAll(r)
+	if err != nil {
+		return string(b)
+	}
+	return string(v)
+}
@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeValue(t *testing.T) {
+	e := &Etcd{cfg: Config{CompressThreshold: 16}}
+	for _, v := range []string{"", "short", strings.Repeat("x", 16), "\x00starts with the header", strings.Repeat("codec ", 100)} {
+		enc := e.encodeValue(v)
+		if compressed := len(enc) > 0 && enc[0] == compressedHeader; compressed != (len(v) >= 16 || strings.HasPrefix(v, "\x00")) {
+			t.Fatalf("%q compressed = %v", v, compressed)
+		}
+		if got := decodeValue([]byte(enc)); got != v {
+			t.Fatalf("round trip of %q = %q", v, got)
+		}
+	}
+	if got := (&Etcd{}).encodeValue(strings.Repeat("x", 1000)); got != strings.Repeat("x", 1000) {
+		t.Fatal("compressed without a threshold")
+	}
+	if got := decodeValue([]byte("\x00not gzip")); got != "\x00not gzip" {
+		t.Fatalf("invalid gzip decoded to %q", got)
+	}
+}
+
+func TestCompressedValues(t *testing.T) {
+	e := newTestEtcd(t, Config{CompressThreshold: 256})
+	raw := func(key string) string {
+		resp, err := e.cli().Get(context.Background(), key)
+		if err != nil || len(resp.Kvs) == 0 {
+			t.Fatalf("raw get %s = %v, %v", key, resp, err)
+		}
+		return string(resp.Kvs[0].Value)
+	}
+
+	small := ServiceNode{ID: "1", Name: "sfu", Addr: "10.0.0.1:5000"}
+	if err := e.PutJSON("ion://test/compress/small", small); err != nil {
+		t.Fatal(err)
+	}
+	if v := raw("ion://test/compress/small"); !strings.HasPrefix(v, "{") {
+		t.Fatalf("small value stored as %q", v)
+	}
+	large := small
+	large.Meta = map[string]string{"codecs": strings.Repeat("opus,vp8,vp9,h264,", 50)}
+	if err := e.PutJSON("ion://test/compress/large", large); err != nil {
+		t.Fatal(err)
+	}
+	if v := raw("ion://test/compress/large"); v[0] != compressedHeader || len(v) >= len(large.Meta["codecs"]) {
+		t.Fatalf("large value stored uncompressed, %d bytes", len(v))
+	}
+	for key, want := range map[string]ServiceNode{"ion://test/compress/small": small, "ion://test/compress/large": large} {
+		var got ServiceNode
+		if err := e.GetJSON(key, &got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("GetJSON %s = %+v, %v", key, got, err)
+		}
+	}
+
+	// a value growing past the threshold and shrinking back
+	fn, events := collectEvents()
+	stop, err := e.Watch("ion://test/compress/grow", false, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	key, big := "ion://test/compress/grow", strings.Repeat("y", 300)
+	for _, v := range []string{"small", big, "small again"} {
+		if err := e.update(key, v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := e.get(key); err != nil || got != v {
+			t.Fatalf("get = %q, %v, want %q", got, err, v)
+		}
+		if m, err := e.getByPrefix(key); err != nil || m[key] != v {
+			t.Fatalf("getByPrefix = %v, %v", m, err)
+		}
+		expectEvent(t, events, watchEvent{EventPut, key, v})
+		if compressed := raw(key)[0] == compressedHeader; compressed != (v == big) {
+			t.Fatalf("%d bytes stored compressed = %v", len(v), compressed)
+		}
+	}
+	if n, err := e.repair(); err != nil || n != 0 {
+		t.Fatalf("repair of compressed keys = %d, %v", n, err)
+	}
+
+	// a Txn writes and compares values encoded too
+	txnKey, staticKey := "ion://test/compress/txn", "ion://test/compress/txnstatic"
+	ok, err := e.Txn().If(KeyMissing(txnKey)).Then(OpPut(txnKey, big), OpPutStatic(staticKey, big)).Commit(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("Txn put = %v, %v", ok, err)
+	}
+	for _, k := range []string{txnKey, staticKey} {
+		if v := raw(k); v[0] != compressedHeader {
+			t.Fatalf("Txn stored %s uncompressed", k)
+		}
+		if got, err := e.get(k); err != nil || got != big {
+			t.Fatalf("get %s = %d bytes, %v", k, len(got), err)
+		}
+	}
+	ok, err = e.Txn().If(ValueEquals(txnKey, big)).Then(OpPut(txnKey, "small")).Commit(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("Txn compare of a compressed value = %v, %v", ok, err)
+	}
+	if got, err := e.get(txnKey); err != nil || got != "small" {
+		t.Fatalf("get after Txn = %q, %v", got, err)
+	}
+	if n, err := e.repair(); err != nil || n != 0 {
+		t.Fatalf("repair of Txn keys = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,259 @@
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+// Config configures the etcd client, zero fields take the defaults
+type Config struct {
+	Endpoints []string
+	// DiscoverySRV is a domain whose etcd client SRV records list the
+	// members, as for etcd --discovery-srv, instead of giving Endpoints.
+	// They are resolved with Resolver, net.DefaultResolver when nil, on
+	// start and again every DiscoveryInterval unless it is 0.
+	DiscoverySRV      string
+	DiscoveryInterval time.Duration
+	Resolver          SRVResolver
+	DialTimeout       time.Duration
+	// FailFast makes the constructor fail with ErrUnavailable unless an
+	// endpoint answers within DialTimeout. Otherwise the client connects
+	// lazily and a bad endpoint only shows on the first operation.
+	FailFast bool
+	// GrantTTL is the lease TTL of kept keys, etcd grants whole seconds
+	GrantTTL time.Duration
+	// MinGrantTTL and MaxGrantTTL replace GrantTTL by an adaptive TTL
+	// between them, set both or neither. It starts at MinGrantTTL and every
+	// TTLAdaptInterval, default 5s, a keepalive round trip is timed: a slow
+	// one lengthens the TTL at once so leases do not expire early, a stable
+	// network shortens it again so dead nodes are noticed sooner. Leases keep
+	// the TTL they were granted with.
+	MinGrantTTL      time.Duration
+	MaxGrantTTL      time.Duration
+	TTLAdaptInterval time.Duration
+	OperationTimeout time.Duration
+	// WatchWorkers is how many goroutines run the WatchFunc of each watch,
+	// events of one key always go to the same one. Up to 1 calls it from the
+	// watch goroutine itself.
+	WatchWorkers int
+	// SubscribeBuffer is how many events the channel of a Subscribe holds
+	// before the watch waits for its reader, default 64
+	SubscribeBuffer int
+	// Namespace is prepended to every key, e.g. "staging/", so deployments
+	// sharing a cluster do not collide. Keys handed back never include it.
+	Namespace string
+	// UpdateWindow coalesces the Update calls of one key within it into a
+	// single put of the latest value, written at the end of the window. 0
+	// writes every call through.
+	UpdateWindow time.Duration
+	// CompressThreshold gzips the values written by keep, update, PutStatic
+	// and Txn from this many bytes on, behind a 0 header byte, and compares
+	// values the same way. Reads decompress them whatever the setting. 0
+	// never compresses, and shorter values stay plain text for etcdctl.
+	CompressThreshold int
+	// ValueWarnSize logs an error for every value of keep, update or
+	// PutStatic of this many bytes or more, as stored after compression,
+	// default 512KiB. Values over MaxValueSize, default 1.5MiB less 64KiB for
+	// the key and request, fail with ErrValueTooLarge without reaching etcd,
+	// whose --max-request-bytes would reject them less clearly.
+	ValueWarnSize int
+	MaxValueSize  int
+	// MaxLeases caps the leases this instance keeps alive at once, each
+	// with its own keepalive goroutine, so a caller keeping keys in a loop
+	// gets ErrLeaseLimitExceeded instead of exhausting etcd and the process.
+	// A lost lease is re-granted within it. 0 sets no limit.
+	MaxLeases int
+
+	// Retry is applied to get, getByPrefix, keep, update and del
+	Retry RetryPolicy
+
+	// TLS is used as is when set, otherwise it is built from the files below
+	TLS *tls.Config
+	// CAFile verifies the server, CertFile and KeyFile authenticate the client
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// DialOptions are passed to grpc when dialing, e.g. keepalive params or
+	// interceptors. They apply after the defaults of clientv3 but before the
+	// transport credentials and dialer it always sets, so the TLS settings
+	// above, or plain text without them, win over any credentials option
+	// given here. Interceptors must be chained with
+	// grpc.WithChainUnaryInterceptor, clientv3 sets the single one itself.
+	DialOptions []grpc.DialOption
+	// MaxCallSendMsgSize and MaxCallRecvMsgSize limit request and response
+	// sizes, 0 keeps the clientv3 defaults of 2MiB and math.MaxInt32. A
+	// request over the server's --max-request-bytes fails whatever the limit.
+	MaxCallSendMsgSize int
+	MaxCallRecvMsgSize int
+
+	// Username and Password authenticate against an etcd cluster with auth
+	// enabled, they are never logged
+	Username string
+	Password string
+
+	// HealthCheckInterval is how often the endpoints are probed, when none
+	// answers the client is rebuilt with a backoff doubling from
+	// ReconnectBackoff up to ReconnectMaxBackoff
+	HealthCheckInterval time.Duration
+	ReconnectBackoff    time.Duration
+	ReconnectMaxBackoff time.Duration
+	// SecondaryEndpoints are a standby cluster, e.g. in another region. When
+	// the primary Endpoints still do not answer once the reconnect backoff
+	// reached ReconnectMaxBackoff, the client fails over to them and puts the
+	// kept keys there, unless SecondaryReadOnly makes every write fail with
+	// ErrReadOnly meanwhile. FailBack returns to the primary as soon as one
+	// of its endpoints answers again, the kept keys are put there anew.
+	SecondaryEndpoints []string
+	SecondaryReadOnly  bool
+	FailBack           bool
+	// ReconcileInterval is how often every kept key is read back and put
+	// again on a fresh lease when it is missing or no longer holds the value
+	// and lease of this instance, e.g. deleted by hand. 0 never checks.
+	ReconcileInterval time.Duration
+	// OnReconnect is called after the client got rebuilt and every kept key
+	// re-put, watches of the old client are closed and must be re-established
+	OnReconnect func()
+	// OnLeaseLost is called with each kept key whose lease stopped renewing
+	// unexpectedly, before the key is re-granted on a new lease
+	OnLeaseLost func(key string)
+	// OnEventLag is called with the lag of every watch event before its
+	// WatchFunc, from when its response was received, so a slow consumer
+	// shows as a growing lag
+	OnEventLag func(lag time.Duration)
+	// Logger defaults to github.com/pion/ion/log, NopLogger silences Etcd
+	Logger Logger
+	// LogSample keeps only 1 in LogSample Info and Debug logs of each kind,
+	// see SampledLogger, errors always log. 0 or 1 keeps every log.
+	LogSample int
+	// TracerProvider traces every operation as a child of the span in its
+	// context, there is no tracing when it is nil
+	TracerProvider trace.TracerProvider
+}
+
+func (c *Config) setDefaults() error {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.GrantTTL == 0 {
+		c.GrantTTL = defaultGrantTimeout * time.Second
+	}
+	if c.OperationTimeout == 0 {
+		c.OperationTimeout = defaultOperationTimeout
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if c.ReconnectBackoff == 0 {
+		c.ReconnectBackoff = defaultReconnectBackoff
+	}
+	if c.ReconnectMaxBackoff == 0 {
+		c.ReconnectMaxBackoff = defaultReconnectMaxBackoff
+	}
+	if c.Logger == nil {
+		c.Logger = ionLogger{}
+	}
+	if c.LogSample < 0 {
+		return errors.New("LogSample must not be negative")
+	}
+	if _, sampled := c.Logger.(*sampledLogger); !sampled {
+		c.Logger = SampledLogger(c.Logger, c.LogSample)
+	}
+	if c.DiscoverySRV != "" {
+		if len(c.Endpoints) > 0 {
+			return errors.New("set either Endpoints or DiscoverySRV")
+		}
+		if c.Resolver == nil {
+			c.Resolver = net.DefaultResolver
+		}
+	}
+	if err := c.Retry.setDefaults(); err != nil {
+		return err
+	}
+	if c.SubscribeBuffer == 0 {
+		c.SubscribeBuffer = defaultSubscribeBuffer
+	}
+	if c.SubscribeBuffer < 0 {
+		return fmt.Errorf("negative SubscribeBuffer %d", c.SubscribeBuffer)
+	}
+	if c.ValueWarnSize == 0 {
+		c.ValueWarnSize = defaultValueWarnSize
+	}
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = defaultMaxValueSize
+	}
+	if c.ValueWarnSize < 0 || c.MaxValueSize < 0 {
+		return fmt.Errorf("negative value size limits warn=%d max=%d", c.ValueWarnSize, c.MaxValueSize)
+	}
+	if c.MaxLeases < 0 {
+		return fmt.Errorf("negative MaxLeases %d", c.MaxLeases)
+	}
+	if c.CompressThreshold < 0 {
+		return fmt.Errorf("negative CompressThreshold %d", c.CompressThreshold)
+	}
+	if c.UpdateWindow < 0 {
+		return fmt.Errorf("negative UpdateWindow %v", c.UpdateWindow)
+	}
+	if c.MaxCallSendMsgSize < 0 || c.MaxCallRecvMsgSize < 0 {
+		return fmt.Errorf("negative message size limits send=%d recv=%d", c.MaxCallSendMsgSize, c.MaxCallRecvMsgSize)
+	}
+	if c.GrantTTL < time.Second {
+		return fmt.Errorf("GrantTTL %v is less than 1s", c.GrantTTL)
+	}
+	if (c.MinGrantTTL == 0) != (c.MaxGrantTTL == 0) {
+		return errors.New("set both MinGrantTTL and MaxGrantTTL or neither")
+	}
+	if c.adaptive() {
+		if c.MinGrantTTL < time.Second || c.MaxGrantTTL < c.MinGrantTTL {
+			return fmt.Errorf("adaptive ttl bounds min=%v max=%v, want 1s <= min <= max", c.MinGrantTTL, c.MaxGrantTTL)
+		}
+		if c.TTLAdaptInterval == 0 {
+			c.TTLAdaptInterval = defaultTTLAdaptInterval
+		}
+		if c.TTLAdaptInterval < 0 {
+			return fmt.Errorf("negative TTLAdaptInterval %v", c.TTLAdaptInterval)
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns nil when no TLS is configured
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.TLS != nil {
+		return c.TLS, nil
+	}
+	if c.CAFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("etcd tls: CertFile and KeyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd tls: load client cert %s: %w", c.CertFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcd tls: read ca %s: %w", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("etcd tls: no certificate found in ca %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
@@ -0,0 +1,256 @@
+package discovery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/etcd/pkg/transport"
+	"google.golang.org/grpc"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var cfg Config
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DialTimeout != defaultDialTimeout || cfg.OperationTimeout != defaultOperationTimeout ||
+		cfg.GrantTTL != defaultGrantTimeout*time.Second {
+		t.Fatalf("unexpected defaults %+v", cfg)
+	}
+}
+
+func TestConfigGrantTTL(t *testing.T) {
+	if _, err := newEtcdWithConfig(Config{GrantTTL: 500 * time.Millisecond}); err == nil {
+		t.Fatal("expected error for GrantTTL below 1s")
+	}
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// writeCert signs a certificate with parent, or self-signs when parent is nil,
+// and writes <name>.pem and <name>-key.pem into dir
+func writeCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return &testCert{cert: cert, key: key}
+}
+
+func writeTestPKI(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ion-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	now := time.Now()
+	ca := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ion test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "etcd"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "ion"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return dir
+}
+
+func TestConfigTLS(t *testing.T) {
+	dir := writeTestPKI(t)
+	_, ep := startEtcd(t, func(cfg *embed.Config) {
+		u := cfg.LCUrls[0]
+		u.Scheme = "https"
+		cfg.LCUrls, cfg.ACUrls = []url.URL{u}, []url.URL{u}
+		cfg.ClientTLSInfo = transport.TLSInfo{
+			CertFile:       filepath.Join(dir, "server.pem"),
+			KeyFile:        filepath.Join(dir, "server-key.pem"),
+			TrustedCAFile:  filepath.Join(dir, "ca.pem"),
+			ClientCertAuth: true,
+		}
+	})
+	e := newTestEtcd(t, Config{
+		Endpoints: []string{"https://" + ep},
+		CAFile:    filepath.Join(dir, "ca.pem"),
+		CertFile:  filepath.Join(dir, "client.pem"),
+		KeyFile:   filepath.Join(dir, "client-key.pem"),
+	})
+	if err := e.keep("ion://test/tls", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.get("ion://test/tls"); err != nil || v != "v" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+}
+
+func TestConfigTLSBadFiles(t *testing.T) {
+	dir := writeTestPKI(t)
+	cfgs := []Config{
+		{CertFile: filepath.Join(dir, "client.pem")},
+		{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "client-key.pem")},
+		{CAFile: filepath.Join(dir, "client-key.pem")},
+	}
+	for _, cfg := range cfgs {
+		if _, err := newEtcdWithConfig(cfg); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestConfigAuth(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	root, err := newEtcd([]string{ep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, step := range []func() error{
+		func() error { _, err := root.client.RoleAdd(ctx, "root"); return err },
+		func() error { _, err := root.client.UserAdd(ctx, "root", "secret"); return err },
+		func() error { _, err := root.client.UserGrantRole(ctx, "root", "root"); return err },
+		func() error { _, err := root.client.AuthEnable(ctx); return err },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.close()
+
+	e := newTestEtcd(t, Config{Endpoints: []string{ep}, Username: "root", Password: "secret"})
+	if err := e.keep("ion://test/auth", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newEtcdWithConfig(Config{Endpoints: []string{ep}, Username: "root", Password: "wrong"})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want ErrAuthFailed", err)
+	}
+}
+
+type recordLogger struct {
+	mu    sync.Mutex
+	infos []string
+}
+
+func (l *recordLogger) Errorf(format string, v ...interface{}) {}
+func (l *recordLogger) Debugf(format string, v ...interface{}) {}
+func (l *recordLogger) Infof(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.infos = append(l.infos, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func TestConfigLogger(t *testing.T) {
+	var c Config
+	c.setDefaults()
+	if _, ok := c.Logger.(ionLogger); !ok {
+		t.Fatalf("default logger %T", c.Logger)
+	}
+
+	l := &recordLogger{}
+	e := newTestEtcd(t, Config{Logger: l})
+	e.keep("ion://test/logger", "v")
+	l.mu.Lock()
+	n := len(l.infos)
+	l.mu.Unlock()
+	if n == 0 {
+		t.Fatal("keep logged nothing to the configured logger")
+	}
+
+	// logging without a logger must not panic
+	var nilEtcd *Etcd
+	nilEtcd.log().Errorf("no panic")
+	(&Etcd{}).log().Infof("no panic")
+}
+
+func TestConfigDialOptions(t *testing.T) {
+	_, ep := startEtcd(t, func(cfg *embed.Config) { cfg.MaxRequestBytes = 4 << 20 })
+	value := strings.Repeat("x", 3<<20)
+
+	var calls int32
+	count := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		atomic.AddInt32(&calls, 1)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	// MaxValueSize would reject the value before grpc sees it
+	e := newTestEtcd(t, Config{
+		Endpoints:    []string{ep},
+		DialOptions:  []grpc.DialOption{grpc.WithChainUnaryInterceptor(count)},
+		MaxValueSize: 4 << 20,
+	})
+	if err := e.keep("ion://test/dial/big", value); err == nil {
+		t.Fatal("3MiB put within the default 2MiB send limit")
+	}
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Fatal("dial option interceptor not called")
+	}
+
+	e = newTestEtcd(t, Config{Endpoints: []string{ep}, MaxCallSendMsgSize: 4 << 20, MaxValueSize: 4 << 20})
+	if err := e.keep("ion://test/dial/big", value); err != nil {
+		t.Fatalf("put with a raised send limit: %v", err)
+	}
+	e = newTestEtcd(t, Config{Endpoints: []string{ep}, MaxCallRecvMsgSize: 1 << 20})
+	if _, err := e.get("ion://test/dial/big"); err == nil {
+		t.Fatal("3MiB get within a 1MiB receive limit")
+	}
+
+	var c Config
+	c.MaxCallRecvMsgSize = -1
+	if err := c.setDefaults(); err == nil {
+		t.Fatal("negative receive limit accepted")
+	}
+}
@@ -0,0 +1,59 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Consistency is how up to date a read must be
+type Consistency int
+
+const (
+	// Linearizable reads are confirmed by a quorum and see every write
+	// acknowledged before they started. This is the default, and the one for
+	// coordination: locks, leadership, compare and swap.
+	Linearizable Consistency = iota
+	// Serializable reads are answered by the member asked from its own
+	// store, without a quorum round trip. They are cheaper and keep working
+	// while the cluster has no leader, but may miss writes the member has
+	// not applied yet, for as long as it lags or is partitioned. Fine for
+	// routing lookups that can live with a node list a moment old.
+	Serializable
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case Linearizable:
+		return "linearizable"
+	case Serializable:
+		return "serializable"
+	}
+	return "unknown"
+}
+
+// consistencyKey carries the Consistency of the reads made with a context
+type consistencyKey struct{}
+
+// withConsistency makes the reads with ctx of consistency c
+func withConsistency(ctx context.Context, c Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, c)
+}
+
+// readOpts returns the options of a read with ctx, opts included
+func readOpts(ctx context.Context, opts ...clientv3.OpOption) []clientv3.OpOption {
+	if c, _ := ctx.Value(consistencyKey{}).(Consistency); c == Serializable {
+		opts = append(opts, clientv3.WithSerializable())
+	}
+	return opts
+}
+
+// getConsistent is get with consistency c
+func (e *Etcd) getConsistent(key string, c Consistency) (string, error) {
+	return e.getCtx(withConsistency(context.Background(), c), key)
+}
+
+// getByPrefixConsistent is getByPrefix with consistency c
+func (e *Etcd) getByPrefixConsistent(prefix string, c Consistency) (map[string]string, error) {
+	return e.getByPrefixCtx(withConsistency(context.Background(), c), prefix)
+}
@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+func TestReadConsistency(t *testing.T) {
+	var mu sync.Mutex
+	var serializable []bool
+	record := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if r, ok := req.(*etcdserverpb.RangeRequest); ok {
+			mu.Lock()
+			serializable = append(serializable, r.Serializable)
+			mu.Unlock()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	e := newTestEtcd(t, Config{DialOptions: []grpc.DialOption{grpc.WithChainUnaryInterceptor(record)}})
+	key := "ion://test/consistency/a"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	last := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return serializable[len(serializable)-1]
+	}
+
+	if v, err := e.get(key); err != nil || v != "v" || last() {
+		t.Fatalf("get = %q, %v, serializable %v, want linearizable by default", v, err, last())
+	}
+	if v, err := e.getConsistent(key, Serializable); err != nil || v != "v" || !last() {
+		t.Fatalf("serializable get = %q, %v, serializable %v", v, err, last())
+	}
+	if v, err := e.getConsistent(key, Linearizable); err != nil || v != "v" || last() {
+		t.Fatalf("linearizable get = %q, %v, serializable %v", v, err, last())
+	}
+	if m, err := e.getByPrefixConsistent("ion://test/consistency/", Serializable); err != nil || m[key] != "v" || !last() {
+		t.Fatalf("serializable getByPrefix = %v, %v, serializable %v", m, err, last())
+	}
+	if _, err := e.getByPrefix("ion://test/consistency/"); err != nil || last() {
+		t.Fatalf("getByPrefix err %v, serializable %v, want linearizable by default", err, last())
+	}
+}
@@ -0,0 +1,383 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ion/log"
+)
+
+const (
+	defaultConsulAddress = "http://127.0.0.1:8500"
+	// consul rejects session TTLs below 10s
+	defaultConsulTTL  = time.Second * 10
+	consulWatchWait   = time.Minute
+	consulRetryPeriod = time.Second
+)
+
+// ConsulConfig configures a Consul backed Registry
+type ConsulConfig struct {
+	// Address of the consul agent, default http://127.0.0.1:8500
+	Address string
+	// Token is sent as X-Consul-Token when set
+	Token string
+	// TTL of the session kept keys are bound to, default and minimum 10s
+	TTL    time.Duration
+	Client *http.Client
+}
+
+// Consul is a Registry on the Consul KV store. Keys are stored path escaped
+// as a single segment, e.g. ion:%2F%2Fnode%2F<ip>:<port>, and read back as
+// the etcd backend lays them out.
+// Every kept key is acquired by one session with a TTL health check and
+// the delete behavior, the session is renewed like an etcd lease keepalive
+// and consul removes all kept keys once the process stops renewing it.
+type Consul struct {
+	cfg ConsulConfig
+
+	mu      sync.Mutex
+	session string
+	kept    map[string]string
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+var _ Registry = (*Consul)(nil)
+
+type consulKV struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+func NewConsul(cfg ConsulConfig) (*Consul, error) {
+	if cfg.Address == "" {
+		cfg.Address = defaultConsulAddress
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultConsulTTL
+	}
+	if cfg.TTL < defaultConsulTTL {
+		return nil, fmt.Errorf("consul session TTL %v is less than 10s", cfg.TTL)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	c := &Consul{
+		cfg:  cfg,
+		kept: make(map[string]string),
+		ctx:  ctx,
+		stop: stop,
+	}
+	session, err := c.createSession()
+	if err != nil {
+		stop()
+		log.Errorf("NewConsul err=%v", err)
+		return nil, err
+	}
+	c.session = session
+	c.wg.Add(1)
+	go c.renew()
+	return c, nil
+}
+
+// consulKVPath is the KV endpoint of key. key is stored path escaped as one
+// segment, so the // of ion:// never reaches a router that cleans paths,
+// and escaped again for the URL so consul decodes it to the stored form.
+func consulKVPath(key string) string {
+	return "/v1/kv/" + url.PathEscape(url.PathEscape(key))
+}
+
+// consulKey is the key consul stores as k. Escaping goes byte by byte, so
+// the stored form of a prefix is a prefix of every stored key under it.
+func consulKey(k string) string {
+	if key, err := url.PathUnescape(k); err == nil {
+		return key
+	}
+	return k
+}
+
+func (c *Consul) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := strings.TrimRight(c.cfg.Address, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", c.cfg.Token)
+	}
+	return c.cfg.Client.Do(req)
+}
+
+// call performs a request bounded by the session TTL and decodes a JSON
+// reply into out, found is false on 404
+func (c *Consul) call(method, path string, query url.Values, body []byte, out interface{}) (found bool, err error) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.TTL)
+	defer cancel()
+	resp, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("consul %s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	if out != nil && len(data) > 0 {
+		return true, json.Unmarshal(data, out)
+	}
+	return true, nil
+}
+
+func (c *Consul) createSession() (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"Name":      "ion",
+		"TTL":       c.cfg.TTL.String(),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	var resp struct{ ID string }
+	if _, err := c.call(http.MethodPut, "/v1/session/create", nil, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// renew keeps the session alive at half its TTL, a session consul no
+// longer knows is recreated and every kept key acquired again
+func (c *Consul) renew() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(c.cfg.TTL / 2):
+		}
+		c.mu.Lock()
+		session := c.session
+		c.mu.Unlock()
+		found, err := c.call(http.MethodPut, "/v1/session/renew/"+session, nil, nil, nil)
+		if err != nil {
+			log.Errorf("Consul.renew session=%s %v", session, err)
+			continue
+		}
+		if found {
+			continue
+		}
+		log.Errorf("Consul.renew session=%s expired", session)
+		if err := c.recreate(); err != nil {
+			log.Errorf("Consul.renew recreate %v", err)
+		}
+	}
+}
+
+func (c *Consul) recreate() error {
+	session, err := c.createSession()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.session = session
+	kept := make(map[string]string, len(c.kept))
+	for k, v := range c.kept {
+		kept[k] = v
+	}
+	c.mu.Unlock()
+	for k, v := range kept {
+		if err := c.acquire(session, k, v); err != nil {
+			log.Errorf("Consul.renew re-put %s %v", k, err)
+		}
+	}
+	return nil
+}
+
+func (c *Consul) acquire(session, key, value string) error {
+	var ok bool
+	q := url.Values{"acquire": {session}}
+	if _, err := c.call(http.MethodPut, consulKVPath(key), q, []byte(value), &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("consul key %s is held by another session", key)
+	}
+	return nil
+}
+
+func (c *Consul) Keep(key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if err = c.acquire(session, key, value); err != nil {
+		log.Errorf("Consul.Keep %s %v", key, err)
+		return err
+	}
+	c.mu.Lock()
+	c.kept[key] = value
+	c.mu.Unlock()
+	return nil
+}
+
+// Update acquires key again, the holding session may change the value
+func (c *Consul) Update(key, value string) error {
+	return c.Keep(key, value)
+}
+
+func (c *Consul) Del(key string) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	c.mu.Lock()
+	delete(c.kept, key)
+	c.mu.Unlock()
+	_, err = c.call(http.MethodDelete, consulKVPath(key), nil, nil, nil)
+	return err
+}
+
+func (c *Consul) Get(key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	var kvs []consulKV
+	found, err := c.call(http.MethodGet, consulKVPath(key), nil, nil, &kvs)
+	if err != nil {
+		return "", err
+	}
+	if !found || len(kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return string(kvs[0].Value), nil
+}
+
+func (c *Consul) GetByPrefix(prefix string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	var kvs []consulKV
+	if _, err = c.call(http.MethodGet, consulKVPath(prefix), url.Values{"recurse": {""}}, nil, &kvs); err != nil {
+		return nil, err
+	}
+	m = make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		m[consulKey(kv.Key)] = string(kv.Value)
+	}
+	return m, nil
+}
+
+// Watch polls key with consul blocking queries and diffs consecutive
+// results into events, consul has no event stream of its own
+func (c *Consul) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	ctx, cancel := context.WithCancel(c.ctx)
+	prev, index, err := c.list(ctx, key, prefix, 0)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for ctx.Err() == nil {
+			cur, next, err := c.list(ctx, key, prefix, index)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Errorf("Consul.Watch %s %v", key, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(consulRetryPeriod):
+				}
+				continue
+			}
+			if next < index {
+				// the index went backwards, consul asks to start over
+				next = 0
+			}
+			index = next
+			diffSnapshots(prev, cur, fn)
+			prev = cur
+		}
+	}()
+	return cancel, nil
+}
+
+// list blocks until the consul index of key passes index, or a wait expires
+func (c *Consul) list(ctx context.Context, key string, prefix bool, index uint64) (map[string]consulKV, uint64, error) {
+	q := url.Values{}
+	if prefix {
+		q.Set("recurse", "")
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", consulWatchWait.String())
+	}
+	resp, err := c.do(ctx, http.MethodGet, consulKVPath(key), q, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	m := make(map[string]consulKV)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return m, next, nil
+	case http.StatusOK:
+	default:
+		return nil, 0, fmt.Errorf("consul watch %s: %s", key, resp.Status)
+	}
+	var kvs []consulKV
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+	for _, kv := range kvs {
+		m[consulKey(kv.Key)] = kv
+	}
+	return m, next, nil
+}
+
+// diffSnapshots calls fn for every key added, modified or removed between prev and cur
+func diffSnapshots(prev, cur map[string]consulKV, fn WatchFunc) {
+	for k, kv := range cur {
+		if old, ok := prev[k]; !ok || old.ModifyIndex != kv.ModifyIndex {
+			fn(EventPut, k, string(kv.Value))
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			fn(EventDelete, k, "")
+		}
+	}
+}
+
+// Close destroys the session, which deletes every kept key
+func (c *Consul) Close() error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	_, err := c.call(http.MethodPut, "/v1/session/destroy/"+session, nil, nil, nil)
+	c.stop()
+	c.wg.Wait()
+	return err
+}
@@ -0,0 +1,226 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	prev := map[string]consulKV{
+		"ion://node/a": {Key: "ion://node/a", Value: []byte("1"), ModifyIndex: 1},
+		"ion://node/b": {Key: "ion://node/b", Value: []byte("1"), ModifyIndex: 2},
+		"ion://node/c": {Key: "ion://node/c", Value: []byte("1"), ModifyIndex: 3},
+	}
+	cur := map[string]consulKV{
+		"ion://node/a": {Key: "ion://node/a", Value: []byte("1"), ModifyIndex: 1},
+		"ion://node/b": {Key: "ion://node/b", Value: []byte("2"), ModifyIndex: 4},
+		"ion://node/d": {Key: "ion://node/d", Value: []byte("1"), ModifyIndex: 5},
+	}
+	var got []string
+	diffSnapshots(prev, cur, func(typ EventType, key, value string) {
+		got = append(got, typ.String()+" "+key+" "+value)
+	})
+	sort.Strings(got)
+	want := []string{
+		"DELETE ion://node/c ",
+		"PUT ion://node/b 2",
+		"PUT ion://node/d 1",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("events = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestNewConsulTTL(t *testing.T) {
+	if _, err := NewConsul(ConsulConfig{TTL: 5 * time.Second}); err == nil {
+		t.Fatal("expected error for session TTL below 10s")
+	}
+}
+
+// consulTestServer is a consul agent with the session and KV endpoints the
+// registry uses, blocking queries wait until the index moves off theirs
+type consulTestServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	index   uint64
+	kv      map[string]consulKV
+	changed chan struct{}
+	// paths and indexes of the blocking queries, "" for a plain read
+	paths   []string
+	queries []string
+}
+
+func startConsulTestServer(t *testing.T) *consulTestServer {
+	s := &consulTestServer{
+		index:   1,
+		kv:      make(map[string]consulKV),
+		changed: make(chan struct{}),
+	}
+	// behind a mux like a real deployment, it redirects paths holding //
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", s.serve)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// bump moves the index to index and wakes the blocked queries, mu held
+func (s *consulTestServer) bump(index uint64) {
+	s.index = index
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// restore moves the index backwards like a snapshot restore does
+func (s *consulTestServer) restore() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bump(1)
+}
+
+func (s *consulTestServer) watchQueries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+func (s *consulTestServer) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case path == "/v1/session/create":
+		json.NewEncoder(w).Encode(map[string]string{"ID": "session"})
+		return
+	case strings.HasPrefix(path, "/v1/session/"):
+		return
+	case !strings.HasPrefix(path, "/v1/kv/"):
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(r.Body)
+		s.paths = append(s.paths, path)
+		s.bump(s.index + 1)
+		s.kv[key] = consulKV{Key: key, Value: value, ModifyIndex: s.index}
+		w.Write([]byte("true"))
+		return
+	case http.MethodDelete:
+		delete(s.kv, key)
+		s.bump(s.index + 1)
+		return
+	}
+	s.paths = append(s.paths, path)
+	if _, ok := q["index"]; ok {
+		s.queries = append(s.queries, q.Get("index"))
+		index, _ := strconv.ParseUint(q.Get("index"), 10, 64)
+		for s.index == index {
+			changed := s.changed
+			s.mu.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+			}
+			s.mu.Lock()
+			if r.Context().Err() != nil {
+				return
+			}
+		}
+	} else if _, ok := q["recurse"]; ok {
+		s.queries = append(s.queries, "")
+	}
+	var kvs []consulKV
+	for k, kv := range s.kv {
+		if k == key || (q["recurse"] != nil && strings.HasPrefix(k, key)) {
+			kvs = append(kvs, kv)
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(s.index, 10))
+	if len(kvs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func TestConsulWatch(t *testing.T) {
+	s := startConsulTestServer(t)
+	c, err := NewConsul(ConsulConfig{Address: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fn, ch := collectEvents()
+	stop, err := c.Watch("ion://node/", true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	c.Keep("ion://node/a", "1")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "1"})
+	c.Keep("ion://room/a", "x")
+	c.Keep("ion://node/a", "2")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "2"})
+
+	// every blocking query waits on the index of the previous reply
+	queries := s.watchQueries()
+	if len(queries) < 3 || queries[0] != "" || queries[1] != "1" {
+		t.Fatalf("queries = %q", queries)
+	}
+
+	// an index that went backwards is dropped and the prefix read again
+	s.restore()
+	waitFor(t, "a fresh read after the index reset", func() bool {
+		q := s.watchQueries()
+		return len(q) > len(queries) && q[len(q)-1] == "1" && q[len(q)-2] == ""
+	})
+	c.Del("ion://node/a")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/a", ""})
+}
+
+func TestConsulKeyEscape(t *testing.T) {
+	s := startConsulTestServer(t)
+	c, err := NewConsul(ConsulConfig{Address: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	key := "ion://node/a b%c?d#e"
+	if err := c.Keep(key, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(key); err != nil || v != "1" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	if m, err := c.GetByPrefix("ion://node/"); err != nil || m[key] != "1" {
+		t.Fatalf("GetByPrefix = %v, %v", m, err)
+	}
+	stored := "ion:%2F%2Fnode%2Fa%20b%25c%3Fd%23e"
+	want := "/v1/kv/ion:%252F%252Fnode%252Fa%2520b%2525c%253Fd%2523e"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.paths) != 3 || s.paths[0] != want || s.paths[1] != want {
+		t.Fatalf("paths = %q, want %s", s.paths, want)
+	}
+	if _, ok := s.kv[stored]; !ok {
+		t.Fatalf("kv = %v, want %s", s.kv, stored)
+	}
+}
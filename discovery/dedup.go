@@ -0,0 +1,43 @@
+package discovery
+
+import "sync"
+
+// dedup remembers the value last delivered per key
+type dedup struct {
+	mu   sync.Mutex
+	last map[string]string
+}
+
+func newDedup() *dedup {
+	return &dedup{last: make(map[string]string)}
+}
+
+// fresh reports whether an event changes what was last delivered for key,
+// the first value of a key or after its delete always does
+func (d *dedup) fresh(eventType EventType, key, value string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch eventType {
+	case EventPut:
+		if last, ok := d.last[key]; ok && last == value {
+			return false
+		}
+		d.last[key] = value
+	case EventDelete:
+		delete(d.last, key)
+	}
+	return true
+}
+
+// Dedup wraps fn for Watch so a put of the value fn last got for that key,
+// such as an idempotent heartbeat, is not delivered. The first value seen
+// of a key always is, as is every delete and the put after it. The values
+// of every key watched are kept until deleted.
+func Dedup(fn WatchFunc) WatchFunc {
+	d := newDedup()
+	return func(eventType EventType, key, value string) {
+		if d.fresh(eventType, key, value) {
+			fn(eventType, key, value)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	const prefix = "ion://test/dedup/"
+	fn, watched := collectEvents()
+	if _, err := e.Watch(prefix, true, Dedup(fn)); err != nil {
+		t.Fatal(err)
+	}
+	_, events, cancel, err := e.SubscribeWithOptions(prefix, SubscribeOptions{Dedup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	for _, p := range []struct{ key, value string }{
+		{"a", "1"}, {"a", "1"}, {"a", "2"}, {"a", "2"}, {"b", "1"}, {"b", "1"},
+		{"a", ""}, {"a", "2"}, {"a", "2"}, {"end", "1"},
+	} {
+		var err error
+		if p.value == "" {
+			err = e.del(prefix + p.key)
+		} else {
+			err = e.PutStatic(prefix+p.key, p.value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []watchEvent{
+		{EventPut, prefix + "a", "1"},
+		{EventPut, prefix + "a", "2"},
+		{EventPut, prefix + "b", "1"},
+		{EventDelete, prefix + "a", ""},
+		{EventPut, prefix + "a", "2"},
+		{EventPut, prefix + "end", "1"},
+	}
+	for _, w := range want {
+		select {
+		case got := <-watched:
+			if got != w {
+				t.Fatalf("watch event %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no watch event, want %+v", w)
+		}
+		select {
+		case got := <-events:
+			if got.Type != w.typ || got.Key != w.key || got.Value != w.value {
+				t.Fatalf("subscription event %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no subscription event, want %+v", w)
+		}
+	}
+	select {
+	case got := <-watched:
+		t.Fatalf("extra watch event %+v", got)
+	case got := <-events:
+		t.Fatalf("extra subscription event %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// attempts of ApplyDesired when the keys change between its read and write
+const applyDesiredAttempts = 3
+
+// errDesiredConflict is ApplyDesired giving up on keys that keep changing
+var errDesiredConflict = errors.New("keys changed while applying, retry")
+
+// ApplyDesired makes the keys under prefix exactly desired, with the fewest
+// writes: missing keys are put, keys holding another value are updated and
+// keys not in desired deleted, keys already holding their value are not
+// written at all. The keys are static like PutStatic ones. The changes go
+// in one transaction guarded by the revisions read, so a concurrent write
+// makes it read and diff again; more than maxTxnOps changes take one
+// transaction per maxTxnOps, each atomic on its own.
+func (e *Etcd) ApplyDesired(prefix string, desired map[string]string) (added, updated, removed int, err error) {
+	defer observe(opPut, time.Now(), &err)
+	for k := range desired {
+		if !strings.HasPrefix(k, prefix) {
+			return 0, 0, 0, fmt.Errorf("desired key %s is not under %s", k, prefix)
+		}
+	}
+	if err := e.writable(); err != nil {
+		return 0, 0, 0, err
+	}
+	for k, v := range desired {
+		if err := e.checkValue(k, v); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	for attempt := 0; attempt < applyDesiredAttempts; attempt++ {
+		kvs, err := e.getByPrefixKV(prefix)
+		if err != nil {
+			return added, updated, removed, err
+		}
+		actual := make(map[string]KV, len(kvs))
+		for _, kv := range kvs {
+			actual[kv.Key] = kv
+		}
+		var changes []desiredChange
+		for k, v := range desired {
+			kv, ok := actual[k]
+			switch {
+			case !ok:
+				changes = append(changes, desiredChange{key: k, value: v, put: true})
+			case kv.Value != v:
+				changes = append(changes, desiredChange{key: k, value: v, put: true, rev: kv.ModRevision})
+			}
+		}
+		for k, kv := range actual {
+			if _, ok := desired[k]; !ok {
+				changes = append(changes, desiredChange{key: k, rev: kv.ModRevision})
+			}
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].key < changes[j].key })
+
+		conflict := false
+		for len(changes) > 0 {
+			n := len(changes)
+			if n > maxTxnOps {
+				n = maxTxnOps
+			}
+			ok, err := e.applyChanges(changes[:n])
+			if err != nil {
+				e.log().Errorf("Etcd.ApplyDesired %s %v", prefix, err)
+				return added, updated, removed, err
+			}
+			if !ok {
+				conflict = true
+				break
+			}
+			for _, c := range changes[:n] {
+				switch {
+				case !c.put:
+					removed++
+				case c.rev == 0:
+					added++
+				default:
+					updated++
+				}
+			}
+			changes = changes[n:]
+		}
+		if !conflict {
+			return added, updated, removed, nil
+		}
+	}
+	return added, updated, removed, fmt.Errorf("apply desired %s: %w", prefix, errDesiredConflict)
+}
+
+// desiredChange is a put or delete of ApplyDesired, rev is the mod revision
+// of the key read or 0 when it did not exist
+type desiredChange struct {
+	key, value string
+	put        bool
+	rev        int64
+}
+
+// applyChanges writes changes in one transaction if none of their keys
+// changed since read, and reports whether it did
+func (e *Etcd) applyChanges(changes []desiredChange) (bool, error) {
+	cmps := make([]clientv3.Cmp, len(changes))
+	ops := make([]clientv3.Op, len(changes))
+	for i, c := range changes {
+		cmps[i] = clientv3.Compare(clientv3.ModRevision(c.key), "=", c.rev)
+		if c.put {
+			ops[i] = clientv3.OpPut(c.key, e.encodeValue(c.value))
+		} else {
+			ops[i] = clientv3.OpDelete(c.key)
+		}
+		e.dropPending(c.key)
+	}
+	ctx, cancel := e.opContext(e.ctx)
+	resp, err := e.cli().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	cancel()
+	if err != nil {
+		return false, etcdError(err)
+	}
+	if resp.Succeeded {
+		e.liveKeyIDLock.Lock()
+		for _, c := range changes {
+			e.untrack(c.key)
+		}
+		e.liveKeyIDLock.Unlock()
+	}
+	return resp.Succeeded, nil
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestApplyDesired(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	const prefix = "ion://test/desired/"
+	for k, v := range map[string]string{"same": "1", "changed": "old", "gone": "x"} {
+		if err := e.PutStatic(prefix+k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	same := func() int64 {
+		kvs, err := e.getByPrefixKV(prefix + "same")
+		if err != nil || len(kvs) != 1 {
+			t.Fatalf("same = %v, %v", kvs, err)
+		}
+		return kvs[0].ModRevision
+	}
+	rev := same()
+
+	desired := map[string]string{prefix + "same": "1", prefix + "changed": "new", prefix + "added": "4"}
+	added, updated, removed, err := e.ApplyDesired(prefix, desired)
+	if err != nil || added != 1 || updated != 1 || removed != 1 {
+		t.Fatalf("ApplyDesired = %d added, %d updated, %d removed, %v", added, updated, removed, err)
+	}
+	if m, err := e.getByPrefix(prefix); err != nil || !reflect.DeepEqual(m, desired) {
+		t.Fatalf("keys %v, %v, want %v", m, err, desired)
+	}
+	if r := same(); r != rev {
+		t.Fatalf("unchanged key rewritten, revision %d was %d", r, rev)
+	}
+
+	// applying again writes nothing
+	added, updated, removed, err = e.ApplyDesired(prefix, desired)
+	if err != nil || added+updated+removed != 0 {
+		t.Fatalf("second ApplyDesired = %d, %d, %d, %v", added, updated, removed, err)
+	}
+
+	if _, _, _, err := e.ApplyDesired(prefix, map[string]string{"ion://test/other": "v"}); err == nil {
+		t.Fatal("key outside the prefix accepted")
+	}
+
+	// more changes than one transaction takes
+	many := make(map[string]string)
+	for i := 0; i < maxTxnOps+10; i++ {
+		many[fmt.Sprintf("%s%03d", prefix, i)] = "v"
+	}
+	added, updated, removed, err = e.ApplyDesired(prefix, many)
+	if err != nil || added != maxTxnOps+10 || updated != 0 || removed != 3 {
+		t.Fatalf("large ApplyDesired = %d, %d, %d, %v", added, updated, removed, err)
+	}
+	if n, err := e.Count(prefix); err != nil || n != int64(len(many)) {
+		t.Fatalf("count %d, %v", n, err)
+	}
+}
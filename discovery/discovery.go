@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"errors"
 	"strconv"
 	"time"
 
@@ -16,7 +17,7 @@ var (
 	etcdRoom string
 	etcdRtp  string
 	etcdNode string
-	etcd     *Etcd
+	registry Registry
 	quit     chan struct{}
 )
 
@@ -26,29 +27,29 @@ func init() {
 
 func Init(ip string, port int, etcds []string) {
 	var err error
-	etcd, err = newEtcd(etcds)
+	registry, err = NewRegistry(Config{Endpoints: etcds})
 	if err != nil {
 		panic(err)
 	}
 	nodeIP = ip
 	nodePort = port
-	etcdBase = "ion://"
-	etcdRoom = etcdBase + "room"
-	etcdRtp = etcdBase + "rtp"
-	etcdNode = etcdBase + "node/" + nodeIP + ":" + strconv.Itoa(nodePort)
+	etcdBase = keyRoot.Prefix()
+	etcdRoom = Join("room").String()
+	etcdRtp = Join("rtp").String()
+	etcdNode = Join("node", nodeIP+":"+strconv.Itoa(nodePort)).String()
 
 	updateLoad()
 }
 
 func updateLoad() {
 	go func() {
-		etcd.keep(etcdNode, "")
+		registry.Keep(etcdNode, "")
 		for {
 			select {
 			case <-quit:
 				return
 			case <-time.After(time.Second):
-				etcd.update(etcdNode, getScore())
+				registry.Update(etcdNode, getScore())
 			}
 		}
 	}()
@@ -71,10 +72,10 @@ func getScore() string {
 	// test net by etcd
 	var netScore float64
 	baseTime := time.Now()
-	_, err = etcd.get("netscore")
+	_, err = registry.Get("netscore")
 	costTime := time.Since(baseTime).Nanoseconds() / 1e6
 
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
 		netScore = 0
 	} else if costTime < 300 {
 		netScore = float64(300-costTime) / 300 * 100
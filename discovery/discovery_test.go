@@ -0,0 +1,28 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateLoad(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	registry = m
+	etcdNode = "ion://node/127.0.0.1:5000"
+	fn, ch := collectEvents()
+	m.Watch(etcdNode, false, fn)
+
+	updateLoad()
+	defer Close()
+
+	expectEvent(t, ch, watchEvent{EventPut, etcdNode, ""})
+	select {
+	case ev := <-ch:
+		if ev.typ != EventPut || ev.value == "" {
+			t.Fatalf("load update = %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no load update")
+	}
+}
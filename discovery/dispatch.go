@@ -0,0 +1,69 @@
+package discovery
+
+import (
+	"context"
+	"time"
+)
+
+// events a dispatch worker queues before the watch waits for it
+const dispatchQueueSize = 64
+
+// watchDispatcher runs a WatchFunc on a fixed set of workers. The worker of
+// an event is picked by hashing its key, so the events of one key are
+// handled in order while a slow key only holds up the keys sharing its
+// worker.
+type watchDispatcher struct {
+	ctx    context.Context
+	fn     eventFunc
+	queues []chan func()
+}
+
+func newWatchDispatcher(ctx context.Context, workers int, fn eventFunc) *watchDispatcher {
+	d := &watchDispatcher{ctx: ctx, fn: fn, queues: make([]chan func(), workers)}
+	for i := range d.queues {
+		q := make(chan func(), dispatchQueueSize)
+		d.queues[i] = q
+		go func() {
+			for {
+				select {
+				case f := <-q:
+					f()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return d
+}
+
+// dispatch queues the event on the worker of key, blocking while that
+// worker's queue is full
+func (d *watchDispatcher) dispatch(received time.Time, rev int64, eventType EventType, key, value string) {
+	q := d.queues[hashKey(key)%uint32(len(d.queues))]
+	select {
+	case q <- func() { d.fn(received, rev, eventType, key, value) }:
+	case <-d.ctx.Done():
+	}
+}
+
+// flush waits until every event queued so far has been handled, or the
+// watch is done, in which case the workers may stop with events queued
+func (d *watchDispatcher) flush() {
+	// buffered so a marker reached after the wait gave up does not block
+	done := make(chan struct{}, len(d.queues))
+	for _, q := range d.queues {
+		select {
+		case q <- func() { done <- struct{}{} }:
+		case <-d.ctx.Done():
+			return
+		}
+	}
+	for range d.queues {
+		select {
+		case <-done:
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDispatcherFlushCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := make(chan struct{})
+	defer close(blocked)
+	d := newWatchDispatcher(ctx, 1, func(time.Time, int64, EventType, string, string) {
+		<-blocked
+	})
+	d.dispatch(time.Now(), 1, EventPut, "ion://test/dispatch", "v")
+
+	flushed := make(chan struct{})
+	go func() {
+		d.flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("flush returned with an event still being handled")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// closing the watch releases flush even though the worker never gets
+	// to its marker
+	cancel()
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("flush still waiting after the watch was canceled")
+	}
+}
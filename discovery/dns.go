@@ -0,0 +1,204 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/ion/log"
+)
+
+const (
+	defaultDNSTTL     = time.Second * 30
+	defaultDNSTimeout = time.Second * 5
+)
+
+// ErrReadOnly is returned by the writes of a read only Registry
+var ErrReadOnly = errors.New("registry is read only")
+
+// SRVResolver looks up SRV records, *net.Resolver implements it
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSConfig configures a DNS backed Registry
+type DNSConfig struct {
+	// Domain holds the SRV records, the nodes of service name are the
+	// targets of _<name>._<Proto>.<Domain>
+	Domain string
+	// Proto of the SRV records, default tcp
+	Proto string
+	// TTL is how often Watch resolves again, default 30s. net does not hand
+	// out the record TTL, so keep it in line with the zone.
+	TTL time.Duration
+	// Timeout of one lookup, default 5s
+	Timeout time.Duration
+	// Resolver defaults to net.DefaultResolver
+	Resolver SRVResolver
+}
+
+// DNS is a read only Registry on DNS SRV records, for small fixed
+// deployments that run no etcd. It only knows the ServiceNode layout:
+// every target host:port of the record of a service is a node under
+// ion://node/<name>/<host>:<port> with the SRV priority and weight in its
+// Meta. Keep, Update and Del return ErrReadOnly.
+type DNS struct {
+	cfg DNSConfig
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+var _ Registry = (*DNS)(nil)
+
+func NewDNS(cfg DNSConfig) (*DNS, error) {
+	if cfg.Domain == "" {
+		return nil, errors.New("dns registry needs a domain")
+	}
+	if cfg.Proto == "" {
+		cfg.Proto = "tcp"
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultDNSTTL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultDNSTimeout
+	}
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.DefaultResolver
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	return &DNS{cfg: cfg, ctx: ctx, stop: stop}, nil
+}
+
+func (d *DNS) Keep(key, value string) error {
+	return ErrReadOnly
+}
+
+func (d *DNS) Update(key, value string) error {
+	return ErrReadOnly
+}
+
+func (d *DNS) Del(key string) error {
+	return ErrReadOnly
+}
+
+func (d *DNS) Get(key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	m, err := d.list(key, false)
+	if err != nil {
+		return "", err
+	}
+	v, ok := m[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (d *DNS) GetByPrefix(prefix string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	return d.list(prefix, true)
+}
+
+// Watch resolves key again every TTL and diffs consecutive results into
+// events, a failed lookup keeps the last result
+func (d *DNS) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	prev, err := d.list(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.cfg.TTL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			cur, err := d.list(key, prefix)
+			if err != nil {
+				log.Errorf("DNS.Watch %s %v", key, err)
+				continue
+			}
+			diffValues(prev, cur, fn)
+			prev = cur
+		}
+	}()
+	return cancel, nil
+}
+
+// list resolves the service of key and returns its nodes matching key
+func (d *DNS) list(key string, prefix bool) (map[string]string, error) {
+	name := strings.SplitN(strings.TrimPrefix(key, servicePrefix), "/", 2)[0]
+	if !strings.HasPrefix(key, servicePrefix) || name == "" {
+		return nil, fmt.Errorf("dns registry: %s is not under %s<name>/", key, servicePrefix)
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, d.cfg.Timeout)
+	defer cancel()
+	_, srvs, err := d.cfg.Resolver.LookupSRV(ctx, name, d.cfg.Proto, d.cfg.Domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		srvs, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	for _, srv := range srvs {
+		addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		k := serviceKey(name, addr)
+		if k != key && !(prefix && strings.HasPrefix(k, key)) {
+			continue
+		}
+		value, err := ServiceNode{
+			ID:   addr,
+			Name: name,
+			Addr: addr,
+			Meta: map[string]string{
+				"priority": strconv.Itoa(int(srv.Priority)),
+				"weight":   strconv.Itoa(int(srv.Weight)),
+			},
+		}.marshal()
+		if err != nil {
+			return nil, err
+		}
+		m[k] = value
+	}
+	return m, nil
+}
+
+// diffValues calls fn for every key added, changed or removed between prev and cur
+func diffValues(prev, cur map[string]string, fn WatchFunc) {
+	for k, v := range cur {
+		if old, ok := prev[k]; !ok || old != v {
+			fn(EventPut, k, v)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			fn(EventDelete, k, "")
+		}
+	}
+}
+
+// Close stops every watch, there is nothing kept to drop
+func (d *DNS) Close() error {
+	d.stop()
+	d.wg.Wait()
+	return nil
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubResolver struct {
+	mu      sync.Mutex
+	records map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cname := "_" + service + "._" + proto + "." + name
+	srvs, ok := r.records[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, srvs, nil
+}
+
+func (r *stubResolver) set(cname string, srvs ...*net.SRV) {
+	r.mu.Lock()
+	r.records[cname] = srvs
+	r.mu.Unlock()
+}
+
+func TestDNS(t *testing.T) {
+	r := &stubResolver{records: map[string][]*net.SRV{}}
+	r.set("_sfu._tcp.ion.local",
+		&net.SRV{Target: "sfu1.ion.local.", Port: 5000, Priority: 10, Weight: 5},
+		&net.SRV{Target: "sfu2.ion.local.", Port: 5000, Priority: 20, Weight: 1})
+	d, err := NewDNS(DNSConfig{Domain: "ion.local", Resolver: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	m, err := d.GetByPrefix("ion://node/sfu/")
+	if err != nil || len(m) != 2 {
+		t.Fatalf("GetByPrefix = %v, %v", m, err)
+	}
+	s := NewServices(d)
+	n, err := s.Get("sfu", "sfu1.ion.local:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Addr != "sfu1.ion.local:5000" || n.Meta["priority"] != "10" || n.Meta["weight"] != "5" {
+		t.Fatalf("node %+v", n)
+	}
+	if _, err := d.Get("ion://node/sfu/sfu3.ion.local:5000"); err != ErrKeyNotFound {
+		t.Fatalf("get of a missing target err = %v", err)
+	}
+	if m, err := d.GetByPrefix("ion://node/biz/"); err != nil || len(m) != 0 {
+		t.Fatalf("GetByPrefix of a missing record = %v, %v", m, err)
+	}
+	if _, err := d.GetByPrefix("ion://other/"); err == nil {
+		t.Fatal("GetByPrefix outside the node layout succeeded")
+	}
+	for _, err := range []error{d.Keep("k", "v"), d.Update("k", "v"), d.Del("k")} {
+		if err != ErrReadOnly {
+			t.Fatalf("write err = %v", err)
+		}
+	}
+}
+
+func TestDNSWatch(t *testing.T) {
+	r := &stubResolver{records: map[string][]*net.SRV{}}
+	r.set("_sfu._tcp.ion.local", &net.SRV{Target: "sfu1.ion.local.", Port: 5000})
+	d, err := NewDNS(DNSConfig{Domain: "ion.local", Resolver: r, TTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	fn, events := collectEvents()
+	if _, err := d.Watch("ion://node/sfu/", true, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	r.set("_sfu._tcp.ion.local", &net.SRV{Target: "sfu2.ion.local.", Port: 5000})
+	got := map[string]EventType{}
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			got[ev.key] = ev.typ
+		case <-time.After(time.Second):
+			t.Fatalf("events %v", got)
+		}
+	}
+	if got["ion://node/sfu/sfu1.ion.local:5000"] != EventDelete || got["ion://node/sfu/sfu2.ion.local:5000"] != EventPut {
+		t.Fatalf("events %v", got)
+	}
+}
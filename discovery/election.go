@@ -0,0 +1,197 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+// Election elects one leader among the instances campaigning on the same
+// name, e.g. the active islb. It shares the Etcd client and its session
+// lease uses the configured GrantTTL, so a dead leader is replaced once its
+// lease expires. A lost session, such as after a reconnect, is re-created
+// and an ongoing campaign or leadership campaigned again.
+type Election struct {
+	etcd   *Etcd
+	name   string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	session  *concurrency.Session
+	election *concurrency.Election
+	// value campaigned for, empty when not campaigning
+	value string
+	// closed and replaced when the session is re-created
+	renewed chan struct{}
+
+	observe chan string
+	wg      sync.WaitGroup
+}
+
+func (e *Etcd) newSession() (*concurrency.Session, error) {
+	return concurrency.NewSession(e.cli(), concurrency.WithTTL(int(e.grantTTL())))
+}
+
+// NewElection joins the election name, a key prefix in etcd
+func (e *Etcd) NewElection(name string) (*Election, error) {
+	s, err := e.newSession()
+	if err != nil {
+		e.log().Errorf("Etcd.NewElection %s %v", name, err)
+		return nil, etcdError(err)
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	el := &Election{
+		etcd:     e,
+		name:     name,
+		ctx:      ctx,
+		cancel:   cancel,
+		session:  s,
+		election: concurrency.NewElection(s, name),
+		renewed:  make(chan struct{}),
+		observe:  make(chan string, 1),
+	}
+	el.wg.Add(2)
+	go el.maintain()
+	go el.observeLoop()
+	return el, nil
+}
+
+// Campaign blocks until this instance is elected with value or ctx is done
+func (el *Election) Campaign(ctx context.Context, value string) error {
+	el.mu.Lock()
+	election := el.election
+	el.value = value
+	el.mu.Unlock()
+	err := election.Campaign(ctx, value)
+	if err != nil {
+		el.mu.Lock()
+		if el.election == election {
+			el.value = ""
+		}
+		el.mu.Unlock()
+	}
+	return err
+}
+
+// Resign gives up leadership or stops campaigning
+func (el *Election) Resign(ctx context.Context) error {
+	el.mu.Lock()
+	election := el.election
+	el.value = ""
+	el.mu.Unlock()
+	return election.Resign(ctx)
+}
+
+// IsLeader tells whether this instance is the current leader
+func (el *Election) IsLeader(ctx context.Context) (bool, error) {
+	el.mu.Lock()
+	election := el.election
+	el.mu.Unlock()
+	key := election.Key()
+	if key == "" {
+		return false, nil
+	}
+	resp, err := election.Leader(ctx)
+	if err == concurrency.ErrElectionNoLeader {
+		return false, nil
+	}
+	if err != nil {
+		return false, etcdError(err)
+	}
+	return string(resp.Kvs[0].Key) == key, nil
+}
+
+// Observe reports the value of each new leader, it is closed by Close
+func (el *Election) Observe() <-chan string {
+	return el.observe
+}
+
+// maintain re-creates the session when its lease is lost
+func (el *Election) maintain() {
+	defer el.wg.Done()
+	for {
+		el.mu.Lock()
+		done := el.session.Done()
+		el.mu.Unlock()
+		select {
+		case <-el.ctx.Done():
+			return
+		case <-done:
+		}
+		el.etcd.log().Errorf("Election %s session lost", el.name)
+		s, err := el.etcd.newSession()
+		for err != nil {
+			el.etcd.log().Errorf("Election %s new session %v", el.name, err)
+			select {
+			case <-el.ctx.Done():
+				return
+			case <-time.After(el.etcd.cfg.ReconnectBackoff):
+			}
+			s, err = el.etcd.newSession()
+		}
+		el.mu.Lock()
+		el.session = s
+		el.election = concurrency.NewElection(s, el.name)
+		election, value := el.election, el.value
+		close(el.renewed)
+		el.renewed = make(chan struct{})
+		el.mu.Unlock()
+		if value != "" {
+			go func() {
+				if err := election.Campaign(el.ctx, value); err != nil && el.ctx.Err() == nil {
+					el.etcd.log().Errorf("Election %s campaign %v", el.name, err)
+				}
+			}()
+		}
+	}
+}
+
+func (el *Election) observeLoop() {
+	defer el.wg.Done()
+	defer close(el.observe)
+	for {
+		el.mu.Lock()
+		election, renewed := el.election, el.renewed
+		el.mu.Unlock()
+		ctx, cancel := context.WithCancel(el.ctx)
+		ch := election.Observe(ctx)
+	loop:
+		for {
+			select {
+			case resp, ok := <-ch:
+				if !ok {
+					break loop
+				}
+				if len(resp.Kvs) == 0 {
+					continue
+				}
+				select {
+				case el.observe <- string(resp.Kvs[0].Value):
+				case <-el.ctx.Done():
+				}
+			case <-renewed:
+				break loop
+			}
+		}
+		cancel()
+		select {
+		case <-el.ctx.Done():
+			return
+		case <-renewed:
+		case <-time.After(watchRetryPeriod):
+		}
+	}
+}
+
+// Close leaves the election, revoking the session lease
+func (el *Election) Close() error {
+	el.cancel()
+	el.wg.Wait()
+	el.mu.Lock()
+	s := el.session
+	el.mu.Unlock()
+	return s.Close()
+}
@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func expectLeader(t *testing.T, ch <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-ch:
+			if got == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("leader %q not observed", want)
+		}
+	}
+}
+
+func TestElection(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	e1 := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	e2 := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	a, err := e1.NewElection("ion://test/election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := e2.NewElection("ion://test/election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx := context.Background()
+	if err := a.Campaign(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	elected := make(chan error, 1)
+	go func() { elected <- b.Campaign(ctx, "b") }()
+	select {
+	case err := <-elected:
+		t.Fatalf("second candidate elected while the leader is alive: %v", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	expectLeader(t, b.Observe(), "a")
+
+	if err := a.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-elected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no failover after resign")
+	}
+	expectLeader(t, a.Observe(), "b")
+}
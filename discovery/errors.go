@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrKeyNotFound is returned by get when the key does not exist
+var ErrKeyNotFound = errors.New("etcd key not found")
+
+// ErrNoSlots is returned by ClaimSlot when every slot of the pool is claimed
+var ErrNoSlots = errors.New("no free slot in pool")
+
+// ErrLeaseLimitExceeded is a new lease beyond MaxLeases, nothing is written
+var ErrLeaseLimitExceeded = errors.New("lease limit exceeded")
+
+// ErrValueTooLarge is a value over MaxValueSize, rejected without asking etcd
+var ErrValueTooLarge = errors.New("etcd value too large")
+
+// ErrConflict is Incr giving up on a key that kept changing under it
+var ErrConflict = errors.New("etcd key kept changing, retry")
+
+// ErrWaitTimeout is WaitFor reaching the deadline of its context before the
+// key got a value it waits for
+var ErrWaitTimeout = errors.New("wait for key timed out")
+
+// ErrOverflow ends a subscription with OverflowError whose reader fell behind
+var ErrOverflow = errors.New("subscription buffer overflow")
+
+// The errors below are wrapped around the etcd error that caused them, test
+// with errors.Is to decide whether to retry
+var (
+	// ErrAuthFailed is caused by rejected credentials or permissions
+	ErrAuthFailed = errors.New("etcd authentication failed")
+	// ErrTimeout is an operation that did not finish within its deadline,
+	// it may or may not have been applied
+	ErrTimeout = errors.New("etcd operation timed out")
+	// ErrConnClosed is an operation on a closed client or without any
+	// endpoint to send it to
+	ErrConnClosed = errors.New("etcd connection closed")
+	// ErrLeaseExpired is a put or renewal on a lease etcd no longer has
+	ErrLeaseExpired = errors.New("etcd lease expired")
+	// ErrCompacted is a read or watch of a revision etcd already compacted
+	ErrCompacted = errors.New("etcd revision compacted")
+)
+
+// etcdError wraps err in the matching error above, err is kept in the chain
+// so errors.Is also matches the etcd and context errors
+func etcdError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kind := errorKind(err); kind != nil {
+		return fmt.Errorf("%w: %w", kind, err)
+	}
+	return err
+}
+
+func errorKind(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	if errors.Is(err, clientv3.ErrNoAvailableEndpoints) || connClosed(err) {
+		return ErrConnClosed
+	}
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrAuthFailed, rpctypes.ErrInvalidAuthToken, rpctypes.ErrInvalidAuthMgmt,
+		rpctypes.ErrPermissionDenied, rpctypes.ErrUserEmpty, rpctypes.ErrUserNotFound:
+		return ErrAuthFailed
+	case rpctypes.ErrTimeout, rpctypes.ErrTimeoutDueToLeaderFail, rpctypes.ErrTimeoutDueToConnectionLost:
+		return ErrTimeout
+	case rpctypes.ErrLeaseNotFound:
+		return ErrLeaseExpired
+	case rpctypes.ErrCompacted:
+		return ErrCompacted
+	}
+	if s, ok := status.FromError(err); ok && s.Code() == codes.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// connClosed is clientv3.IsConnCanceled without taking a canceled context for
+// a closed connection
+func connClosed(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		return s.Message() == "transport is closing" ||
+			strings.Contains(s.Message(), "client connection is closing")
+	}
+	return strings.Contains(err.Error(), "client connection is closing")
+}
@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEtcdError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{context.DeadlineExceeded, ErrTimeout},
+		{rpctypes.ErrGRPCTimeout, ErrTimeout},
+		{rpctypes.ErrTimeoutDueToLeaderFail, ErrTimeout},
+		{status.Error(codes.DeadlineExceeded, "deadline"), ErrTimeout},
+		{clientv3.ErrNoAvailableEndpoints, ErrConnClosed},
+		{status.Error(codes.Canceled, "grpc: the client connection is closing"), ErrConnClosed},
+		{rpctypes.ErrGRPCLeaseNotFound, ErrLeaseExpired},
+		{rpctypes.ErrGRPCPermissionDenied, ErrAuthFailed},
+		{rpctypes.ErrAuthFailed, ErrAuthFailed},
+		{rpctypes.ErrGRPCCompacted, ErrCompacted},
+	} {
+		err := etcdError(c.err)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%v mapped to %v, want %v", c.err, err, c.want)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("%v lost from the chain of %v", c.err, err)
+		}
+	}
+	if err := etcdError(context.Canceled); err != context.Canceled {
+		t.Errorf("canceled mapped to %v", err)
+	}
+	if etcdError(nil) != nil {
+		t.Error("nil mapped to an error")
+	}
+}
+
+func TestEtcdErrorPaths(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	l, err := e.cli().Grant(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cli().Revoke(context.Background(), l.ID)
+	_, err = e.cli().Put(context.Background(), "ion://test/errors", "v", clientv3.WithLease(l.ID))
+	if err = etcdError(err); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("put on a revoked lease err = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	if _, err := e.getCtx(ctx, "ion://test/errors"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expired deadline err = %v", err)
+	}
+
+	e.close()
+	if _, err := e.get("ion://test/errors"); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("get on a closed client err = %v", err)
+	}
+}
@@ -3,148 +3,736 @@ package discovery
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pion/ion/log"
-	"go.etcd.io/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 )
 
 const (
 	defaultDialTimeout      = time.Second * 5
 	defaultGrantTimeout     = 5
 	defaultOperationTimeout = time.Second * 5
+
+	// operations etcd accepts in one transaction by default
+	maxTxnOps = 128
+	// keys per read of getByPrefixFunc
+	prefixPageSize = 1000
 )
 
 type WatchCallback func(clientv3.WatchChan)
 
 type Etcd struct {
+	// client is replaced on reconnect, use cli()
 	client        *clientv3.Client
-	liveKeyID     map[string]clientv3.LeaseID
+	clientLock    sync.RWMutex
+	cfg           Config
+	liveKeyID     map[string]*liveKey
 	liveKeyIDLock sync.RWMutex
+	// leases of NewLease by handle, guarded by liveKeyIDLock
+	shared map[clientv3.LeaseID]*lease
+	// leases of ClaimSlot, guarded by liveKeyIDLock
+	claims map[clientv3.LeaseID]*lease
+
+	// updates waiting for the end of UpdateWindow
+	pending     map[string]*pendingUpdate
+	pendingLock sync.Mutex
+
+	// endpoints the client is narrowed to by monitor, reconnecting is set
+	// while none answers and lastReconnect when the client was last
+	// replaced, all guarded by healthyLock
+	healthyEndpoints []string
+	reconnecting     bool
+	lastReconnect    time.Time
+	healthyLock      sync.RWMutex
+	// leases lost and not re-granted yet, atomic
+	lostLeases int64
+	// leases with a running keepalive, atomic and capped by MaxLeases
+	leaseCount int64
+
+	// secondary is set while the client is on SecondaryEndpoints, guarded
+	// by clientLock
+	secondary bool
+	// switches counts the failovers and failbacks, guarded by clientLock
+	switches int
+
+	// leaseTTL is the adaptive ttl in seconds of new leases, atomic
+	leaseTTL int64
+
+	// parent of every background goroutine, canceled on close
+	ctx     context.Context
+	stop    context.CancelFunc
+	keepers sync.WaitGroup
 }
 
 func newEtcd(endpoints []string) (*Etcd, error) {
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   endpoints,
-		DialTimeout: defaultDialTimeout,
-	})
+	return newEtcdWithConfig(Config{Endpoints: endpoints})
+}
 
+func newEtcdWithConfig(cfg Config) (*Etcd, error) {
+	if err := cfg.setDefaults(); err != nil {
+		cfg.Logger.Errorf("newEtcd err=%v", err)
+		return nil, err
+	}
+	if cfg.DiscoverySRV != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DialTimeout)
+		endpoints, err := cfg.resolveEndpoints(ctx)
+		cancel()
+		if err != nil {
+			cfg.Logger.Errorf("newEtcd err=%v", err)
+			return nil, err
+		}
+		cfg.Endpoints = endpoints
+	}
+	cli, err := dial(cfg)
 	if err != nil {
-		log.Errorf("newEtcd err=%v", err)
+		cfg.Logger.Errorf("newEtcd err=%v", err)
 		return nil, err
 	}
+	if cfg.FailFast {
+		if err := reachable(cli, cfg.DialTimeout); err != nil {
+			cli.Close()
+			cfg.Logger.Errorf("newEtcd err=%v", err)
+			return nil, err
+		}
+	}
 
-	return &Etcd{
+	ctx, stop := context.WithCancel(context.Background())
+	e := &Etcd{
 		client:    cli,
-		liveKeyID: make(map[string]clientv3.LeaseID),
-	}, nil
+		cfg:       cfg,
+		liveKeyID: make(map[string]*liveKey),
+		shared:    make(map[clientv3.LeaseID]*lease),
+		claims:    make(map[clientv3.LeaseID]*lease),
+		pending:   make(map[string]*pendingUpdate),
+		ctx:       ctx,
+		stop:      stop,
+
+		healthyEndpoints: cli.Endpoints(),
+	}
+	e.keepers.Add(1)
+	go e.monitor()
+	if cfg.ReconcileInterval > 0 {
+		e.keepers.Add(1)
+		go e.reconcile()
+	}
+	if cfg.adaptive() {
+		e.leaseTTL = int64(cfg.MinGrantTTL / time.Second)
+		adaptiveTTLGauge.Set(float64(e.leaseTTL))
+		e.keepers.Add(1)
+		go e.adaptTTL()
+	}
+	return e, nil
 }
 
-func (e *Etcd) keep(key, value string) error {
-	resp, err := e.client.Grant(context.TODO(), defaultGrantTimeout)
+func dial(cfg Config) (*clientv3.Client, error) {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
+		TLS:         tlsCfg,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+
+		DialOptions:        cfg.DialOptions,
+		MaxCallSendMsgSize: cfg.MaxCallSendMsgSize,
+		MaxCallRecvMsgSize: cfg.MaxCallRecvMsgSize,
+	})
 	if err != nil {
-		log.Errorf("Etcd.keep Grant %s %v", key, err)
+		return nil, etcdError(err)
+	}
+	if cfg.Namespace != "" {
+		cli.KV = namespace.NewKV(cli.KV, cfg.Namespace)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, cfg.Namespace)
+		cli.Lease = namespace.NewLease(cli.Lease, cfg.Namespace)
+	}
+	return cli, nil
+}
+
+// reachable returns ErrUnavailable unless an endpoint of cli answers a
+// Status request within timeout
+func reachable(cli *clientv3.Client, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	endpoints := cli.Endpoints()
+	// asked together, so a hanging endpoint does not use up the timeout
+	results := make(chan error, len(endpoints))
+	for _, ep := range endpoints {
+		go func(ep string) {
+			_, err := cli.Status(ctx, ep)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", ep, err)
+			}
+			results <- err
+		}(ep)
+	}
+	var errs []error
+	for range endpoints {
+		err := <-results
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("%w: no endpoint answered within %v: %v", ErrUnavailable, timeout, errors.Join(errs...))
+}
+
+func (e *Etcd) cli() *clientv3.Client {
+	e.clientLock.RLock()
+	defer e.clientLock.RUnlock()
+	return e.client
+}
+
+// Client is an escape hatch to the underlying client for what Etcd does not
+// cover, such as compaction or member management, reusing its connection.
+// Keys written through it bypass liveKeyID: they are neither kept alive,
+// re-put after a reconnect nor deleted on close. A reconnect replaces the
+// client and closes the old one, so call Client again instead of holding
+// on to it. With a Namespace its KV, Watcher and Lease are namespaced.
+func (e *Etcd) Client() *clientv3.Client {
+	return e.cli()
+}
+
+// opContext bounds a single etcd round-trip by OperationTimeout,
+// a tighter deadline or cancellation on the parent ctx still wins
+func (e *Etcd) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Value(opDeadlineKey{}).(bool); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.cfg.OperationTimeout)
+}
+
+// opDeadlineKey marks a context whose deadline replaces OperationTimeout
+type opDeadlineKey struct{}
+
+// withOpTimeout bounds an operation by d instead of OperationTimeout, d also
+// covers its retries
+func withOpTimeout(d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithValue(context.Background(), opDeadlineKey{}, true), d)
+}
+
+// grantTTL returns the ttl in seconds of new leases
+func (e *Etcd) grantTTL() int64 {
+	if e.cfg.adaptive() {
+		return atomic.LoadInt64(&e.leaseTTL)
+	}
+	return int64(e.cfg.GrantTTL / time.Second)
+}
+
+func (e *Etcd) keep(key, value string) error {
+	return e.keepCtx(context.Background(), key, value)
+}
+
+func (e *Etcd) keepCtx(ctx context.Context, key, value string) error {
+	return e.keepWithTTLCtx(ctx, key, value, e.grantTTL())
+}
+
+// keepWithTTL is keep on a lease of ttlSeconds instead of GrantTTL, e.g. a
+// short ttl for stream keys that should vanish soon after their node dies
+func (e *Etcd) keepWithTTL(key, value string, ttlSeconds int64) error {
+	return e.keepWithTTLCtx(context.Background(), key, value, ttlSeconds)
+}
+
+func (e *Etcd) keepWithTTLCtx(ctx context.Context, key, value string, ttlSeconds int64) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	ctx, span := e.span(ctx, "keep", key)
+	defer endSpan(span, &err)
+	if err := e.checkValue(key, value); err != nil {
 		return err
 	}
-	_, err = e.client.Put(context.TODO(), key, value, clientv3.WithLease(resp.ID))
+	err = e.retry(ctx, func() error {
+		return e.keepAll(ctx, map[string]string{key: value}, ttlSeconds)
+	})
 	if err != nil {
-		log.Errorf("Etcd.keep Put %s %v", key, err)
+		e.log().Errorf("Etcd.keep %s %v", key, err)
 		return err
 	}
+	e.log().Infof("Etcd.keep %s %v ttl=%d", key, value, ttlSeconds)
+	return nil
+}
 
-	_, err = e.client.KeepAlive(context.TODO(), resp.ID)
-	if err != nil {
-		log.Errorf("Etcd.keep %s %v", key, err)
+func (e *Etcd) del(key string) error {
+	return e.delCtx(context.Background(), key)
+}
+
+func (e *Etcd) delCtx(ctx context.Context, key string) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	ctx, span := e.span(ctx, "del", key)
+	defer endSpan(span, &err)
+	if err := e.writable(); err != nil {
 		return err
 	}
+	e.dropPending(key)
 	e.liveKeyIDLock.Lock()
-	e.liveKeyID[key] = resp.ID
+	e.untrack(key)
 	e.liveKeyIDLock.Unlock()
-	log.Infof("Etcd.keep %s %v %v", key, value, err)
-	return nil
+	return e.retry(ctx, func() error {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		_, err := e.cli().Delete(opCtx, key)
+		return etcdError(err)
+	})
 }
 
-func (e *Etcd) del(key string) error {
+// delByPrefix deletes every key under prefix and returns how many were removed
+func (e *Etcd) delByPrefix(prefix string) (n int64, err error) {
+	defer observe(opDelete, time.Now(), &err)
+	if err := e.writable(); err != nil {
+		return 0, err
+	}
+	e.dropPendingPrefix(prefix)
 	e.liveKeyIDLock.Lock()
-	delete(e.liveKeyID, key)
+	for k := range e.liveKeyID {
+		if strings.HasPrefix(k, prefix) {
+			e.untrack(k)
+		}
+	}
 	e.liveKeyIDLock.Unlock()
-	_, err := e.client.Delete(context.TODO(), key)
-	return err
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Delete(ctx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.delByPrefix %s %v", prefix, err)
+		return 0, etcdError(err)
+	}
+	return resp.Deleted, nil
 }
 
 func (e *Etcd) watch(key string, watchFunc WatchCallback, prefix bool) error {
+	return e.watchCtx(context.Background(), key, watchFunc, prefix)
+}
+
+// watchCtx is like watch, canceling ctx closes the WatchChan handed to watchFunc
+func (e *Etcd) watchCtx(ctx context.Context, key string, watchFunc WatchCallback, prefix bool) error {
 	if watchFunc == nil {
 		return errors.New("watchFunc is nil")
 	}
 	if prefix {
-		watchFunc(e.client.Watch(context.Background(), key, clientv3.WithPrefix()))
+		watchFunc(e.cli().Watch(ctx, key, clientv3.WithPrefix()))
 	} else {
-		watchFunc(e.client.Watch(context.Background(), key))
+		watchFunc(e.cli().Watch(ctx, key))
 	}
 
 	return nil
 }
 
+// close revokes the leases of the kept keys and closes the client, it gives
+// up on the revokes after OperationTimeout and returns their errors joined
 func (e *Etcd) close() error {
+	ctx, cancel := e.opContext(context.Background())
+	defer cancel()
+	return e.closeCtx(ctx)
+}
+
+func (e *Etcd) closeCtx(ctx context.Context) error {
+	e.stopPending()
 	e.liveKeyIDLock.Lock()
-	for k, _ := range e.liveKeyID {
-		e.client.Delete(context.TODO(), k)
+	leases := make(map[clientv3.LeaseID]struct{})
+	for k, lk := range e.liveKeyID {
+		leases[lk.lease.id] = struct{}{}
+		e.untrack(k)
+	}
+	for h, l := range e.shared {
+		leases[l.id] = struct{}{}
+		l.cancel()
+		delete(e.shared, h)
+	}
+	for id, l := range e.claims {
+		leases[id] = struct{}{}
+		l.cancel()
+		delete(e.claims, id)
 	}
 	e.liveKeyIDLock.Unlock()
-	return e.client.Close()
+
+	var errs []error
+	cli := e.cli()
+	for id := range leases {
+		if _, err := cli.Revoke(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("revoke lease %x: %w", id, etcdError(err)))
+		}
+	}
+	e.stop()
+	done := make(chan struct{})
+	go func() {
+		e.keepers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("wait for keepalives: %w", ctx.Err()))
+	}
+	if err := e.cli().Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
 
-// func (e *Etcd) Put(key, value string) error { ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
-// _, err := e.client.Put(ctx, key, value)
-// cancel()
+// PutStatic writes key without a lease, so it stays after this instance
+// dies or closes: cluster wide settings and other durable configuration.
+// Node registrations and anything that must vanish with its writer belong
+// in keep. A key kept until now stops being kept and becomes static.
+func (e *Etcd) PutStatic(key, value string) error {
+	return e.putStaticCtx(context.Background(), key, value)
+}
 
-// return err
-// }
+func (e *Etcd) putStaticCtx(ctx context.Context, key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	ctx, span := e.span(ctx, "putStatic", key)
+	defer endSpan(span, &err)
+	if err := e.writable(); err != nil {
+		return err
+	}
+	if err := e.checkValue(key, value); err != nil {
+		return err
+	}
+	e.dropPending(key)
+	e.liveKeyIDLock.Lock()
+	e.untrack(key)
+	e.liveKeyIDLock.Unlock()
+	return e.retry(ctx, func() error {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		_, err := e.cli().Put(opCtx, key, e.encodeValue(value))
+		return etcdError(err)
+	})
+}
 
+// get returns the value of exactly one key, ErrKeyNotFound tells a missing
+// key apart from one holding an empty value
 func (e *Etcd) get(key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
-	resp, err := e.client.Get(ctx, key)
+	return e.getCtx(context.Background(), key)
+}
+
+// getTimeout is get failing with ErrTimeout after d rather than
+// OperationTimeout, e.g. a hot path read failing fast
+func (e *Etcd) getTimeout(key string, d time.Duration) (string, error) {
+	ctx, cancel := withOpTimeout(d)
+	defer cancel()
+	return e.getCtx(ctx, key)
+}
+
+// getAndRefresh is get also renewing the lease of key once when this
+// instance keeps it, so its TTL starts over on every read: active readers
+// keep a presence key alive without a heartbeat of its own. Every key on the
+// same lease is renewed with it. A failed renewal is only logged, the
+// keepalive of the lease goes on as before.
+func (e *Etcd) getAndRefresh(key string) (string, error) {
+	v, err := e.get(key)
 	if err != nil {
-		cancel()
 		return "", err
 	}
-	var val string
-	for _, ev := range resp.Kvs {
-		val = string(ev.Value)
+	e.liveKeyIDLock.RLock()
+	lk, ok := e.liveKeyID[key]
+	e.liveKeyIDLock.RUnlock()
+	if !ok {
+		return v, nil
+	}
+	ctx, cancel := e.opContext(e.ctx)
+	defer cancel()
+	if _, err := e.cli().KeepAliveOnce(ctx, lk.lease.id); err != nil {
+		e.log().Errorf("Etcd.getAndRefresh %s lease=%x %v", key, lk.lease.id, etcdError(err))
 	}
+	return v, nil
+}
+
+func (e *Etcd) getCtx(ctx context.Context, key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	ctx, span := e.span(ctx, "get", key)
+	defer endSpan(span, &err)
+	var resp *clientv3.GetResponse
+	err = e.retry(ctx, func() (err error) {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		resp, err = e.cli().Get(opCtx, key, readOpts(ctx)...)
+		return etcdError(err)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return decodeValue(resp.Kvs[0].Value), nil
+}
+
+// getAtRevision returns the value key had at revision rev, ErrKeyNotFound
+// if it did not exist then and ErrCompacted once rev has been compacted
+func (e *Etcd) getAtRevision(key string, rev int64) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Get(ctx, key, clientv3.WithRev(rev))
 	cancel()
+	if err != nil {
+		return "", etcdError(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrKeyNotFound
+	}
+	return decodeValue(resp.Kvs[0].Value), nil
+}
+
+// GetMany reads keys in one round trip and returns the values found, keys
+// that do not exist are left out. More than maxTxnOps keys take one
+// transaction per maxTxnOps, each a consistent read of its own.
+func (e *Etcd) GetMany(keys []string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	m = make(map[string]string, len(keys))
+	err = e.getManyFunc(keys, func(kv *mvccpb.KeyValue) {
+		m[string(kv.Key)] = decodeValue(kv.Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	return val, err
+// getManyFunc calls fn with every one of keys that exists, read like GetMany
+func (e *Etcd) getManyFunc(keys []string, fn func(kv *mvccpb.KeyValue)) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		ops := make([]clientv3.Op, n)
+		for i, k := range keys[:n] {
+			ops[i] = clientv3.OpGet(k)
+		}
+		ctx, cancel := e.opContext(context.Background())
+		resp, err := e.cli().Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return etcdError(err)
+		}
+		for _, r := range resp.Responses {
+			for _, kv := range r.GetResponseRange().Kvs {
+				fn(kv)
+			}
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Exists reports whether key is stored, without transferring its value
+func (e *Etcd) Exists(key string) (bool, error) {
+	n, err := e.count(key)
+	return n > 0, err
+}
+
+// Count returns how many keys are under prefix, without transferring them
+func (e *Etcd) Count(prefix string) (int64, error) {
+	return e.count(prefix, clientv3.WithPrefix())
+}
+
+func (e *Etcd) count(key string, opts ...clientv3.OpOption) (n int64, err error) {
+	defer observe(opGet, time.Now(), &err)
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Get(ctx, key, append(opts, clientv3.WithCountOnly())...)
+	cancel()
+	if err != nil {
+		return 0, etcdError(err)
+	}
+	return resp.Count, nil
 }
 
 func (e *Etcd) getByPrefix(key string) (map[string]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
-	resp, err := e.client.Get(ctx, key, clientv3.WithPrefix())
+	return e.getByPrefixCtx(context.Background(), key)
+}
+
+// getByPrefixTimeout is getByPrefix failing with ErrTimeout after d rather
+// than OperationTimeout, e.g. a bulk scan given more slack
+func (e *Etcd) getByPrefixTimeout(prefix string, d time.Duration) (map[string]string, error) {
+	ctx, cancel := withOpTimeout(d)
+	defer cancel()
+	return e.getByPrefixCtx(ctx, prefix)
+}
+
+func (e *Etcd) getByPrefixCtx(ctx context.Context, key string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	ctx, span := e.span(ctx, "getByPrefix", key)
+	defer endSpan(span, &err)
+	var resp *clientv3.GetResponse
+	err = e.retry(ctx, func() (err error) {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		resp, err = e.cli().Get(opCtx, key, readOpts(ctx, clientv3.WithPrefix())...)
+		return etcdError(err)
+	})
 	if err != nil {
-		cancel()
 		return nil, err
 	}
-	m := make(map[string]string)
+	m = make(map[string]string)
 	for _, kv := range resp.Kvs {
-		m[string(kv.Key)] = string(kv.Value)
+		m[string(kv.Key)] = decodeValue(kv.Value)
 	}
+	return m, nil
+}
+
+// KV is a key with the revisions etcd keeps for it
+type KV struct {
+	Key, Value     string
+	ModRevision    int64
+	CreateRevision int64
+	Version        int64
+}
+
+// getByPrefixKV returns every key under prefix sorted by key, with its
+// revisions for version checks or last writer wins
+func (e *Etcd) getByPrefixKV(prefix string) (kvs []KV, err error) {
+	defer observe(opGet, time.Now(), &err)
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Get(ctx, prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
+	if err != nil {
+		return nil, etcdError(err)
+	}
+	kvs = make([]KV, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, KV{
+			Key:            string(kv.Key),
+			Value:          decodeValue(kv.Value),
+			ModRevision:    kv.ModRevision,
+			CreateRevision: kv.CreateRevision,
+			Version:        kv.Version,
+		})
+	}
+	return kvs, nil
+}
 
-	return m, err
+// getByPrefixFunc calls fn with every key under prefix in ascending key
+// order, reading prefixPageSize keys at a time so memory stays bounded
+// however many there are. Pages after the first are read at its revision, so
+// fn sees a consistent snapshot, and ErrCompacted is returned if that
+// revision gets compacted before the end. An error from fn stops the walk
+// and is returned as is.
+func (e *Etcd) getByPrefixFunc(prefix string, fn func(key, value string) error) error {
+	return e.walkPrefix(prefix, prefixPageSize, fn)
 }
 
+func (e *Etcd) walkPrefix(prefix string, limit int64, fn func(key, value string) error) (err error) {
+	// an error of fn is not an etcd failure
+	var fnErr error
+	start := time.Now()
+	defer func() {
+		if fnErr == nil {
+			observe(opGet, start, &err)
+		}
+	}()
+	from, end := prefix, clientv3.GetPrefixRangeEnd(prefix)
+	var rev int64
+	for {
+		opts := []clientv3.OpOption{
+			clientv3.WithRange(end),
+			clientv3.WithLimit(limit),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		}
+		if rev != 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		ctx, cancel := e.opContext(context.Background())
+		resp, err := e.cli().Get(ctx, from, opts...)
+		cancel()
+		if err != nil {
+			return etcdError(err)
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			if fnErr = fn(string(kv.Key), decodeValue(kv.Value)); fnErr != nil {
+				return fnErr
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		from = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// getByPrefixPaged returns at most limit keys under prefix in ascending key
+// order, starting at fromKey or at the beginning of the prefix when it is
+// empty. next is the fromKey of the following page, empty on the last one.
+func (e *Etcd) getByPrefixPaged(prefix string, limit int64, fromKey string) (m map[string]string, next string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	if fromKey == "" {
+		fromKey = prefix
+	}
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Get(ctx, fromKey,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+		clientv3.WithLimit(limit),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, "", etcdError(err)
+	}
+	m = make(map[string]string)
+	for _, kv := range resp.Kvs {
+		m[string(kv.Key)] = decodeValue(kv.Value)
+	}
+	if resp.More && len(resp.Kvs) > 0 {
+		// the smallest key after the last one returned
+		next = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	return m, next, nil
+}
+
+// update is updateCtx, coalesced when UpdateWindow is set
 func (e *Etcd) update(key, value string) error {
+	if e.cfg.UpdateWindow > 0 {
+		if n := e.valueSize(value); n > e.cfg.MaxValueSize {
+			// rejected now rather than when the window ends
+			return e.checkValue(key, value)
+		}
+		e.coalesce(key, value)
+		return nil
+	}
+	return e.updateCtx(context.Background(), key, value)
+}
+
+func (e *Etcd) updateCtx(ctx context.Context, key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	ctx, span := e.span(ctx, "update", key)
+	defer endSpan(span, &err)
+	if err := e.writable(); err != nil {
+		return err
+	}
+	if err := e.checkValue(key, value); err != nil {
+		return err
+	}
 	e.liveKeyIDLock.Lock()
-	id := e.liveKeyID[key]
+	lk, ok := e.liveKeyID[key]
+	if !ok {
+		e.liveKeyIDLock.Unlock()
+		// a put without a lease would never expire
+		return e.keepCtx(ctx, key, value)
+	}
+	id := lk.lease.id
+	lk.value = value
 	e.liveKeyIDLock.Unlock()
-	_, err := e.client.Put(context.TODO(), key, value, clientv3.WithLease(id))
+	err = e.retry(ctx, func() error {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		_, err := e.cli().Put(opCtx, key, e.encodeValue(value), clientv3.WithLease(id))
+		return etcdError(err)
+	})
 	if err != nil {
-		err = e.keep(key, value)
+		err = e.keepCtx(ctx, key, value)
 		if err != nil {
-			log.Errorf("Etcd.Keep %s %s %v", key, value, err)
+			e.log().Errorf("Etcd.Keep %s %s %v", key, value, err)
 		}
 	}
-	// log.Infof("Etcd.Update %s %s %v", key, value, err)
+	// e.log().Infof("Etcd.Update %s %s %v", key, value, err)
 	return err
 }
@@ -0,0 +1,593 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	"google.golang.org/grpc"
+)
+
+func freeURL(t *testing.T, scheme string) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: scheme, Host: l.Addr().String()}
+}
+
+// startEtcd runs a single member etcd server for the duration of the test,
+// setup may adjust the embed config before the server starts
+func startEtcd(t *testing.T, setup func(*embed.Config)) (*embed.Etcd, string) {
+	dir, err := ioutil.TempDir("", "ion-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg *embed.Config
+	var srv *embed.Etcd
+	// a port picked by freeURL may be taken again before etcd binds it
+	for i := 0; i < 3; i++ {
+		cfg = embed.NewConfig()
+		cfg.Dir = dir
+		cu, pu := freeURL(t, "http"), freeURL(t, "http")
+		cfg.LCUrls, cfg.ACUrls = []url.URL{cu}, []url.URL{cu}
+		cfg.LPUrls, cfg.APUrls = []url.URL{pu}, []url.URL{pu}
+		cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+		if setup != nil {
+			setup(cfg)
+		}
+		srv, err = embed.StartEtcd(cfg)
+		if err == nil || !strings.Contains(err.Error(), "address already in use") {
+			break
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		srv.Close()
+		os.RemoveAll(dir)
+		t.Fatal("etcd server not ready")
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	})
+	return srv, cfg.ACUrls[0].Host
+}
+
+func newTestEtcd(t *testing.T, cfg Config) *Etcd {
+	if len(cfg.Endpoints) == 0 && cfg.DiscoverySRV == "" {
+		_, ep := startEtcd(t, nil)
+		cfg.Endpoints = []string{ep}
+	}
+	e, err := newEtcdWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.close() })
+	return e
+}
+
+func TestKeepGrantTTL(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: 30 * time.Second})
+	if err := e.keep("ion://test/ttl", "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	id := e.liveKeyID["ion://test/ttl"].lease.id
+	e.liveKeyIDLock.RUnlock()
+	resp, err := e.cli().TimeToLive(e.ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GrantedTTL != 30 {
+		t.Fatalf("granted ttl %d, want 30", resp.GrantedTTL)
+	}
+}
+
+func TestGet(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	if _, err := e.get("ion://test/get/missing"); err != ErrKeyNotFound {
+		t.Fatalf("missing key err = %v, want ErrKeyNotFound", err)
+	}
+	e.keep("ion://test/get/value", "v")
+	if v, err := e.get("ion://test/get/value"); err != nil || v != "v" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	e.keep("ion://test/get/empty", "")
+	if v, err := e.get("ion://test/get/empty"); err != nil || v != "" {
+		t.Fatalf("empty value get = %q, %v", v, err)
+	}
+}
+
+func TestDelByPrefix(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	for _, k := range []string{"a", "b", "c"} {
+		e.keep("ion://test/sfu1/"+k, k)
+	}
+	e.keep("ion://test/sfu2/a", "a")
+	n, err := e.delByPrefix("ion://test/sfu1/")
+	if err != nil || n != 3 {
+		t.Fatalf("delByPrefix = %d, %v", n, err)
+	}
+	if m, _ := e.getByPrefix("ion://test/sfu1/"); len(m) != 0 {
+		t.Fatalf("keys left %v", m)
+	}
+	e.liveKeyIDLock.RLock()
+	defer e.liveKeyIDLock.RUnlock()
+	if len(e.liveKeyID) != 1 || e.liveKeyID["ion://test/sfu2/a"] == nil {
+		t.Fatalf("liveKeyID = %v", e.liveKeyID)
+	}
+}
+
+func TestGetByPrefixPaged(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	kv := make(map[string]string)
+	for i := 0; i < 23; i++ {
+		kv[fmt.Sprintf("ion://test/page/%02d", i)] = fmt.Sprint(i)
+	}
+	kv["ion://test/pagex"] = "outside"
+	if err := e.PutAll(context.Background(), kv); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]string)
+	pages := 0
+	var last string
+	for from := ""; ; {
+		m, next, err := e.getByPrefixPaged("ion://test/page/", 5, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for k, v := range m {
+			if _, dup := seen[k]; dup {
+				t.Fatalf("%s returned twice", k)
+			}
+			if k <= last {
+				t.Fatalf("%s returned after %s", k, last)
+			}
+			seen[k] = v
+		}
+		for k := range m {
+			if k > last {
+				last = k
+			}
+		}
+		if next == "" {
+			break
+		}
+		from = next
+	}
+	if pages != 5 || len(seen) != 23 {
+		t.Fatalf("walked %d pages, %d keys", pages, len(seen))
+	}
+}
+
+func TestGetByPrefixFunc(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	for i := 0; i < 25; i++ {
+		e.PutStatic(fmt.Sprintf("ion://test/walk/%02d", i), fmt.Sprint(i))
+	}
+	var keys []string
+	err := e.walkPrefix("ion://test/walk/", 10, func(key, value string) error {
+		if len(keys) == 0 {
+			// changes after the first page is read are not seen
+			e.PutStatic("ion://test/walk/99", "new")
+			e.del("ion://test/walk/20")
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 25 || keys[20] != "ion://test/walk/20" || !sort.StringsAreSorted(keys) {
+		t.Fatalf("walked %v", keys)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = e.getByPrefixFunc("ion://test/walk/", func(key, value string) error {
+		if n++; n == 12 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 12 {
+		t.Fatalf("walk = %v after %d keys, want stop after 12", err, n)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	srv, ep := startEtcd(t, nil)
+	e, err := newEtcdWithConfig(Config{Endpoints: []string{ep}, OperationTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.keep("ion://test/close", "v"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	start := time.Now()
+	err = e.close()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("close took %v", d)
+	}
+	if err == nil {
+		t.Fatal("close against a stopped server returned nil")
+	}
+	if len(e.liveKeyID) != 0 {
+		t.Fatalf("liveKeyID not cleared %v", e.liveKeyID)
+	}
+}
+
+func TestCloseContext(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	e, err := newEtcdWithConfig(Config{Endpoints: []string{ep}, GrantTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.keep("ion://test/closectx/a", "a")
+	e.PutAll(context.Background(), map[string]string{"ion://test/closectx/b": "b", "ion://test/closectx/c": "c"})
+	e.PutJSONStatic("ion://test/closectx/static", "s")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := e.CloseContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	m, err := other.getByPrefix("ion://test/closectx/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["ion://test/closectx/static"] == "" {
+		t.Fatalf("keys left after CloseContext %v", m)
+	}
+}
+
+func TestPutStatic(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	w, err := newEtcdWithConfig(Config{Endpoints: []string{ep}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.keep("ion://test/static/kept", "k")
+	w.keep("ion://test/static/converted", "leased")
+	if err := w.PutStatic("ion://test/static/converted", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.PutStatic("ion://test/static/config", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	m, err := r.getByPrefix("ion://test/static/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"ion://test/static/config": "v", "ion://test/static/converted": "c"}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("keys after the writer closed %v, want %v", m, want)
+	}
+}
+
+func TestExistsCount(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	if ok, err := e.Exists("ion://test/count/a"); err != nil || ok {
+		t.Fatalf("exists before put = %v, %v", ok, err)
+	}
+	e.keep("ion://test/count/a", "")
+	e.keep("ion://test/count/b", "b")
+	e.keep("ion://test/countx", "outside")
+	if ok, err := e.Exists("ion://test/count/a"); err != nil || !ok {
+		t.Fatalf("exists of empty value = %v, %v", ok, err)
+	}
+	if n, err := e.Count("ion://test/count/"); err != nil || n != 2 {
+		t.Fatalf("count = %d, %v, want 2", n, err)
+	}
+	e.del("ion://test/count/a")
+	if n, err := e.Count("ion://test/count/"); err != nil || n != 1 {
+		t.Fatalf("count after del = %d, %v, want 1", n, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	staging := newTestEtcd(t, Config{Endpoints: []string{ep}, Namespace: "staging/"})
+	prod := newTestEtcd(t, Config{Endpoints: []string{ep}, Namespace: "prod/"})
+	raw := newTestEtcd(t, Config{Endpoints: []string{ep}})
+
+	events := make(chan string, 4)
+	stop, err := prod.Watch("ion://node/", true, func(_ EventType, key, value string) {
+		events <- key + "=" + value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	staging.keep("ion://node/sfu/1", "staging")
+	prod.keep("ion://node/sfu/1", "prod")
+
+	if v, _ := staging.get("ion://node/sfu/1"); v != "staging" {
+		t.Fatalf("staging get %q", v)
+	}
+	if m, _ := prod.getByPrefix("ion://node/"); len(m) != 1 || m["ion://node/sfu/1"] != "prod" {
+		t.Fatalf("prod getByPrefix %v", m)
+	}
+	if v, _ := raw.get("prod/ion://node/sfu/1"); v != "prod" {
+		t.Fatalf("raw get of namespaced key %q", v)
+	}
+	select {
+	case ev := <-events:
+		if ev != "ion://node/sfu/1=prod" {
+			t.Fatalf("prod watch got %s", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no watch event")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("prod watch saw a foreign event %s", ev)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestGetByPrefixKV(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	for _, k := range []string{"c", "a", "b"} {
+		e.keep("ion://test/kv/"+k, k)
+	}
+	e.update("ion://test/kv/a", "a2")
+	kvs, err := e.getByPrefixKV("ion://test/kv/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 3 {
+		t.Fatalf("got %v", kvs)
+	}
+	for i, k := range []string{"a", "b", "c"} {
+		if kvs[i].Key != "ion://test/kv/"+k {
+			t.Fatalf("kvs[%d] = %s, want key %s", i, kvs[i].Key, k)
+		}
+	}
+	a := kvs[0]
+	if a.Value != "a2" || a.Version != 2 || a.ModRevision <= a.CreateRevision {
+		t.Fatalf("updated key %+v", a)
+	}
+	// c was written first
+	if kvs[2].CreateRevision >= kvs[1].CreateRevision || kvs[1].Version != 1 {
+		t.Fatalf("revisions %+v", kvs)
+	}
+}
+
+func TestUpdateDelRace(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/update/race"
+	leased := func() {
+		t.Helper()
+		resp, err := e.cli().Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Kvs) > 0 && resp.Kvs[0].Lease == 0 {
+			t.Fatalf("%s left without a lease", key)
+		}
+	}
+
+	e.del(key)
+	if err := e.update(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	leased()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			e.update(key, fmt.Sprint(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			e.del(key)
+		}
+	}()
+	wg.Wait()
+	leased()
+}
+
+func TestClient(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	resp, err := e.Client().MemberList(context.Background())
+	if err != nil || len(resp.Members) != 1 {
+		t.Fatalf("member list %v, %v", resp, err)
+	}
+}
+
+func TestGetAtRevision(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/rev"
+	e.keep(key, "1")
+	kvs, _ := e.getByPrefixKV(key)
+	first := kvs[0].ModRevision
+	e.update(key, "2")
+	kvs, _ = e.getByPrefixKV(key)
+	second := kvs[0].ModRevision
+
+	if v, err := e.getAtRevision(key, first); err != nil || v != "1" {
+		t.Fatalf("at first revision = %q, %v", v, err)
+	}
+	if v, err := e.getAtRevision(key, second); err != nil || v != "2" {
+		t.Fatalf("at second revision = %q, %v", v, err)
+	}
+	if _, err := e.getAtRevision(key, first-1); err != ErrKeyNotFound {
+		t.Fatalf("before the key existed err = %v", err)
+	}
+
+	if _, err := e.cli().Compact(context.Background(), second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.getAtRevision(key, first); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("compacted revision err = %v, want ErrCompacted", err)
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	// every range takes 200ms, more than OperationTimeout
+	slow := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if method == "/etcdserverpb.KV/Range" {
+			select {
+			case <-time.After(200 * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	e := newTestEtcd(t, Config{
+		OperationTimeout: 100 * time.Millisecond,
+		Retry:            RetryPolicy{MaxAttempts: 1},
+		DialOptions:      []grpc.DialOption{grpc.WithChainUnaryInterceptor(slow)},
+	})
+	key := "ion://test/timeout/a"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := e.getTimeout(key, 30*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("getTimeout err = %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 90*time.Millisecond {
+		t.Fatalf("getTimeout took %v, past its own deadline", d)
+	}
+	if _, err := e.getByPrefix("ion://test/timeout/"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("getByPrefix err = %v, want ErrTimeout", err)
+	}
+	if m, err := e.getByPrefixTimeout("ion://test/timeout/", 2*time.Second); err != nil || m[key] != "v" {
+		t.Fatalf("getByPrefixTimeout = %v, %v", m, err)
+	}
+	if v, err := e.getTimeout(key, 2*time.Second); err != nil || v != "v" {
+		t.Fatalf("getTimeout with slack = %q, %v", v, err)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	kv := make(map[string]string)
+	var keys []string
+	for i := 0; i < maxTxnOps+10; i++ {
+		k := fmt.Sprintf("ion://test/many/%03d", i)
+		kv[k] = fmt.Sprint(i)
+		keys = append(keys, k)
+	}
+	kv["ion://test/many/empty"] = ""
+	for k, v := range kv {
+		e.keep(k, v)
+	}
+	keys = append(keys, "ion://test/many/empty", "ion://test/many/missing")
+
+	m, err := e.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != len(kv) {
+		t.Fatalf("got %d keys, want %d", len(m), len(kv))
+	}
+	if _, ok := m["ion://test/many/missing"]; ok {
+		t.Fatal("missing key returned")
+	}
+	for _, k := range keys {
+		v, err := e.get(k)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if got, ok := m[k]; !ok || got != v {
+			t.Fatalf("GetMany %s = %q, %v, get = %q", k, got, ok, v)
+		}
+	}
+}
+
+func TestGetAndRefresh(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: 10 * time.Second})
+	key := "ion://test/refresh/presence"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	// without its keepalive only getAndRefresh renews the lease
+	e.liveKeyIDLock.RLock()
+	e.liveKeyID[key].lease.cancel()
+	e.liveKeyIDLock.RUnlock()
+	time.Sleep(2 * time.Second)
+	before, err := e.TimeToLive(key)
+	if err != nil || before > 8*time.Second {
+		t.Fatalf("ttl %v after 2s, %v", before, err)
+	}
+	if v, err := e.getAndRefresh(key); err != nil || v != "v" {
+		t.Fatalf("getAndRefresh = %q, %v", v, err)
+	}
+	after, err := e.TimeToLive(key)
+	if err != nil || after < 9*time.Second {
+		t.Fatalf("ttl %v after getAndRefresh, was %v, err %v", after, before, err)
+	}
+
+	if err := e.PutStatic("ion://test/refresh/static", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := e.getAndRefresh("ion://test/refresh/static"); err != nil || v != "s" {
+		t.Fatalf("getAndRefresh of a static key = %q, %v", v, err)
+	}
+	if _, err := e.getAndRefresh("ion://test/refresh/missing"); err != ErrKeyNotFound {
+		t.Fatalf("getAndRefresh of a missing key err = %v", err)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	dead := freeURL(t, "http").Host
+	e, err := newEtcdWithConfig(Config{Endpoints: []string{dead, ep}, FailFast: true, DialTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("one reachable endpoint: %v", err)
+	}
+	e.close()
+
+	start := time.Now()
+	_, err = newEtcdWithConfig(Config{Endpoints: []string{dead}, FailFast: true, DialTimeout: 300 * time.Millisecond})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("unreachable endpoints err = %v, want ErrUnavailable", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("failing took %v, past DialTimeout", d)
+	}
+
+	// lazy by default
+	e, err = newEtcdWithConfig(Config{Endpoints: []string{dead}, DialTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("lazy client: %v", err)
+	}
+	e.close()
+}
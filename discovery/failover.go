@@ -0,0 +1,83 @@
+package discovery
+
+import "github.com/coreos/etcd/clientv3"
+
+// secondary returns c dialing SecondaryEndpoints
+func (c Config) secondary() Config {
+	c.Endpoints = c.SecondaryEndpoints
+	return c
+}
+
+// OnSecondary reports whether the client failed over to SecondaryEndpoints
+func (e *Etcd) OnSecondary() bool {
+	e.clientLock.RLock()
+	defer e.clientLock.RUnlock()
+	return e.secondary
+}
+
+// clusterSwitches counts the switches between the primary and secondary
+// clusters, their revisions are unrelated so watches resync across one
+func (e *Etcd) clusterSwitches() int {
+	e.clientLock.RLock()
+	defer e.clientLock.RUnlock()
+	return e.switches
+}
+
+// activeEndpoints are the endpoints of the cluster the client is on
+func (e *Etcd) activeEndpoints() []string {
+	if e.OnSecondary() {
+		return e.cfg.SecondaryEndpoints
+	}
+	return e.cfg.Endpoints
+}
+
+// writable returns ErrReadOnly while on a read only secondary
+func (e *Etcd) writable() error {
+	if e.cfg.SecondaryReadOnly && e.OnSecondary() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// failOver swaps in a client on SecondaryEndpoints if they answer, and
+// reports whether it did
+func (e *Etcd) failOver() bool {
+	if len(e.cfg.SecondaryEndpoints) == 0 {
+		return false
+	}
+	cli, err := dial(e.cfg.secondary())
+	if err != nil {
+		e.log().Errorf("Etcd.failover %v", err)
+		return false
+	}
+	if !e.healthy(cli) {
+		cli.Close()
+		return false
+	}
+	e.log().Errorf("Etcd.failover primary %v unreachable, using secondary %v", e.cfg.Endpoints, e.cfg.SecondaryEndpoints)
+	e.swapClient(cli, true)
+	return true
+}
+
+// failBack swaps in a client on the primary Endpoints once one of them
+// answers, and reports whether it did
+func (e *Etcd) failBack(current *clientv3.Client) bool {
+	if len(e.probeEndpoints(current, e.cfg.Endpoints)) == 0 {
+		return false
+	}
+	cli, err := dial(e.cfg)
+	if err != nil {
+		e.log().Errorf("Etcd.failback %v", err)
+		return false
+	}
+	if !e.healthy(cli) {
+		cli.Close()
+		return false
+	}
+	e.log().Infof("Etcd.failback primary %v reachable again", e.cfg.Endpoints)
+	e.swapClient(cli, false)
+	if e.cfg.OnReconnect != nil {
+		e.cfg.OnReconnect()
+	}
+	return true
+}
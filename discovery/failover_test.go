@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+func failoverConfig(primary, secondary string) Config {
+	return Config{
+		Endpoints:           []string{primary},
+		SecondaryEndpoints:  []string{secondary},
+		DialTimeout:         300 * time.Millisecond,
+		OperationTimeout:    300 * time.Millisecond,
+		HealthCheckInterval: 100 * time.Millisecond,
+		ReconnectBackoff:    50 * time.Millisecond,
+		ReconnectMaxBackoff: 100 * time.Millisecond,
+	}
+}
+
+func waitSecondary(t *testing.T, e *Etcd, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for e.OnSecondary() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("on secondary = %v, want %v", e.OnSecondary(), want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitValue waits for key to hold value, kept keys are re-put right after
+// the client switched cluster
+func waitValue(t *testing.T, e *Etcd, key, value string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v, err := e.get(key)
+		if err == nil && v == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %q, %v, want %q", key, v, err, value)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	srv, primary := startEtcd(t, nil)
+	_, secondary := startEtcd(t, nil)
+	cfg := failoverConfig(primary, secondary)
+	cfg.FailBack = true
+	e := newTestEtcd(t, cfg)
+	standby := newTestEtcd(t, Config{Endpoints: []string{secondary}})
+	key := "ion://test/failover"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := standby.get(key); err != ErrKeyNotFound {
+		t.Fatalf("key on the secondary before failover err = %v", err)
+	}
+
+	srvCfg := srv.Config()
+	srv.Close()
+	waitSecondary(t, e, true)
+	waitValue(t, standby, key, "v")
+	if err := e.keep(key+"/new", "w"); err != nil {
+		t.Fatalf("keep on a read write secondary: %v", err)
+	}
+
+	restarted, err := embed.StartEtcd(&srvCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restarted.Close)
+	waitSecondary(t, e, false)
+	back := newTestEtcd(t, Config{Endpoints: []string{primary}})
+	waitValue(t, back, key, "v")
+	waitValue(t, back, key+"/new", "w")
+}
+
+func TestFailoverReadOnly(t *testing.T) {
+	srv, primary := startEtcd(t, nil)
+	_, secondary := startEtcd(t, nil)
+	cfg := failoverConfig(primary, secondary)
+	cfg.SecondaryReadOnly = true
+	e := newTestEtcd(t, cfg)
+	standby := newTestEtcd(t, Config{Endpoints: []string{secondary}})
+	if err := standby.PutStatic("ion://test/failover/static", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.keep("ion://test/failover/kept", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Close()
+	waitSecondary(t, e, true)
+	if v, err := e.get("ion://test/failover/static"); err != nil || v != "s" {
+		t.Fatalf("read on the secondary = %q, %v", v, err)
+	}
+	if err := e.keep("ion://test/failover/new", "v"); err != ErrReadOnly {
+		t.Fatalf("keep on a read only secondary err = %v", err)
+	}
+	if _, err := standby.get("ion://test/failover/kept"); err != ErrKeyNotFound {
+		t.Fatalf("kept key put on a read only secondary err = %v", err)
+	}
+}
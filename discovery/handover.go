@@ -0,0 +1,165 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Transferer is implemented by registries that can hand a kept key over to
+// another instance without the key ever being absent
+type Transferer interface {
+	// TakeOver keeps key with value if it currently holds expected, and
+	// reports whether it did
+	TakeOver(key, expected, value string) (bool, error)
+	// Release stops keeping key and leaves it in place for its new owner
+	Release(key string)
+}
+
+var _ Transferer = (*Etcd)(nil)
+
+// errNoTransfer is returned by Handover and TakeOver on other registries
+var errNoTransfer = errors.New("registry cannot hand over keys")
+
+// TakeOver moves key onto a new lease of this instance with value in one
+// transaction, if key still holds expected. The key is never deleted on
+// the way, and revoking the lease it was on no longer touches it.
+func (e *Etcd) TakeOver(key, expected, value string) (ok bool, err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err := e.checkValue(key, value); err != nil {
+		return false, err
+	}
+	e.dropPending(key)
+	cmp := clientv3.Compare(clientv3.Value(key), "=", e.encodeValue(expected))
+	_, ok, err = e.grantIf(context.Background(), []clientv3.Cmp{cmp}, map[string]string{key: value}, e.grantTTL())
+	if err != nil {
+		e.log().Errorf("Etcd.TakeOver %s %v", key, err)
+		return false, err
+	}
+	return ok, nil
+}
+
+// Release stops keeping key without deleting it, e.g. once another instance
+// took it over. Its lease is revoked on close like any other.
+func (e *Etcd) Release(key string) {
+	e.dropPending(key)
+	e.liveKeyIDLock.Lock()
+	e.untrack(key)
+	e.liveKeyIDLock.Unlock()
+}
+
+// Handover hands node id over to the instance successor without a moment
+// where the node is missing. It re-registers the node as Draining with
+// that Successor, then waits until the successor took it over with TakeOver
+// and stops keeping it. The node stays registered as Draining if ctx is
+// done first.
+func (s *Services) Handover(ctx context.Context, id, successor string) error {
+	t, ok := s.registry.(Transferer)
+	if !ok {
+		return errNoTransfer
+	}
+	s.mu.Lock()
+	node, ok := s.nodes[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("service node %s is not registered", id)
+	}
+	node.Health = Draining
+	node.Successor = successor
+	node, kv, err := s.layout(node)
+	if err != nil {
+		return err
+	}
+	if err := s.registry.Update(kv.Key, kv.Value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.nodes[id] = node
+	s.mu.Unlock()
+	_, _, err = s.waitKey(ctx, kv.Key, func(value string, found bool) bool {
+		return !found || value != kv.Value
+	})
+	if err != nil {
+		return err
+	}
+	t.Release(kv.Key)
+	s.mu.Lock()
+	delete(s.nodes, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// TakeOver registers node in place of the instance handing it over with
+// Handover to this one, in one transaction so the node never disappears.
+// It waits until the marker of the outgoing instance is there, or until
+// ctx is done; a node not registered at all is simply registered.
+func (s *Services) TakeOver(ctx context.Context, node ServiceNode) error {
+	t, ok := s.registry.(Transferer)
+	if !ok {
+		return errNoTransfer
+	}
+	node, kv, err := s.layout(node)
+	if err != nil {
+		return err
+	}
+	for {
+		marker, found, err := s.waitKey(ctx, kv.Key, func(value string, found bool) bool {
+			if !found {
+				return true
+			}
+			old, err := unmarshalServiceNode(value)
+			return err == nil && old.Health == Draining && old.Successor == node.Instance
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return s.Register(node)
+		}
+		ok, err := t.TakeOver(kv.Key, marker, kv.Value)
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.mu.Lock()
+			s.nodes[node.ID] = node
+			s.mu.Unlock()
+			return nil
+		}
+		// changed since it was read, wait for the marker again
+	}
+}
+
+// waitKey returns the value of key once done holds for it, found is false
+// while key does not exist. It reads key again after every change.
+func (s *Services) waitKey(ctx context.Context, key string, done func(value string, found bool) bool) (string, bool, error) {
+	changed := make(chan struct{}, 1)
+	stop, err := s.registry.Watch(key, false, func(EventType, string, string) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return "", false, err
+	}
+	defer stop()
+	for {
+		value, err := s.registry.Get(key)
+		found := err == nil
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return "", false, err
+		}
+		if done(value, found) {
+			return value, found, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-changed:
+		}
+	}
+}
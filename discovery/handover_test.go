@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandover(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	outgoing := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	incoming := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	observer := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	key := serviceKey("sfu", "sfu1")
+
+	var mu sync.Mutex
+	var events []EventType
+	stop, err := observer.Watch(key, false, func(typ EventType, key, value string) {
+		mu.Lock()
+		events = append(events, typ)
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	s1 := NewServices(outgoing)
+	if err := s1.Register(ServiceNode{ID: "sfu1", Name: "sfu", Addr: "10.0.0.1:5000"}); err != nil {
+		t.Fatal(err)
+	}
+	s2 := NewServices(incoming)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	took := make(chan error, 1)
+	go func() {
+		took <- s2.TakeOver(ctx, ServiceNode{ID: "sfu1", Name: "sfu", Addr: "10.0.0.2:5000"})
+	}()
+	if err := s1.Handover(ctx, "sfu1", s2.Instance()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-took; err != nil {
+		t.Fatal(err)
+	}
+	// the lease of the outgoing node no longer holds the key
+	if err := outgoing.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	n, err := NewServices(observer).Get("sfu", "sfu1")
+	if err != nil || n.Addr != "10.0.0.2:5000" || n.Instance != s2.Instance() || n.Health != Healthy {
+		t.Fatalf("node after handover %+v, %v", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) < 2 {
+		t.Fatalf("events %v, want the marker and the takeover", events)
+	}
+	for _, typ := range events {
+		if typ != EventPut {
+			t.Fatalf("key absent during handover, events %v", events)
+		}
+	}
+}
+
+func TestHandoverUnsupported(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	if err := s.TakeOver(context.Background(), ServiceNode{ID: "sfu1", Name: "sfu"}); err != errNoTransfer {
+		t.Fatalf("TakeOver err = %v", err)
+	}
+}
+
+// wrappedNotFound is a registry whose Get wraps ErrKeyNotFound
+type wrappedNotFound struct{ Registry }
+
+func (w wrappedNotFound) Get(key string) (string, error) {
+	v, err := w.Registry.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("get %s: %w", key, err)
+	}
+	return v, nil
+}
+
+func TestWaitKeyWrappedNotFound(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(wrappedNotFound{m})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, found, err := s.waitKey(ctx, "ion://test/handover/missing", func(_ string, found bool) bool { return !found })
+	if err != nil || found {
+		t.Fatalf("waitKey = %v, %v, want a missing key", found, err)
+	}
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const defaultVirtualNodes = 128
+
+// ConsistentHashSelector maps a key, such as a room id, to the same node as
+// long as that node is alive. Each node is placed at several points of a
+// hash ring, so a joining or leaving node only moves the keys next to its
+// own points.
+type ConsistentHashSelector struct {
+	replicas int
+
+	mu     sync.RWMutex
+	nodes  map[string]ServiceNode
+	ring   []uint32
+	owners map[uint32]string
+}
+
+// NewConsistentHashSelector places every node at replicas points of the
+// ring, defaultVirtualNodes when replicas is 0
+func NewConsistentHashSelector(replicas int) *ConsistentHashSelector {
+	if replicas <= 0 {
+		replicas = defaultVirtualNodes
+	}
+	return &ConsistentHashSelector{
+		replicas: replicas,
+		nodes:    make(map[string]ServiceNode),
+		owners:   make(map[uint32]string),
+	}
+}
+
+// Watch keeps the ring in sync with the nodes of service name, the returned
+// func stops watching
+func (c *ConsistentHashSelector) Watch(services *Services, name string) (func(), error) {
+	return services.WatchServices(name, c.Add, c.Add, c.Remove)
+}
+
+// Add places node on the ring, a known node only has its fields updated
+func (c *ConsistentHashSelector) Add(node ServiceNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, known := c.nodes[node.ID]
+	c.nodes[node.ID] = node
+	if known {
+		return
+	}
+	for i := 0; i < c.replicas; i++ {
+		h := hashKey(node.ID + "#" + strconv.Itoa(i))
+		if owner, ok := c.owners[h]; ok && owner < node.ID {
+			// on a collision the smallest id keeps the point
+			continue
+		}
+		if _, ok := c.owners[h]; !ok {
+			c.ring = append(c.ring, h)
+		}
+		c.owners[h] = node.ID
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+}
+
+func (c *ConsistentHashSelector) Remove(node ServiceNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[node.ID]; !ok {
+		return
+	}
+	delete(c.nodes, node.ID)
+	ring := c.ring[:0]
+	for _, h := range c.ring {
+		if c.owners[h] == node.ID {
+			delete(c.owners, h)
+			continue
+		}
+		ring = append(ring, h)
+	}
+	c.ring = ring
+}
+
+// Get returns the node owning key, false when the ring is empty
+func (c *ConsistentHashSelector) Get(key string) (ServiceNode, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ring) == 0 {
+		return ServiceNode{}, false
+	}
+	h := hashKey(key)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.nodes[c.owners[c.ring[i]]], true
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
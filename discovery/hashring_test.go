@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConsistentHash(t *testing.T) {
+	c := NewConsistentHashSelector(0)
+	if _, ok := c.Get("room1"); ok {
+		t.Fatal("empty ring returned a node")
+	}
+	for i := 0; i < 4; i++ {
+		c.Add(ServiceNode{ID: fmt.Sprintf("sfu%d", i), Name: "sfu"})
+	}
+	const keys = 10000
+	before := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprintf("room%d", i)
+		n, _ := c.Get(k)
+		before[k] = n.ID
+	}
+	if n, _ := c.Get("room1"); n.ID != before["room1"] {
+		t.Fatal("same key mapped to another node")
+	}
+
+	c.Add(ServiceNode{ID: "sfu4", Name: "sfu"})
+	moved := 0
+	for k, id := range before {
+		n, _ := c.Get(k)
+		if n.ID != id {
+			if n.ID != "sfu4" {
+				t.Fatalf("%s moved from %s to %s, not to the new node", k, id, n.ID)
+			}
+			moved++
+		}
+	}
+	// ideally 1/5 of the keys move to the new node
+	if f := float64(moved) / keys; f < 0.1 || f > 0.3 {
+		t.Fatalf("%.2f of the keys moved", f)
+	}
+
+	c.Remove(ServiceNode{ID: "sfu4"})
+	for k, id := range before {
+		if n, _ := c.Get(k); n.ID != id {
+			t.Fatalf("%s on %s after removing the new node, was %s", k, n.ID, id)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnavailable is returned by Ping when no endpoint answers
+var ErrUnavailable = errors.New("etcd unavailable")
+
+// Status is what the first answering endpoint reports about the cluster
+type Status struct {
+	Endpoint string
+	Version  string
+	Leader   uint64
+	MemberID uint64
+	DBSize   int64
+	// Revision is the store revision the endpoint is at
+	Revision int64
+}
+
+// DiscoveryStatus is the state of the client and of the leases it keeps,
+// for readiness checks
+type DiscoveryStatus struct {
+	// Connected is false while no endpoint answers and the client is
+	// reconnecting
+	Connected bool
+	// HealthyEndpoints answered the last probe, see HealthyEndpoints
+	HealthyEndpoints []string
+	// TrackedLeases are the leases kept alive, LeasesLost those of them that
+	// stopped renewing and are not re-granted yet
+	TrackedLeases int
+	LeasesLost    int
+	// LastReconnect is when the client was last replaced, zero if never
+	LastReconnect time.Time
+}
+
+// OK reports whether discovery is fully operational: connected with every
+// lease alive
+func (s DiscoveryStatus) OK() bool {
+	return s.Connected && len(s.HealthyEndpoints) > 0 && s.LeasesLost == 0
+}
+
+// DiscoveryStatus returns the current DiscoveryStatus without any request
+// to etcd, it is as fresh as the last HealthCheckInterval probe
+func (e *Etcd) DiscoveryStatus() DiscoveryStatus {
+	var s DiscoveryStatus
+	e.healthyLock.RLock()
+	s.Connected = !e.reconnecting
+	s.HealthyEndpoints = append([]string(nil), e.healthyEndpoints...)
+	s.LastReconnect = e.lastReconnect
+	e.healthyLock.RUnlock()
+
+	leases := make(map[*lease]struct{})
+	e.liveKeyIDLock.RLock()
+	for _, lk := range e.liveKeyID {
+		leases[lk.lease] = struct{}{}
+	}
+	for _, l := range e.shared {
+		leases[l] = struct{}{}
+	}
+	for _, l := range e.claims {
+		leases[l] = struct{}{}
+	}
+	e.liveKeyIDLock.RUnlock()
+	s.TrackedLeases = len(leases)
+	s.LeasesLost = int(atomic.LoadInt64(&e.lostLeases))
+	return s
+}
+
+// Ping returns nil if at least one endpoint answers within the deadline of
+// ctx, for readiness probes
+func (e *Etcd) Ping(ctx context.Context) error {
+	_, err := e.Status(ctx)
+	return err
+}
+
+// Status asks every endpoint in turn and returns the first answer
+func (e *Etcd) Status(ctx context.Context) (*Status, error) {
+	cli := e.cli()
+	var last error
+	for _, ep := range cli.Endpoints() {
+		resp, err := cli.Status(ctx, ep)
+		if err != nil {
+			last = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		return &Status{
+			Endpoint: ep,
+			Version:  resp.Version,
+			Leader:   resp.Leader,
+			MemberID: resp.Header.MemberId,
+			DBSize:   resp.DbSize,
+			Revision: resp.Header.Revision,
+		}, nil
+	}
+	if last == nil {
+		return nil, ErrUnavailable
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnavailable, etcdError(last))
+}
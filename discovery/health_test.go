@@ -0,0 +1,112 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPing(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := e.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s, err := e.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version == "" || s.Leader == 0 || s.Leader != s.MemberID {
+		t.Fatalf("status %+v", s)
+	}
+}
+
+func TestPingDown(t *testing.T) {
+	srv, ep := startEtcd(t, nil)
+	e := newTestEtcd(t, Config{Endpoints: []string{ep}, OperationTimeout: 300 * time.Millisecond})
+	srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := e.Ping(ctx)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("ping err = %v, want ErrUnavailable", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("ping took %v", d)
+	}
+}
+
+func TestDiscoveryStatus(t *testing.T) {
+	srv, ep := startEtcd(t, nil)
+	dead := freeURL(t, "http").Host
+	// grants fail while set, so a lost lease stays lost
+	var failGrant int32
+	grant := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if method == "/etcdserverpb.Lease/LeaseGrant" && atomic.LoadInt32(&failGrant) == 1 {
+			return status.Error(codes.Unavailable, "grant disabled")
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	e := newTestEtcd(t, Config{
+		Endpoints:           []string{ep, dead},
+		OperationTimeout:    300 * time.Millisecond,
+		HealthCheckInterval: 50 * time.Millisecond,
+		Retry:               RetryPolicy{MaxAttempts: 1},
+		DialOptions:         []grpc.DialOption{grpc.WithChainUnaryInterceptor(grant)},
+	})
+	if err := e.keep("ion://test/status/a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.keep("ion://test/status/b", "v"); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus := func(what string, ok func(DiscoveryStatus) bool) DiscoveryStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s := e.DiscoveryStatus()
+			if ok(s) {
+				return s
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("status %+v, want %s", s, what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the dead endpoint is dropped by the first probe
+	s := waitStatus("one healthy endpoint", func(s DiscoveryStatus) bool { return len(s.HealthyEndpoints) == 1 })
+	if !s.Connected || s.HealthyEndpoints[0] != ep || s.TrackedLeases != 2 || s.LeasesLost != 0 || !s.OK() || !s.LastReconnect.IsZero() {
+		t.Fatalf("status %+v", s)
+	}
+
+	atomic.StoreInt32(&failGrant, 1)
+	e.liveKeyIDLock.RLock()
+	id := e.liveKeyID["ion://test/status/a"].lease.id
+	e.liveKeyIDLock.RUnlock()
+	if _, err := e.cli().Revoke(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	s = waitStatus("a lost lease", func(s DiscoveryStatus) bool { return s.LeasesLost == 1 })
+	if s.OK() {
+		t.Fatalf("status %+v OK with a lost lease", s)
+	}
+	atomic.StoreInt32(&failGrant, 0)
+	waitStatus("the lease re-granted", func(s DiscoveryStatus) bool { return s.LeasesLost == 0 && s.TrackedLeases == 2 && s.OK() })
+
+	srv.Close()
+	s = waitStatus("disconnected", func(s DiscoveryStatus) bool { return !s.Connected })
+	if s.OK() {
+		t.Fatalf("status %+v OK while disconnected", s)
+	}
+}
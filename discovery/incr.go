@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// attempts of Incr when other writers change the key between its read and
+// write, waiting a random time up to a backoff doubling from incrBackoff to
+// incrMaxBackoff in between
+const (
+	incrAttempts   = 64
+	incrBackoff    = time.Millisecond
+	incrMaxBackoff = time.Millisecond * 100
+)
+
+// Incr adds delta to the decimal counter at key and returns the new value,
+// a missing key counts from 0. The write is guarded by the revision read, so
+// concurrent Incr of one key across the cluster never lose an increment; a
+// lost race reads the key again within the same transaction. One that keeps
+// losing fails with ErrConflict, one over the int64 range fails without a
+// write. The key is static like a PutStatic one.
+func (e *Etcd) Incr(key string, delta int64) (n int64, err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err := e.writable(); err != nil {
+		return 0, err
+	}
+	e.dropPending(key)
+	e.liveKeyIDLock.Lock()
+	e.untrack(key)
+	e.liveKeyIDLock.Unlock()
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Get(ctx, key)
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.Incr %s %v", key, err)
+		return 0, etcdError(err)
+	}
+	kvs := resp.Kvs
+	backoff := incrBackoff
+	for attempt := 0; attempt < incrAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+			if backoff *= 2; backoff > incrMaxBackoff {
+				backoff = incrMaxBackoff
+			}
+		}
+		var cur, rev int64
+		if len(kvs) > 0 {
+			if cur, err = strconv.ParseInt(decodeValue(kvs[0].Value), 10, 64); err != nil {
+				return 0, fmt.Errorf("counter %s: %w", key, err)
+			}
+			rev = kvs[0].ModRevision
+		}
+		if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+			return 0, fmt.Errorf("incr %s: %d%+d overflows int64", key, cur, delta)
+		}
+		n = cur + delta
+		value := strconv.FormatInt(n, 10)
+		if err := e.checkValue(key, value); err != nil {
+			return 0, err
+		}
+		ctx, cancel := e.opContext(context.Background())
+		txn, err := e.cli().Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(clientv3.OpPut(key, e.encodeValue(value))).
+			Else(clientv3.OpGet(key)).
+			Commit()
+		cancel()
+		if err != nil {
+			e.log().Errorf("Etcd.Incr %s %v", key, err)
+			return 0, etcdError(err)
+		}
+		if txn.Succeeded {
+			return n, nil
+		}
+		kvs = txn.Responses[0].GetResponseRange().Kvs
+	}
+	return 0, fmt.Errorf("incr %s: %w", key, ErrConflict)
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncr(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/incr/counter"
+	if n, err := e.Incr(key, 5); err != nil || n != 5 {
+		t.Fatalf("Incr of a missing key = %d, %v, want 5", n, err)
+	}
+	if n, err := e.Incr(key, -2); err != nil || n != 3 {
+		t.Fatalf("Incr = %d, %v, want 3", n, err)
+	}
+
+	const workers, each = 16, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*each)
+	want := int64(3)
+	for w := 0; w < workers; w++ {
+		delta := int64(w + 1)
+		want += delta * each
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				if _, err := e.Incr(key, delta); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if v, err := e.get(key); err != nil || v != strconv.FormatInt(want, 10) {
+		t.Fatalf("counter = %q, %v, want %d", v, err, want)
+	}
+
+	if err := e.PutStatic("ion://test/incr/text", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Incr("ion://test/incr/text", 1); err == nil {
+		t.Fatal("Incr of a non numeric value succeeded")
+	}
+}
+
+func TestIncrKeptKey(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/incr/kept"
+	if err := e.keep(key, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := e.Incr(key, 1); err != nil || n != 2 {
+		t.Fatalf("Incr = %d, %v, want 2", n, err)
+	}
+	if e.tracked(key) {
+		t.Fatal("Incr left the key kept")
+	}
+
+	if err := e.PutStatic(key, strconv.FormatInt(math.MaxInt64, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Incr(key, 1); err == nil {
+		t.Fatal("Incr over MaxInt64 succeeded")
+	}
+	if v, _ := e.get(key); v != strconv.FormatInt(math.MaxInt64, 10) {
+		t.Fatalf("counter = %q after an overflow", v)
+	}
+}
@@ -0,0 +1,37 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PutJSON keeps key alive with v encoded as JSON
+func (e *Etcd) PutJSON(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("etcd json encode %s: %w", key, err)
+	}
+	return e.keep(key, string(b))
+}
+
+// PutJSONStatic is PutStatic with v encoded as JSON
+func (e *Etcd) PutJSONStatic(key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("etcd json encode %s: %w", key, err)
+	}
+	return e.PutStatic(key, string(b))
+}
+
+// GetJSON decodes the value of key into out, ErrKeyNotFound when it does
+// not exist
+func (e *Etcd) GetJSON(key string, out interface{}) error {
+	v, err := e.get(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(v), out); err != nil {
+		return fmt.Errorf("etcd json decode %s: %w", key, err)
+	}
+	return nil
+}
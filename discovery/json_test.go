@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	in := ServiceNode{ID: "1", Name: "sfu", Addr: "10.0.0.1:5000", Meta: map[string]string{"load": "3"}}
+	if err := e.PutJSON("ion://test/json/node", in); err != nil {
+		t.Fatal(err)
+	}
+	var out ServiceNode
+	if err := e.GetJSON("ion://test/json/node", &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip %+v, %v", out, err)
+	}
+	if err := e.GetJSON("ion://test/json/missing", &out); err != ErrKeyNotFound {
+		t.Fatalf("missing key err = %v", err)
+	}
+
+	e.keep("ion://test/json/bad", "{not json")
+	var syntax *json.SyntaxError
+	if err := e.GetJSON("ion://test/json/bad", &out); !errors.As(err, &syntax) {
+		t.Fatalf("malformed json err = %v", err)
+	}
+	if err := e.PutJSON("ion://test/json/chan", make(chan int)); err == nil {
+		t.Fatal("unencodable value put")
+	}
+
+	if err := e.PutJSONStatic("ion://test/json/config", map[string]int{"max": 10}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := e.cli().Get(context.Background(), "ion://test/json/config")
+	if err != nil || len(resp.Kvs) != 1 || resp.Kvs[0].Lease != 0 {
+		t.Fatalf("static put %v, %v", resp, err)
+	}
+	e.liveKeyIDLock.RLock()
+	_, tracked := e.liveKeyID["ion://test/json/config"]
+	e.liveKeyIDLock.RUnlock()
+	if tracked {
+		t.Fatal("static key is tracked")
+	}
+}
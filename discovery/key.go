@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"net/url"
+	"strings"
+)
+
+// keySeparator separates the parts of a Key
+const keySeparator = "/"
+
+// keyRoot is the Key of no part, every key of ion is under its Prefix
+const keyRoot Key = "ion:/"
+
+// Key is a key built from parts, each escaped so a / or % inside a part can
+// never be taken for a separator. Build keys with it rather than by
+// concatenation, and list the keys under one with its Prefix: the trailing
+// separator keeps ion://node/a/ from matching ion://node/ab.
+type Key string
+
+// Join returns the key ion://<part>/<part>...
+func Join(parts ...string) Key {
+	return keyRoot.Join(parts...)
+}
+
+// ForNode is the key a node of service registers under, ion://node/<service>/<id>
+func ForNode(service, id string) Key {
+	return Join("node", service, id)
+}
+
+// Join returns the key of parts under k
+func (k Key) Join(parts ...string) Key {
+	var b strings.Builder
+	b.WriteString(string(k))
+	for _, p := range parts {
+		b.WriteString(keySeparator)
+		b.WriteString(url.PathEscape(p))
+	}
+	return Key(b.String())
+}
+
+// Prefix matches the keys under k and not k itself nor its siblings
+func (k Key) Prefix() string {
+	return string(k) + keySeparator
+}
+
+func (k Key) String() string {
+	return string(k)
+}
+
+// Parts returns the unescaped parts k was built from, false when k is not
+// a key built by Join
+func (k Key) Parts() ([]string, bool) {
+	rest := strings.TrimPrefix(string(k), keyRoot.Prefix())
+	if rest == string(k) {
+		return nil, false
+	}
+	parts := strings.Split(rest, keySeparator)
+	for i, p := range parts {
+		u, err := url.PathUnescape(p)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = u
+	}
+	return parts, true
+}
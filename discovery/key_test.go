@@ -0,0 +1,59 @@
+package discovery
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	for _, c := range []struct {
+		key  Key
+		want string
+	}{
+		{Join("room"), "ion://room"},
+		{ForNode("sfu", "10.0.0.1:5000"), "ion://node/sfu/10.0.0.1:5000"},
+		{ForNode("sfu/a", "b"), "ion://node/sfu%2Fa/b"},
+		{Join("node").Join("sfu", "100%"), "ion://node/sfu/100%25"},
+	} {
+		if c.key.String() != c.want {
+			t.Fatalf("key %s, want %s", c.key, c.want)
+		}
+	}
+
+	parts := []string{"node", "sfu/a", "b%2F", "10.0.0.1:5000"}
+	got, ok := Join(parts...).Parts()
+	if !ok || !reflect.DeepEqual(got, parts) {
+		t.Fatalf("parts = %q, %v, want %q", got, ok, parts)
+	}
+	if _, ok := Key("other://a").Parts(); ok {
+		t.Fatal("parts of a key not built by Join")
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	prefix := Join("node", "a").Prefix()
+	if prefix != "ion://node/a/" {
+		t.Fatalf("prefix %s", prefix)
+	}
+	for _, k := range []Key{ForNode("a", "1"), Join("node", "a", "1", "stream")} {
+		if !strings.HasPrefix(k.String(), prefix) {
+			t.Fatalf("%s not under %s", k, prefix)
+		}
+	}
+	// neither the key itself, a sibling sharing its start nor a part
+	// holding a separator
+	for _, k := range []Key{Join("node", "a"), ForNode("ab", "1"), Join("node", "a/1")} {
+		if strings.HasPrefix(k.String(), prefix) {
+			t.Fatalf("%s matches %s", k, prefix)
+		}
+	}
+
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	m.Keep(ForNode("a", "1").String(), "1")
+	m.Keep(ForNode("ab", "1").String(), "2")
+	if got, _ := m.GetByPrefix(prefix); len(got) != 1 {
+		t.Fatalf("GetByPrefix %s = %v", prefix, got)
+	}
+}
@@ -0,0 +1,482 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// lease is a lease kept alive by this instance and the keys put on it
+type lease struct {
+	id clientv3.LeaseID
+	// granted ttl in seconds, used again when the lease is re-granted
+	ttl  int64
+	keys map[string]struct{}
+	// stops the keepalive goroutine
+	cancel context.CancelFunc
+	// room is 1 while the keepalive holds a MaxLeases slot of leaseCount,
+	// see releaseRoom
+	room *int32
+	// handle is the id NewLease returned for a shared lease, it stays the
+	// same when the lease is re-granted under a new id. 0 for the others.
+	// It is set once the keepalive runs, so it is read under liveKeyIDLock.
+	handle clientv3.LeaseID
+}
+
+// liveKey is a key held alive by this instance
+type liveKey struct {
+	lease *lease
+	value string
+}
+
+// PutAll writes every key of kv in one transaction, so either all or none of
+// them are stored. The keys share one lease that is kept alive like keep.
+func (e *Etcd) PutAll(ctx context.Context, kv map[string]string) (err error) {
+	if len(kv) == 0 {
+		return nil
+	}
+	defer observe(opPut, time.Now(), &err)
+	for k, v := range kv {
+		if err := e.checkValue(k, v); err != nil {
+			return err
+		}
+	}
+	if err = e.keepAll(ctx, kv, e.grantTTL()); err != nil {
+		e.log().Errorf("Etcd.PutAll %d keys %v", len(kv), err)
+		return err
+	}
+	return nil
+}
+
+// TrackedKeys returns the keys this instance keeps alive, sorted. It is
+// what this instance believes it owns, compare it with etcd to debug a
+// registration.
+func (e *Etcd) TrackedKeys() []string {
+	e.liveKeyIDLock.RLock()
+	keys := make([]string, 0, len(e.liveKeyID))
+	for k := range e.liveKeyID {
+		keys = append(keys, k)
+	}
+	e.liveKeyIDLock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// TrackedLeases returns the id of the lease each kept key is on
+func (e *Etcd) TrackedLeases() map[string]int64 {
+	e.liveKeyIDLock.RLock()
+	defer e.liveKeyIDLock.RUnlock()
+	m := make(map[string]int64, len(e.liveKeyID))
+	for k, lk := range e.liveKeyID {
+		m[k] = int64(lk.lease.id)
+	}
+	return m
+}
+
+// TimeToLive returns the time left on the lease of a key this instance
+// keeps, ErrKeyNotFound when it keeps no such key
+func (e *Etcd) TimeToLive(key string) (time.Duration, error) {
+	e.liveKeyIDLock.RLock()
+	lk, ok := e.liveKeyID[key]
+	e.liveKeyIDLock.RUnlock()
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().TimeToLive(ctx, lk.lease.id)
+	cancel()
+	if err != nil {
+		return 0, etcdError(err)
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+// Revoke revokes the lease of a key this instance keeps, ErrKeyNotFound
+// when it keeps no such key. Every key sharing that lease, such as the keys
+// of one PutAll or of a NewLease, is deleted by etcd at once and stops being
+// kept.
+func (e *Etcd) Revoke(key string) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	e.liveKeyIDLock.Lock()
+	lk, ok := e.liveKeyID[key]
+	if !ok {
+		e.liveKeyIDLock.Unlock()
+		return ErrKeyNotFound
+	}
+	l := lk.lease
+	for k := range l.keys {
+		e.dropPending(k)
+		e.untrack(k)
+	}
+	if l.handle != 0 {
+		delete(e.shared, l.handle)
+		l.cancel()
+	}
+	e.liveKeyIDLock.Unlock()
+	ctx, cancel := e.opContext(context.Background())
+	_, err = e.cli().Revoke(ctx, l.id)
+	cancel()
+	return etcdError(err)
+}
+
+// errMoveConflict is MoveKey finding the old key changed or the new one taken
+var errMoveConflict = errors.New("key changed or target exists")
+
+// MoveKey renames a key this instance keeps, ErrKeyNotFound when it keeps
+// no such key. One transaction puts newKey with the value on the lease of
+// oldKey and deletes oldKey, so one of them exists at every revision and no
+// lease is granted; newKey is kept from then on. It fails without a change
+// if oldKey no longer holds what this instance put or newKey exists.
+func (e *Etcd) MoveKey(oldKey, newKey string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err := e.writable(); err != nil {
+		return err
+	}
+	e.dropPending(oldKey)
+	e.dropPending(newKey)
+	e.liveKeyIDLock.RLock()
+	lk, ok := e.liveKeyID[oldKey]
+	var id clientv3.LeaseID
+	var value string
+	if ok {
+		id, value = lk.lease.id, lk.value
+	}
+	e.liveKeyIDLock.RUnlock()
+	if !ok {
+		return ErrKeyNotFound
+	}
+	encoded := e.encodeValue(value)
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.Value(oldKey), "=", encoded),
+			clientv3.Compare(clientv3.LeaseValue(oldKey), "=", id),
+			clientv3.Compare(clientv3.CreateRevision(newKey), "=", 0),
+		).
+		Then(clientv3.OpPut(newKey, encoded, clientv3.WithLease(id)), clientv3.OpDelete(oldKey)).
+		Commit()
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.MoveKey %s %s %v", oldKey, newKey, err)
+		return etcdError(err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("move %s to %s: %w", oldKey, newKey, errMoveConflict)
+	}
+	e.liveKeyIDLock.Lock()
+	if cur, ok := e.liveKeyID[oldKey]; ok && cur == lk {
+		// newKey first, the lease must not be left without keys
+		e.track(newKey, value, lk.lease)
+		e.untrack(oldKey)
+	}
+	e.liveKeyIDLock.Unlock()
+	return nil
+}
+
+// NewLease grants a lease of ttl that is kept alive until Revoke of one of
+// its keys or close, even while no key is on it. Keys put on it with
+// keepOnLease share its single keepalive and all expire together when the
+// node dies, instead of one lease per key. The returned id stays valid when
+// the lease gets re-granted after a loss or a reconnect.
+func (e *Etcd) NewLease(ttl time.Duration) (clientv3.LeaseID, error) {
+	if ttl < time.Second {
+		return 0, fmt.Errorf("lease ttl %v is less than 1s", ttl)
+	}
+	l, err := e.grantAll(e.ctx, nil, int64(ttl/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	e.liveKeyIDLock.Lock()
+	l.handle = l.id
+	e.shared[l.id] = l
+	e.liveKeyIDLock.Unlock()
+	return l.id, nil
+}
+
+// keepOnLease is keep on a lease from NewLease, ErrLeaseExpired when there
+// is no such lease
+func (e *Etcd) keepOnLease(id clientv3.LeaseID, key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err := e.writable(); err != nil {
+		return err
+	}
+	if err := e.checkValue(key, value); err != nil {
+		return err
+	}
+	e.dropPending(key)
+	for {
+		e.liveKeyIDLock.RLock()
+		l, ok := e.shared[id]
+		e.liveKeyIDLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w: no shared lease %x", ErrLeaseExpired, id)
+		}
+		ctx, cancel := e.opContext(context.Background())
+		_, err = e.cli().Put(ctx, key, e.encodeValue(value), clientv3.WithLease(l.id))
+		cancel()
+		if err != nil {
+			return etcdError(err)
+		}
+		e.liveKeyIDLock.Lock()
+		if e.shared[id] == l {
+			e.track(key, value, l)
+			e.liveKeyIDLock.Unlock()
+			return nil
+		}
+		// re-granted while putting, the key must go on the new lease
+		e.liveKeyIDLock.Unlock()
+	}
+}
+
+// keepAll grants a lease of ttl seconds, puts kv on it atomically and keeps
+// it alive
+func (e *Etcd) keepAll(ctx context.Context, kv map[string]string, ttl int64) error {
+	_, err := e.grantAll(ctx, kv, ttl)
+	return err
+}
+
+// regrant is keepAll for the keys of a lost lease, a shared lease keeps its
+// handle and is re-granted even without keys
+func (e *Etcd) regrant(ctx context.Context, old *lease, kv map[string]string) error {
+	e.liveKeyIDLock.RLock()
+	handle := old.handle
+	current := e.shared[handle] == old
+	e.liveKeyIDLock.RUnlock()
+	if handle == 0 {
+		return e.keepAll(ctx, kv, old.ttl)
+	}
+	if !current {
+		// revoked meanwhile
+		return nil
+	}
+	l, err := e.grantAll(ctx, kv, old.ttl)
+	if err != nil {
+		return err
+	}
+	e.liveKeyIDLock.Lock()
+	l.handle = handle
+	e.shared[handle] = l
+	e.liveKeyIDLock.Unlock()
+	return nil
+}
+
+func (e *Etcd) grantAll(ctx context.Context, kv map[string]string, ttl int64) (*lease, error) {
+	l, _, err := e.grantIf(ctx, nil, kv, ttl)
+	return l, err
+}
+
+// grantIf is grantAll putting kv only if every cmp holds, it returns false
+// and no lease when one did not
+func (e *Etcd) grantIf(ctx context.Context, cmps []clientv3.Cmp, kv map[string]string, ttl int64) (*lease, bool, error) {
+	if err := e.writable(); err != nil {
+		return nil, false, err
+	}
+	if err := e.leaseRoom(); err != nil {
+		return nil, false, err
+	}
+	opCtx, cancel := e.opContext(ctx)
+	resp, err := e.cli().Grant(opCtx, ttl)
+	cancel()
+	if err != nil {
+		return nil, false, etcdError(err)
+	}
+	if len(kv) > 0 {
+		ops := make([]clientv3.Op, 0, len(kv))
+		for k, v := range kv {
+			ops = append(ops, clientv3.OpPut(k, e.encodeValue(v), clientv3.WithLease(resp.ID)))
+		}
+		opCtx, cancel = e.opContext(ctx)
+		txn, err := e.cli().Txn(opCtx).If(cmps...).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			e.revokeLease(resp.ID)
+			return nil, false, etcdError(err)
+		}
+		if !txn.Succeeded {
+			e.revokeLease(resp.ID)
+			return nil, false, nil
+		}
+	}
+
+	l, err := e.keepAlive(resp.ID, ttl)
+	if err != nil {
+		e.revokeLease(resp.ID)
+		return nil, false, err
+	}
+	e.liveKeyIDLock.Lock()
+	for k, v := range kv {
+		e.track(k, v, l)
+	}
+	e.liveKeyIDLock.Unlock()
+	return l, true, nil
+}
+
+// revokeLease drops a lease that never got tracked, so nothing is left on it
+func (e *Etcd) revokeLease(id clientv3.LeaseID) {
+	ctx, cancel := e.opContext(context.Background())
+	defer cancel()
+	if _, err := e.cli().Revoke(ctx, id); err != nil {
+		e.log().Errorf("Etcd.revoke lease=%x %v", id, err)
+	}
+}
+
+// LeaseCount returns how many leases this instance keeps alive, which
+// MaxLeases caps
+func (e *Etcd) LeaseCount() int {
+	return int(atomic.LoadInt64(&e.leaseCount))
+}
+
+// leaseRoom is ErrLeaseLimitExceeded when MaxLeases leases are kept alive,
+// checked before a grant so etcd is not asked for a lease keepAlive rejects
+func (e *Etcd) leaseRoom() error {
+	if max := e.cfg.MaxLeases; max > 0 && e.LeaseCount() >= max {
+		return fmt.Errorf("%w: %d leases kept", ErrLeaseLimitExceeded, max)
+	}
+	return nil
+}
+
+// keepAlive starts renewing a lease, the lease outlives the request that
+// granted it so its keepalive only stops on untrack or close. It is
+// ErrLeaseLimitExceeded beyond MaxLeases, the caller revokes the lease.
+func (e *Etcd) keepAlive(id clientv3.LeaseID, ttl int64) (*lease, error) {
+	n := atomic.AddInt64(&e.leaseCount, 1)
+	if max := e.cfg.MaxLeases; max > 0 && n > int64(max) {
+		atomic.AddInt64(&e.leaseCount, -1)
+		e.log().Errorf("Etcd.keepalive lease=%x over the limit of %d leases", id, max)
+		return nil, fmt.Errorf("%w: %d leases kept", ErrLeaseLimitExceeded, max)
+	}
+	l := &lease{id: id, ttl: ttl, keys: make(map[string]struct{})}
+	if err := e.startKeepAlive(l); err != nil {
+		atomic.AddInt64(&e.leaseCount, -1)
+		return nil, err
+	}
+	return l, nil
+}
+
+// startKeepAlive renews l on the current client until l.cancel, its room
+// in leaseCount must be taken already
+func (e *Etcd) startKeepAlive(l *lease) error {
+	ctx, cancel := context.WithCancel(e.ctx)
+	ch, err := e.cli().KeepAlive(ctx, l.id)
+	if err != nil {
+		cancel()
+		return etcdError(err)
+	}
+	room := int32(1)
+	l.cancel, l.room = cancel, &room
+	e.keepers.Add(1)
+	go e.drainKeepAlive(ctx, l, ch, &room)
+	return nil
+}
+
+// releaseRoom gives the leaseCount slot of a keepalive back, once, when it
+// stops or when swapClient cancels it and re-grants right away
+func (e *Etcd) releaseRoom(room *int32) {
+	if atomic.CompareAndSwapInt32(room, 1, 0) {
+		atomic.AddInt64(&e.leaseCount, -1)
+	}
+}
+
+// track records key as kept on l, liveKeyIDLock must be held
+func (e *Etcd) track(key, value string, l *lease) {
+	e.untrack(key)
+	e.liveKeyID[key] = &liveKey{lease: l, value: value}
+	l.keys[key] = struct{}{}
+}
+
+// untrack forgets key and stops the keepalive of its lease once no key is
+// left on it, liveKeyIDLock must be held
+func (e *Etcd) untrack(key string) {
+	lk, ok := e.liveKeyID[key]
+	if !ok {
+		return
+	}
+	delete(e.liveKeyID, key)
+	delete(lk.lease.keys, key)
+	if len(lk.lease.keys) == 0 && lk.lease.handle == 0 {
+		lk.lease.cancel()
+	}
+}
+
+// leaseLost reports every key still on l before it is re-granted
+func (e *Etcd) leaseLost(l *lease) {
+	e.liveKeyIDLock.RLock()
+	keys := make([]string, 0, len(l.keys))
+	for k := range l.keys {
+		keys = append(keys, k)
+	}
+	e.liveKeyIDLock.RUnlock()
+	leaseLostTotal.Add(float64(len(keys)))
+	if e.cfg.OnLeaseLost == nil {
+		return
+	}
+	for _, k := range keys {
+		e.cfg.OnLeaseLost(k)
+	}
+}
+
+// drainKeepAlive consumes the keepalive responses of a lease, the client
+// stops renewing a lease whose channel is not drained. When the channel
+// closes without ctx being canceled the lease is lost, so its keys are
+// re-granted and re-put until that succeeds or they are all dropped.
+func (e *Etcd) drainKeepAlive(ctx context.Context, l *lease, ch <-chan *clientv3.LeaseKeepAliveResponse, room *int32) {
+	defer e.keepers.Done()
+	leasesGauge.Inc()
+	for range ch {
+		observeKeepAlive(true)
+	}
+	leasesGauge.Dec()
+	// a re-grant below needs the room of this lease
+	e.releaseRoom(room)
+	if ctx.Err() != nil {
+		return
+	}
+	observeKeepAlive(false)
+	e.log().Errorf("Etcd.keepalive lease=%x channel closed", l.id)
+	atomic.AddInt64(&e.lostLeases, 1)
+	defer atomic.AddInt64(&e.lostLeases, -1)
+	e.leaseLost(l)
+	e.liveKeyIDLock.Lock()
+	if e.claims[l.id] == l {
+		// a claim is not re-granted, see ClaimSlot
+		delete(e.claims, l.id)
+		e.liveKeyIDLock.Unlock()
+		return
+	}
+	e.liveKeyIDLock.Unlock()
+	e.regrantLoop(ctx, l, 0)
+}
+
+// regrantLoop re-grants the keys still on l after delay, and then every
+// second until that succeeds, they are all dropped or ctx is done
+func (e *Etcd) regrantLoop(ctx context.Context, l *lease, delay time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = time.Second
+		kv := make(map[string]string)
+		e.liveKeyIDLock.RLock()
+		for k := range l.keys {
+			kv[k] = e.liveKeyID[k].value
+		}
+		handle := l.handle
+		e.liveKeyIDLock.RUnlock()
+		if len(kv) == 0 && handle == 0 {
+			return
+		}
+		err := e.regrant(ctx, l, kv)
+		if err == nil {
+			return
+		}
+		observeKeepAlive(false)
+		e.log().Errorf("Etcd.keepalive lease=%x regrant %v", l.id, err)
+	}
+}
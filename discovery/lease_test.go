@@ -0,0 +1,335 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPutAll(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	kv := map[string]string{
+		"ion://test/putall/a": "1",
+		"ion://test/putall/b": "2",
+		"ion://test/putall/c": "3",
+	}
+	if err := e.PutAll(context.Background(), kv); err != nil {
+		t.Fatal(err)
+	}
+	m, err := e.getByPrefix("ion://test/putall/")
+	if err != nil || len(m) != len(kv) {
+		t.Fatalf("getByPrefix = %v, %v", m, err)
+	}
+	e.liveKeyIDLock.RLock()
+	l := e.liveKeyID["ion://test/putall/a"].lease
+	for k := range kv {
+		if e.liveKeyID[k].lease != l {
+			t.Errorf("%s is not on the shared lease", k)
+		}
+	}
+	e.liveKeyIDLock.RUnlock()
+
+	// dropping one key keeps the lease alive for the others
+	e.del("ion://test/putall/a")
+	if l.keys == nil || len(l.keys) != 2 {
+		t.Fatalf("lease keys = %v", l.keys)
+	}
+	resp, err := e.cli().TimeToLive(context.Background(), l.id)
+	if err != nil || resp.TTL <= 0 {
+		t.Fatalf("lease ttl = %v, %v", resp, err)
+	}
+}
+
+func TestPutAllCanceled(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := e.PutAll(ctx, map[string]string{
+		"ion://test/putall/x": "1",
+		"ion://test/putall/y": "2",
+	})
+	if err == nil {
+		t.Fatal("expected error from canceled PutAll")
+	}
+	m, err := e.getByPrefix("ion://test/putall/")
+	if err != nil || len(m) != 0 {
+		t.Fatalf("keys written by canceled PutAll: %v, %v", m, err)
+	}
+	if len(e.liveKeyID) != 0 {
+		t.Fatalf("tracked keys after canceled PutAll: %v", e.liveKeyID)
+	}
+}
+
+func TestKeepWithTTL(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	if err := e.keepWithTTL("ion://test/ttl/stream", "s", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.keepWithTTL("ion://test/ttl/service", "n", 30); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	if ttl := e.liveKeyID["ion://test/ttl/stream"].lease.ttl; ttl != 2 {
+		t.Fatalf("tracked ttl %d, want 2", ttl)
+	}
+	// stop renewing both leases as if the node died
+	for _, lk := range e.liveKeyID {
+		lk.lease.cancel()
+	}
+	e.liveKeyIDLock.RUnlock()
+
+	time.Sleep(4 * time.Second)
+	if _, err := e.get("ion://test/ttl/stream"); err != ErrKeyNotFound {
+		t.Fatalf("short ttl key err = %v, want ErrKeyNotFound", err)
+	}
+	if v, err := e.get("ion://test/ttl/service"); err != nil || v != "n" {
+		t.Fatalf("long ttl key = %q, %v", v, err)
+	}
+}
+
+func TestTimeToLive(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: 10 * time.Second})
+	if _, err := e.TimeToLive("ion://test/ttl/missing"); err != ErrKeyNotFound {
+		t.Fatalf("untracked key err = %v, want ErrKeyNotFound", err)
+	}
+	e.keep("ion://test/ttl/key", "v")
+	first, err := e.TimeToLive("ion://test/ttl/key")
+	if err != nil || first <= 0 || first > 10*time.Second {
+		t.Fatalf("ttl = %v, %v", first, err)
+	}
+	// without renewals the ttl runs down
+	e.liveKeyIDLock.RLock()
+	e.liveKeyID["ion://test/ttl/key"].lease.cancel()
+	e.liveKeyIDLock.RUnlock()
+	time.Sleep(2 * time.Second)
+	later, err := e.TimeToLive("ion://test/ttl/key")
+	if err != nil || later >= first {
+		t.Fatalf("ttl %v after 2s, was %v, err %v", later, first, err)
+	}
+}
+
+func TestOnLeaseLost(t *testing.T) {
+	lost := make(chan string, 4)
+	e := newTestEtcd(t, Config{OnLeaseLost: func(key string) { lost <- key }})
+	key := "ion://test/leaselost"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	id := e.liveKeyID[key].lease.id
+	e.liveKeyIDLock.RUnlock()
+	before := testutil.ToFloat64(leaseLostTotal)
+	if _, err := e.cli().Revoke(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case k := <-lost:
+		if k != key {
+			t.Fatalf("lost %s, want %s", k, key)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnLeaseLost not called")
+	}
+	if d := testutil.ToFloat64(leaseLostTotal) - before; d != 1 {
+		t.Fatalf("lease lost counter +%v", d)
+	}
+	// the key is re-granted after the callback
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, err := e.get(key); err == nil && v == "v" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key not re-granted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: time.Minute})
+	if err := e.PutAll(context.Background(), map[string]string{"ion://test/revoke/a": "a", "ion://test/revoke/b": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	e.keep("ion://test/revoke/other", "o")
+	if err := e.Revoke("ion://test/revoke/a"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := e.getByPrefix("ion://test/revoke/")
+	if err != nil || len(m) != 1 || m["ion://test/revoke/other"] != "o" {
+		t.Fatalf("keys after Revoke %v, %v", m, err)
+	}
+	e.liveKeyIDLock.RLock()
+	_, tracked := e.liveKeyID["ion://test/revoke/b"]
+	e.liveKeyIDLock.RUnlock()
+	if tracked {
+		t.Fatal("key sharing the revoked lease still kept")
+	}
+	if err := e.Revoke("ion://test/revoke/a"); err != ErrKeyNotFound {
+		t.Fatalf("second Revoke err = %v", err)
+	}
+}
+
+func TestNewLease(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	waitLeases := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for testutil.ToFloat64(leasesGauge) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("leases %v, want %v", testutil.ToFloat64(leasesGauge), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	before := testutil.ToFloat64(leasesGauge)
+	id, err := e.NewLease(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := e.keepOnLease(id, fmt.Sprintf("ion://test/shared/%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// one keepalive covers every key
+	waitLeases(before + 1)
+	if n, err := e.Count("ion://test/shared/"); err != nil || n != 100 {
+		t.Fatalf("count = %d, %v", n, err)
+	}
+	// the lease outlives its keys
+	e.del("ion://test/shared/0")
+	e.keepOnLease(id, "ion://test/shared/0", "again")
+	waitLeases(before + 1)
+
+	if err := e.Revoke("ion://test/shared/7"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := e.Count("ion://test/shared/"); err != nil || n != 0 {
+		t.Fatalf("count after revoke = %d, %v", n, err)
+	}
+	waitLeases(before)
+	if err := e.keepOnLease(id, "ion://test/shared/late", "v"); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("keep on a revoked lease err = %v", err)
+	}
+}
+
+func TestTrackedKeys(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	if err := e.keep("ion://test/tracked/b", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PutAll(context.Background(), map[string]string{"ion://test/tracked/a": "v", "ion://test/tracked/c": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PutStatic("ion://test/tracked/static", "v"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ion://test/tracked/a", "ion://test/tracked/b", "ion://test/tracked/c"}
+	if got := e.TrackedKeys(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("TrackedKeys = %v, want %v", got, want)
+	}
+	leases := e.TrackedLeases()
+	if len(leases) != 3 || leases[want[0]] != leases[want[2]] || leases[want[0]] == leases[want[1]] || leases[want[1]] == 0 {
+		t.Fatalf("TrackedLeases = %v, want PutAll keys on one lease and b on another", leases)
+	}
+	// the copies are the caller's
+	leases[want[0]] = 0
+	if e.TrackedLeases()[want[0]] == 0 {
+		t.Fatal("TrackedLeases shares its map")
+	}
+	e.del(want[1])
+	if got := e.TrackedKeys(); len(got) != 2 {
+		t.Fatalf("TrackedKeys after del = %v", got)
+	}
+}
+
+func TestMoveKey(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	oldKey, newKey := "ion://test/move/old", "ion://test/move/new"
+	if err := e.keep(oldKey, "v"); err != nil {
+		t.Fatal(err)
+	}
+	id := e.TrackedLeases()[oldKey]
+	if err := e.MoveKey(oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	resp, err := e.cli().Get(ctx, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "v" || resp.Kvs[0].Lease != id {
+		t.Fatalf("%s = %v, want v on lease %x", newKey, resp.Kvs, id)
+	}
+	// one revision removed the old key and created the new one
+	rev := resp.Kvs[0].CreateRevision
+	for _, c := range []struct {
+		key  string
+		rev  int64
+		want int
+	}{{oldKey, rev - 1, 1}, {newKey, rev - 1, 0}, {oldKey, rev, 0}, {newKey, rev, 1}} {
+		r, err := e.cli().Get(ctx, c.key, clientv3.WithRev(c.rev))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Kvs) != c.want {
+			t.Fatalf("%s at revision %d has %d keys, want %d", c.key, c.rev, len(r.Kvs), c.want)
+		}
+	}
+	leases := e.TrackedLeases()
+	if _, ok := leases[oldKey]; ok || leases[newKey] != id {
+		t.Fatalf("TrackedLeases = %v, want only %s on %x", leases, newKey, id)
+	}
+	if err := e.MoveKey(oldKey, newKey); err != ErrKeyNotFound {
+		t.Fatalf("moving an untracked key = %v, want ErrKeyNotFound", err)
+	}
+	if err := e.keep(oldKey, "w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.MoveKey(oldKey, newKey); !errors.Is(err, errMoveConflict) {
+		t.Fatalf("moving onto an existing key = %v, want errMoveConflict", err)
+	}
+}
+
+func TestMaxLeases(t *testing.T) {
+	e := newTestEtcd(t, Config{MaxLeases: 3})
+	for i := 0; i < 3; i++ {
+		if err := e.keep(fmt.Sprintf("ion://test/maxleases/%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := e.LeaseCount(); n != 3 {
+		t.Fatalf("LeaseCount = %d, want 3", n)
+	}
+	if err := e.keep("ion://test/maxleases/3", "v"); !errors.Is(err, ErrLeaseLimitExceeded) {
+		t.Fatalf("keep over the limit = %v, want ErrLeaseLimitExceeded", err)
+	}
+	if _, err := e.get("ion://test/maxleases/3"); err != ErrKeyNotFound {
+		t.Fatalf("rejected key written: %v", err)
+	}
+	if _, err := e.NewLease(5 * time.Second); !errors.Is(err, ErrLeaseLimitExceeded) {
+		t.Fatalf("NewLease over the limit = %v, want ErrLeaseLimitExceeded", err)
+	}
+
+	// a key deleted frees its lease once the keepalive stopped
+	if err := e.del("ion://test/maxleases/0"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for e.LeaseCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("LeaseCount = %d after del, want 2", e.LeaseCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := e.keep("ion://test/maxleases/3", "v"); err != nil {
+		t.Fatal(err)
+	}
+}
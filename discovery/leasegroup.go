@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// LeaseGroup assigns keys to named groups, each on a NewLease of its own
+// ttl and keepalive: the keys of a group expire together when this instance
+// dies or the group is revoked, while other groups go on. Putting a key of
+// a group again only changes its value, the lease keeps its cadence.
+type LeaseGroup struct {
+	etcd   *Etcd
+	mu     sync.Mutex
+	groups map[string]clientv3.LeaseID
+}
+
+// NewLeaseGroup returns a LeaseGroup without any group yet
+func (e *Etcd) NewLeaseGroup() *LeaseGroup {
+	return &LeaseGroup{etcd: e, groups: make(map[string]clientv3.LeaseID)}
+}
+
+// Define creates group name on a lease of ttl, it fails if name exists
+func (g *LeaseGroup) Define(name string, ttl time.Duration) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.groups[name]; ok {
+		return fmt.Errorf("lease group %s already defined", name)
+	}
+	id, err := g.etcd.NewLease(ttl)
+	if err != nil {
+		return err
+	}
+	g.groups[name] = id
+	return nil
+}
+
+func (g *LeaseGroup) lease(name string) (clientv3.LeaseID, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id, ok := g.groups[name]
+	if !ok {
+		return 0, fmt.Errorf("no lease group %s", name)
+	}
+	return id, nil
+}
+
+// Put keeps key with value on the lease of group name, moving it there if
+// it was kept on another
+func (g *LeaseGroup) Put(name, key, value string) error {
+	id, err := g.lease(name)
+	if err != nil {
+		return err
+	}
+	return g.etcd.keepOnLease(id, key, value)
+}
+
+// Refresh renews the lease of group name at once, so its keys get their
+// whole ttl again, without touching the other groups
+func (g *LeaseGroup) Refresh(name string) error {
+	id, err := g.lease(name)
+	if err != nil {
+		return err
+	}
+	e := g.etcd
+	e.liveKeyIDLock.RLock()
+	l, ok := e.shared[id]
+	e.liveKeyIDLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: lease group %s", ErrLeaseExpired, name)
+	}
+	ctx, cancel := e.opContext(e.ctx)
+	defer cancel()
+	_, err = e.cli().KeepAliveOnce(ctx, l.id)
+	return etcdError(err)
+}
+
+// Revoke revokes the lease of group name, which deletes every key of the
+// group at once, and forgets the group
+func (g *LeaseGroup) Revoke(name string) error {
+	id, err := g.lease(name)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	delete(g.groups, name)
+	g.mu.Unlock()
+	return g.etcd.revokeShared(id)
+}
+
+// revokeShared revokes the NewLease of handle and stops keeping its keys
+func (e *Etcd) revokeShared(handle clientv3.LeaseID) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	e.liveKeyIDLock.Lock()
+	l, ok := e.shared[handle]
+	if !ok {
+		e.liveKeyIDLock.Unlock()
+		return fmt.Errorf("%w: no shared lease %x", ErrLeaseExpired, handle)
+	}
+	for k := range l.keys {
+		e.dropPending(k)
+		e.untrack(k)
+	}
+	delete(e.shared, handle)
+	l.cancel()
+	e.liveKeyIDLock.Unlock()
+	ctx, cancel := e.opContext(context.Background())
+	defer cancel()
+	_, err = e.cli().Revoke(ctx, l.id)
+	return etcdError(err)
+}
@@ -0,0 +1,104 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseGroup(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	g := e.NewLeaseGroup()
+	if err := g.Define("live", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Define("meta", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Define("live", time.Minute); err == nil {
+		t.Fatal("group defined twice")
+	}
+	if err := g.Put("none", "ion://test/group/x", "v"); err == nil {
+		t.Fatal("put on an undefined group")
+	}
+	for _, k := range []string{"alive", "addr"} {
+		if err := g.Put("live", "ion://test/group/"+k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Put("meta", "ion://test/group/meta", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	leaseOf := func(key string) *lease {
+		e.liveKeyIDLock.RLock()
+		defer e.liveKeyIDLock.RUnlock()
+		return e.liveKeyID[key].lease
+	}
+	live, meta := leaseOf("ion://test/group/alive"), leaseOf("ion://test/group/meta")
+	if live == meta || leaseOf("ion://test/group/addr") != live {
+		t.Fatal("groups do not map to one lease each")
+	}
+
+	// only Refresh renews the leases from here on
+	live.cancel()
+	meta.cancel()
+	time.Sleep(2 * time.Second)
+	if err := g.Put("meta", "ion://test/group/meta", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if leaseOf("ion://test/group/meta") != meta {
+		t.Fatal("updating a key of a group changed its lease")
+	}
+	if err := g.Refresh("meta"); err != nil {
+		t.Fatal(err)
+	}
+	metaTTL, err := e.TimeToLive("ion://test/group/meta")
+	if err != nil || metaTTL < 9*time.Second {
+		t.Fatalf("refreshed group ttl %v, %v", metaTTL, err)
+	}
+	liveTTL, err := e.TimeToLive("ion://test/group/alive")
+	if err != nil || liveTTL > 8*time.Second {
+		t.Fatalf("other group ttl %v, %v, want it left running down", liveTTL, err)
+	}
+
+	if err := g.Revoke("live"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := e.getByPrefix("ion://test/group/")
+	if err != nil || len(m) != 1 || m["ion://test/group/meta"] != "v2" {
+		t.Fatalf("keys after revoking live %v, %v", m, err)
+	}
+	if err := g.Put("live", "ion://test/group/alive", "v"); err == nil {
+		t.Fatal("put on a revoked group")
+	}
+}
+
+func TestLeaseGroupExpiry(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	crashed := newTestEtcd(t, Config{Endpoints: e.cfg.Endpoints})
+	g := crashed.NewLeaseGroup()
+	if err := g.Define("live", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Define("meta", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	g.Put("live", "ion://test/expiry/alive", "v")
+	g.Put("live", "ion://test/expiry/addr", "v")
+	g.Put("meta", "ion://test/expiry/meta", "v")
+	crashed.stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, err := e.getByPrefix("ion://test/expiry/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) == 1 && m["ion://test/expiry/meta"] == "v" {
+			return
+		}
+		if len(m) == 2 || time.Now().After(deadline) {
+			t.Fatalf("keys %v, want the live group to expire together and meta to stay", m)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
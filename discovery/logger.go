@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"sync"
+
+	"github.com/pion/ion/log"
+)
+
+// Logger receives the logs of Etcd, e.g. an adapter to a structured logger
+// adding correlation fields. The default writes to github.com/pion/ion/log.
+type Logger interface {
+	Errorf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+}
+
+// NopLogger discards every log
+var NopLogger Logger = nopLogger{}
+
+type ionLogger struct{}
+
+func (ionLogger) Errorf(format string, v ...interface{}) { log.Errorf(format, v...) }
+func (ionLogger) Infof(format string, v ...interface{})  { log.Infof(format, v...) }
+func (ionLogger) Debugf(format string, v ...interface{}) { log.Debugf(format, v...) }
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+
+// SampledLogger passes every Errorf to l but only the first of every n
+// Infof and Debugf of each format, so a line logged on every keep of a node
+// keeping many keys does not flood the log while a rare one still shows
+func SampledLogger(l Logger, n int) Logger {
+	if n <= 1 {
+		return l
+	}
+	return &sampledLogger{l: l, n: n, seen: make(map[string]int)}
+}
+
+type sampledLogger struct {
+	l Logger
+	n int
+
+	mu   sync.Mutex
+	seen map[string]int
+}
+
+// sample reports whether this occurrence of format is logged
+func (s *sampledLogger) sample(format string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.seen[format]
+	s.seen[format] = (c + 1) % s.n
+	return c == 0
+}
+
+func (s *sampledLogger) Errorf(format string, v ...interface{}) { s.l.Errorf(format, v...) }
+
+func (s *sampledLogger) Infof(format string, v ...interface{}) {
+	if s.sample(format) {
+		s.l.Infof(format, v...)
+	}
+}
+
+func (s *sampledLogger) Debugf(format string, v ...interface{}) {
+	if s.sample(format) {
+		s.l.Debugf(format, v...)
+	}
+}
+
+// log returns the configured logger, or one discarding everything when
+// there is none
+func (e *Etcd) log() Logger {
+	if e == nil || e.cfg.Logger == nil {
+		return NopLogger
+	}
+	return e.cfg.Logger
+}
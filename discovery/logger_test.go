@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type countLogger struct {
+	mu     sync.Mutex
+	errors []string
+	infos  []string
+}
+
+func (l *countLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *countLogger) Infof(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.infos = append(l.infos, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *countLogger) Debugf(format string, v ...interface{}) {}
+
+func TestSampledLogger(t *testing.T) {
+	l := &countLogger{}
+	s := SampledLogger(l, 10)
+	for i := 0; i < 100; i++ {
+		s.Infof("keep %d", i)
+		s.Errorf("failed %d", i)
+	}
+	s.Infof("rare")
+	if len(l.infos) != 11 || l.infos[0] != "keep 0" || l.infos[1] != "keep 10" || l.infos[10] != "rare" {
+		t.Fatalf("infos = %v, want every 10th keep and the rare line", l.infos)
+	}
+	if len(l.errors) != 100 {
+		t.Fatalf("%d errors logged, want 100", len(l.errors))
+	}
+	if SampledLogger(l, 1) != Logger(l) {
+		t.Fatal("sampling 1 in 1 wraps the logger")
+	}
+
+	l = &countLogger{}
+	e := newTestEtcd(t, Config{Logger: l, LogSample: 5})
+	for i := 0; i < 10; i++ {
+		if err := e.keep(fmt.Sprintf("ion://test/sampled/%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keeps := 0
+	l.mu.Lock()
+	for _, s := range l.infos {
+		var key string
+		if _, err := fmt.Sscanf(s, "Etcd.keep %s", &key); err == nil {
+			keeps++
+		}
+	}
+	l.mu.Unlock()
+	if keeps != 2 {
+		t.Fatalf("%d keeps logged, want 2 of 10", keeps)
+	}
+
+	var c Config
+	c.LogSample = -1
+	if err := c.setDefaults(); err == nil {
+		t.Fatal("negative LogSample accepted")
+	}
+}
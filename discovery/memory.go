@@ -0,0 +1,249 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRegistry is an in process Registry for tests. Kept keys expire
+// after ttl unless renewed, renewal runs in the background like an etcd
+// keepalive until StopKeepAlive simulates a hung or dead node.
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	kv       map[string]string
+	deadline map[string]time.Time
+	watchers map[*memoryWatcher]struct{}
+	paused   bool
+	closed   bool
+	quit     chan struct{}
+}
+
+type memoryEvent struct {
+	typ   EventType
+	key   string
+	value string
+}
+
+// memoryWatcher queues events so writers never block on a slow WatchFunc
+type memoryWatcher struct {
+	key    string
+	prefix bool
+	fn     WatchFunc
+	mu     sync.Mutex
+	queue  []memoryEvent
+	notify chan struct{}
+	done   chan struct{}
+}
+
+var (
+	_ Registry        = (*MemoryRegistry)(nil)
+	_ SnapshotWatcher = (*MemoryRegistry)(nil)
+)
+
+// minMemoryTTL keeps the renewal period of ttl/3 above zero, the registry is
+// in process so ttls well below a second are fine for tests
+const minMemoryTTL = time.Millisecond
+
+// NewMemoryRegistry returns an empty MemoryRegistry, a zero ttl never expires keys
+func NewMemoryRegistry(ttl time.Duration) (*MemoryRegistry, error) {
+	if ttl < 0 || (ttl > 0 && ttl < minMemoryTTL) {
+		return nil, fmt.Errorf("memory registry ttl %v is less than %v", ttl, minMemoryTTL)
+	}
+	m := &MemoryRegistry{
+		ttl:      ttl,
+		kv:       make(map[string]string),
+		deadline: make(map[string]time.Time),
+		watchers: make(map[*memoryWatcher]struct{}),
+		quit:     make(chan struct{}),
+	}
+	if ttl > 0 {
+		go m.keepAlive()
+	}
+	return m, nil
+}
+
+func (m *MemoryRegistry) keepAlive() {
+	tick := time.NewTicker(m.ttl / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case now := <-tick.C:
+			m.mu.Lock()
+			for k, d := range m.deadline {
+				if !m.paused {
+					m.deadline[k] = now.Add(m.ttl)
+				} else if now.After(d) {
+					m.remove(k)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// StopKeepAlive stops renewing the kept keys, they expire after ttl
+func (m *MemoryRegistry) StopKeepAlive() {
+	m.mu.Lock()
+	m.paused = true
+	m.mu.Unlock()
+}
+
+func (m *MemoryRegistry) Keep(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("memory registry closed")
+	}
+	if m.ttl > 0 {
+		m.deadline[key] = time.Now().Add(m.ttl)
+	}
+	m.kv[key] = value
+	m.emit(memoryEvent{EventPut, key, value})
+	return nil
+}
+
+func (m *MemoryRegistry) Update(key, value string) error {
+	return m.Keep(key, value)
+}
+
+func (m *MemoryRegistry) Del(key string) error {
+	m.mu.Lock()
+	m.remove(key)
+	m.mu.Unlock()
+	return nil
+}
+
+// remove deletes key and notifies watchers, mu must be held
+func (m *MemoryRegistry) remove(key string) {
+	if _, ok := m.kv[key]; !ok {
+		return
+	}
+	delete(m.kv, key)
+	delete(m.deadline, key)
+	m.emit(memoryEvent{EventDelete, key, ""})
+}
+
+func (m *MemoryRegistry) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.kv[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (m *MemoryRegistry) GetByPrefix(prefix string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := make(map[string]string)
+	for k, v := range m.kv {
+		if strings.HasPrefix(k, prefix) {
+			r[k] = v
+		}
+	}
+	return r, nil
+}
+
+func (m *MemoryRegistry) Watch(key string, prefix bool, fn WatchFunc) (func(), error) {
+	_, cancel, err := m.watch(key, prefix, fn)
+	return cancel, err
+}
+
+// SnapshotWatch reads prefix and starts watching it atomically
+func (m *MemoryRegistry) SnapshotWatch(prefix string, fn WatchFunc) (map[string]string, func(), error) {
+	return m.watch(prefix, true, fn)
+}
+
+func (m *MemoryRegistry) watch(key string, prefix bool, fn WatchFunc) (map[string]string, func(), error) {
+	if fn == nil {
+		return nil, nil, errors.New("watch func is nil")
+	}
+	w := &memoryWatcher{
+		key:    key,
+		prefix: prefix,
+		fn:     fn,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	snapshot := make(map[string]string)
+	m.mu.Lock()
+	for k, v := range m.kv {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			snapshot[k] = v
+		}
+	}
+	m.watchers[w] = struct{}{}
+	m.mu.Unlock()
+	go w.run()
+
+	return snapshot, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.watchers[w]; ok {
+			delete(m.watchers, w)
+			close(w.done)
+		}
+	}, nil
+}
+
+// emit queues ev on every matching watcher, mu must be held
+func (m *MemoryRegistry) emit(ev memoryEvent) {
+	for w := range m.watchers {
+		if w.key == ev.key || (w.prefix && strings.HasPrefix(ev.key, w.key)) {
+			w.push(ev)
+		}
+	}
+}
+
+func (w *memoryWatcher) push(ev memoryEvent) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *memoryWatcher) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.notify:
+		}
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, ev := range queue {
+			w.fn(ev.typ, ev.key, ev.value)
+		}
+	}
+}
+
+// Close drops every kept key and stops all watchers
+func (m *MemoryRegistry) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.quit)
+	for k := range m.kv {
+		delete(m.kv, k)
+	}
+	for w := range m.watchers {
+		delete(m.watchers, w)
+		close(w.done)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMemory(t *testing.T, ttl time.Duration) *MemoryRegistry {
+	m, err := NewMemoryRegistry(ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	fn, ch := collectEvents()
+	cancel, _ := m.Watch("ion://node/", true, fn)
+	defer cancel()
+
+	m.Keep("ion://node/a", "1")
+	m.Keep("ion://room/a", "x")
+	m.Update("ion://node/a", "2")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "1"})
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "2"})
+
+	if v, err := m.Get("ion://node/a"); err != nil || v != "2" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	if _, err := m.Get("ion://node/b"); err != ErrKeyNotFound {
+		t.Fatalf("missing key err = %v", err)
+	}
+	if kv, _ := m.GetByPrefix("ion://node/"); len(kv) != 1 {
+		t.Fatalf("prefix read = %v", kv)
+	}
+	m.Del("ion://node/a")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/a", ""})
+}
+
+func TestMemoryRegistryExpiry(t *testing.T) {
+	m := newTestMemory(t, 150*time.Millisecond)
+	defer m.Close()
+	fn, ch := collectEvents()
+	m.Watch("ion://node/", true, fn)
+	m.Keep("ion://node/a", "1")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "1"})
+
+	time.Sleep(400 * time.Millisecond)
+	if _, err := m.Get("ion://node/a"); err != nil {
+		t.Fatalf("kept key expired while alive: %v", err)
+	}
+	m.StopKeepAlive()
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/a", ""})
+}
+
+func TestMemoryRegistryTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{-time.Second, time.Nanosecond} {
+		if _, err := NewMemoryRegistry(ttl); err == nil {
+			t.Fatalf("NewMemoryRegistry(%v) succeeded", ttl)
+		}
+	}
+}
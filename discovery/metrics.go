@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are shared by every Registry backend, so they report under the
+// same names whichever one is in use
+var (
+	opTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "operations_total",
+		Help:      "Discovery operations by op and result.",
+	}, []string{"op", "result"})
+	opDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of discovery operations by op.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"op"})
+	keepAliveTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "keepalive_total",
+		Help:      "Lease renewals by result.",
+	}, []string{"result"})
+	leasesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "leases",
+		Help:      "Leases currently kept alive.",
+	})
+	leaseLostTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "lease_lost_keys_total",
+		Help:      "Kept keys whose lease stopped renewing unexpectedly.",
+	})
+	eventLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "watch_event_lag_seconds",
+		Help:      "Time from receiving a watch event to handing it to its WatchFunc, by watch id.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"watch"})
+	repairTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "repaired_keys_total",
+		Help:      "Kept keys put again after being found missing or changed.",
+	})
+	serviceNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "service_nodes",
+		Help:      "Nodes registered per service, as seen by WatchServices.",
+	}, []string{"service"})
+	adaptiveTTLGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "adaptive_ttl_seconds",
+		Help:      "TTL granted to new leases with MinGrantTTL and MaxGrantTTL.",
+	})
+	droppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "subscribe_dropped_events_total",
+		Help:      "Events a full Subscribe buffer dropped, by watch id.",
+	}, []string{"watch"})
+	valueSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "value_size_bytes",
+		Help:      "Size of the values written by keep, update and PutStatic, after compression.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	})
+	largeValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "large_values_total",
+		Help:      "Values over ValueWarnSize by result, warned or rejected over MaxValueSize.",
+	}, []string{"result"})
+	reconnectTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ion",
+		Subsystem: "discovery",
+		Name:      "reconnects_total",
+		Help:      "Reconnects to the discovery backend.",
+	})
+)
+
+const (
+	opGet    = "get"
+	opPut    = "put"
+	opDelete = "delete"
+	opWatch  = "watch"
+)
+
+// RegisterMetrics registers the discovery metrics on reg, they are collected
+// whether registered or not
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{opTotal, opDuration, keepAliveTotal, leasesGauge, leaseLostTotal, eventLag, repairTotal, serviceNodes, adaptiveTTLGauge, droppedEvents, valueSize, largeValues, reconnectTotal} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observe records one op started at start, deferred with a pointer to the
+// op's error. A missing key is not an error.
+func observe(op string, start time.Time, err *error) {
+	result := "ok"
+	if *err != nil && !errors.Is(*err, ErrKeyNotFound) {
+		result = "error"
+	}
+	opTotal.WithLabelValues(op, result).Inc()
+	opDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func observeKeepAlive(ok bool) {
+	if ok {
+		keepAliveTotal.WithLabelValues("ok").Inc()
+	} else {
+		keepAliveTotal.WithLabelValues("error").Inc()
+	}
+}
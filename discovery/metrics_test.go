@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if err := RegisterMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEtcd(t, Config{})
+	puts := testutil.ToFloat64(opTotal.WithLabelValues(opPut, "ok"))
+	gets := testutil.ToFloat64(opTotal.WithLabelValues(opGet, "ok"))
+	leases := testutil.ToFloat64(leasesGauge)
+
+	e.keep("ion://test/metrics/a", "1")
+	e.get("ion://test/metrics/a")
+	e.get("ion://test/metrics/missing")
+
+	if d := testutil.ToFloat64(opTotal.WithLabelValues(opPut, "ok")) - puts; d != 1 {
+		t.Fatalf("put count +%v, want 1", d)
+	}
+	if d := testutil.ToFloat64(opTotal.WithLabelValues(opGet, "ok")) - gets; d != 2 {
+		t.Fatalf("get count +%v, want 2", d)
+	}
+	if d := testutil.ToFloat64(leasesGauge) - leases; d != 1 {
+		t.Fatalf("leases +%v, want 1", d)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, n := range []string{"ion_discovery_operations_total", "ion_discovery_operation_duration_seconds", "ion_discovery_leases"} {
+		if !names[n] {
+			t.Fatalf("%s not gathered, got %v", n, names)
+		}
+	}
+}
+
+func TestObserveWrappedNotFound(t *testing.T) {
+	ok := testutil.ToFloat64(opTotal.WithLabelValues(opGet, "ok"))
+	err := fmt.Errorf("get ion://test/metrics/missing: %w", ErrKeyNotFound)
+	observe(opGet, time.Now(), &err)
+	if d := testutil.ToFloat64(opTotal.WithLabelValues(opGet, "ok")) - ok; d != 1 {
+		t.Fatalf("ok count +%v, want 1", d)
+	}
+}
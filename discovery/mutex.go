@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+// Mutex is a lock shared by every instance using the same name. It is held
+// through a session lease, so a lock whose holder dies is released once the
+// lease TTL expires.
+type Mutex struct {
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+}
+
+// NewMutex returns the lock name, its session lease lives ttl after the
+// holder stops renewing it, GrantTTL when ttl is zero
+func (e *Etcd) NewMutex(name string, ttl time.Duration) (*Mutex, error) {
+	if ttl == 0 {
+		ttl = time.Duration(e.grantTTL()) * time.Second
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("mutex %s ttl %v is less than 1s", name, ttl)
+	}
+	s, err := concurrency.NewSession(e.cli(), concurrency.WithTTL(int(ttl/time.Second)))
+	if err != nil {
+		e.log().Errorf("Etcd.NewMutex %s %v", name, err)
+		return nil, etcdError(err)
+	}
+	return &Mutex{session: s, mutex: concurrency.NewMutex(s, name)}, nil
+}
+
+// Lock blocks until the lock is acquired or ctx is canceled
+func (m *Mutex) Lock(ctx context.Context) error {
+	return m.mutex.Lock(ctx)
+}
+
+func (m *Mutex) Unlock(ctx context.Context) error {
+	return m.mutex.Unlock(ctx)
+}
+
+// Close revokes the session, releasing the lock if it is held
+func (m *Mutex) Close() error {
+	return m.session.Close()
+}
+
+// onceKey is where RunOnce keeps the lock and completion marker of name
+func onceKey(name, part string) string {
+	return Join("once", name, part).String()
+}
+
+// RunOnce runs fn on exactly one of the instances calling it with name,
+// e.g. a migration of keys to a new layout by the first node up. It holds
+// the Mutex of name while fn runs and writes a completion marker without a
+// lease once fn succeeds, calls after that return nil without running fn.
+// If fn fails no marker is written and the next caller runs it again. The
+// marker is only written while the lock is still held, so fn running past
+// the lock TTL may run a second time elsewhere.
+func (e *Etcd) RunOnce(name string, fn func() error) error {
+	marker := onceKey(name, "done")
+	if _, err := e.get(marker); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	m, err := e.NewMutex(onceKey(name, "lock"), 0)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if err := m.Lock(e.ctx); err != nil {
+		return etcdError(err)
+	}
+	if _, err := e.get(marker); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	if err := fn(); err != nil {
+		e.log().Errorf("Etcd.RunOnce %s %v", name, err)
+		return err
+	}
+	ctx, cancel := e.opContext(e.ctx)
+	defer cancel()
+	resp, err := e.cli().Txn(ctx).
+		If(m.mutex.IsOwner()).
+		Then(clientv3.OpPut(marker, time.Now().UTC().Format(time.RFC3339))).
+		Commit()
+	if err != nil {
+		return etcdError(err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%s lost its lock before completing, it may run again", name)
+	}
+	e.log().Infof("Etcd.RunOnce %s done", name)
+	return nil
+}
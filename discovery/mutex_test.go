@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMutex(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	e := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	key := "ion://test/mutex/counter"
+	if _, err := e.cli().Put(context.Background(), key, "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, rounds = 4, 5
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		other := newTestEtcd(t, Config{Endpoints: []string{ep}})
+		m, err := other.NewMutex("ion://test/mutex/lock", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				if err := m.Lock(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+				v, _ := other.get(key)
+				n, _ := strconv.Atoi(v)
+				time.Sleep(5 * time.Millisecond)
+				other.cli().Put(ctx, key, strconv.Itoa(n+1))
+				if err := m.Unlock(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := e.get(key); v != strconv.Itoa(workers*rounds) {
+		t.Fatalf("counter = %s, want %d", v, workers*rounds)
+	}
+}
+
+func TestNewMutexTTL(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	for _, ttl := range []time.Duration{-time.Second, 500 * time.Millisecond} {
+		if m, err := e.NewMutex("ion://test/mutex/ttl", ttl); err == nil {
+			m.Close()
+			t.Fatalf("ttl %v accepted", ttl)
+		}
+	}
+}
+
+func TestMutexHolderDies(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	holder := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	waiter := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	m1, err := holder.NewMutex("ion://test/mutex/dead", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the holder stops renewing its session without unlocking
+	holder.cli().Close()
+
+	m2, err := waiter.NewMutex("ion://test/mutex/dead", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m2.Lock(ctx); err != nil {
+		t.Fatalf("lock of a dead holder not released: %v", err)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	first := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	failed := errors.New("migration failed")
+	if err := first.RunOnce("migrate", func() error { return failed }); err != failed {
+		t.Fatalf("failing RunOnce err = %v", err)
+	}
+	if _, err := first.get(onceKey("migrate", "done")); err != ErrKeyNotFound {
+		t.Fatalf("marker after a failure err = %v", err)
+	}
+
+	var runs int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		e := newTestEtcd(t, Config{Endpoints: []string{ep}})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := e.RunOnce("migrate", func() error {
+				atomic.AddInt32(&runs, 1)
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runs != 1 {
+		t.Fatalf("fn ran %d times", runs)
+	}
+	if err := first.RunOnce("migrate", func() error { runs++; return nil }); err != nil || runs != 1 {
+		t.Fatalf("RunOnce after completion = %v, runs %d", err, runs)
+	}
+}
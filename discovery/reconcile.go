@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// reconcile runs repair every ReconcileInterval until close
+func (e *Etcd) reconcile() {
+	defer e.keepers.Done()
+	ticker := time.NewTicker(e.cfg.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if e.writable() != nil {
+			// on a read only secondary, the keys are re-put on failing back
+			continue
+		}
+		if n, err := e.repair(); err != nil {
+			e.log().Errorf("Etcd.reconcile %v", err)
+		} else if n > 0 {
+			e.log().Infof("Etcd.reconcile repaired %d keys", n)
+		}
+	}
+}
+
+// repair reads every kept key back and puts those that are missing or
+// differ from what this instance kept on a fresh lease, it returns how many
+// it put
+func (e *Etcd) repair() (int, error) {
+	type keptKey struct {
+		lk    *liveKey
+		value string
+		id    clientv3.LeaseID
+		ttl   int64
+	}
+	e.liveKeyIDLock.RLock()
+	kept := make(map[string]keptKey, len(e.liveKeyID))
+	keys := make([]string, 0, len(e.liveKeyID))
+	for k, lk := range e.liveKeyID {
+		kept[k] = keptKey{lk, lk.value, lk.lease.id, lk.lease.ttl}
+		keys = append(keys, k)
+	}
+	e.liveKeyIDLock.RUnlock()
+
+	intact := make(map[string]bool, len(keys))
+	err := e.getManyFunc(keys, func(kv *mvccpb.KeyValue) {
+		want := kept[string(kv.Key)]
+		intact[string(kv.Key)] = decodeValue(kv.Value) == want.value && clientv3.LeaseID(kv.Lease) == want.id
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		if intact[k] {
+			continue
+		}
+		want := kept[k]
+		e.liveKeyIDLock.RLock()
+		lk := e.liveKeyID[k]
+		changed := lk != want.lk || lk.value != want.value || lk.lease.id != want.id
+		e.liveKeyIDLock.RUnlock()
+		if changed {
+			// deleted or put again meanwhile
+			continue
+		}
+		e.log().Errorf("Etcd.reconcile %s missing or changed, putting it again", k)
+		if err := e.keepWithTTLCtx(context.Background(), k, want.value, want.ttl); err != nil {
+			return n, err
+		}
+		repairTotal.Inc()
+		n++
+	}
+	return n, nil
+}
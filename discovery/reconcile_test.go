@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReconcile(t *testing.T) {
+	interval := 200 * time.Millisecond
+	e := newTestEtcd(t, Config{ReconcileInterval: interval})
+	e.keep("ion://test/reconcile/a", "a")
+	e.keep("ion://test/reconcile/b", "b")
+	e.keep("ion://test/reconcile/gone", "g")
+	repairs := testutil.ToFloat64(repairTotal)
+
+	cli := e.cli()
+	cli.Delete(context.Background(), "ion://test/reconcile/a")
+	cli.Put(context.Background(), "ion://test/reconcile/b", "overwritten")
+	e.del("ion://test/reconcile/gone")
+
+	deadline := time.Now().Add(interval + 150*time.Millisecond)
+	for {
+		a, _ := e.get("ion://test/reconcile/a")
+		b, _ := e.get("ion://test/reconcile/b")
+		if a == "a" && b == "b" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not repaired within one interval: a=%q b=%q", a, b)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if d := testutil.ToFloat64(repairTotal) - repairs; d != 2 {
+		t.Fatalf("repairs +%v, want 2", d)
+	}
+	// the restored key is kept again, on a lease of its own
+	if _, err := e.TimeToLive("ion://test/reconcile/a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(interval)
+	if _, err := e.get("ion://test/reconcile/gone"); err != ErrKeyNotFound {
+		t.Fatalf("deleted key came back: %v", err)
+	}
+}
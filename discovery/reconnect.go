@@ -0,0 +1,249 @@
+package discovery
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	defaultHealthCheckInterval = time.Second * 5
+	defaultReconnectBackoff    = time.Millisecond * 500
+	defaultReconnectMaxBackoff = time.Second * 30
+)
+
+// monitor probes every configured endpoint each HealthCheckInterval. The
+// client is narrowed to the endpoints that answered, so requests stop going
+// to a degraded member until it recovers, and rebuilt once none answers.
+func (e *Etcd) monitor() {
+	defer e.keepers.Done()
+	discovered := time.Now()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(e.cfg.HealthCheckInterval):
+		}
+		if e.cfg.DiscoverySRV != "" && e.cfg.DiscoveryInterval > 0 && time.Since(discovered) >= e.cfg.DiscoveryInterval {
+			e.rediscover()
+			discovered = time.Now()
+		}
+		cli := e.cli()
+		if e.OnSecondary() && e.cfg.FailBack && e.failBack(cli) {
+			continue
+		}
+		healthy := e.probe(cli)
+		if len(healthy) == 0 {
+			e.log().Errorf("Etcd.monitor no endpoint of %v is reachable", e.activeEndpoints())
+			e.reconnect()
+			continue
+		}
+		if !equalStrings(healthy, e.HealthyEndpoints()) {
+			e.log().Infof("Etcd.monitor healthy endpoints %v", healthy)
+			cli.SetEndpoints(healthy...)
+			e.setHealthy(healthy)
+		}
+	}
+}
+
+// probe returns the configured endpoints answering a Status request, in
+// configuration order
+func (e *Etcd) probe(cli *clientv3.Client) []string {
+	return e.probeEndpoints(cli, e.activeEndpoints())
+}
+
+func (e *Etcd) probeEndpoints(cli *clientv3.Client, endpoints []string) []string {
+	ok := make([]bool, len(endpoints))
+	var wg sync.WaitGroup
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func(i int, ep string) {
+			defer wg.Done()
+			ctx, cancel := e.opContext(e.ctx)
+			_, err := cli.Status(ctx, ep)
+			cancel()
+			ok[i] = err == nil
+		}(i, ep)
+	}
+	wg.Wait()
+	var healthy []string
+	for i, ep := range endpoints {
+		if ok[i] {
+			healthy = append(healthy, ep)
+		}
+	}
+	return healthy
+}
+
+// HealthyEndpoints returns the endpoints the client currently uses, those
+// that answered the last probe
+func (e *Etcd) HealthyEndpoints() []string {
+	e.healthyLock.RLock()
+	defer e.healthyLock.RUnlock()
+	return append([]string(nil), e.healthyEndpoints...)
+}
+
+func (e *Etcd) setHealthy(endpoints []string) {
+	e.healthyLock.Lock()
+	e.healthyEndpoints = endpoints
+	e.healthyLock.Unlock()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// healthy reports whether at least one endpoint answers a Status request
+func (e *Etcd) healthy(cli *clientv3.Client) bool {
+	for _, ep := range cli.Endpoints() {
+		ctx, cancel := e.opContext(e.ctx)
+		_, err := cli.Status(ctx, ep)
+		cancel()
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnect dials a new client with exponential backoff until it is healthy,
+// then swaps it in and re-puts every kept key on fresh leases. Once the
+// backoff reached ReconnectMaxBackoff each attempt on the primary endpoints
+// is followed by one on SecondaryEndpoints.
+func (e *Etcd) reconnect() {
+	e.healthyLock.Lock()
+	e.reconnecting = true
+	e.healthyLock.Unlock()
+	backoff := e.cfg.ReconnectBackoff
+	for {
+		cli, err := dial(e.cfg)
+		if err == nil && e.healthy(cli) {
+			e.swapClient(cli, false)
+			break
+		}
+		if err == nil {
+			cli.Close()
+		}
+		if backoff >= e.cfg.ReconnectMaxBackoff && e.failOver() {
+			break
+		}
+		e.log().Errorf("Etcd.reconnect retry in %v err=%v", backoff, err)
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > e.cfg.ReconnectMaxBackoff {
+			backoff = e.cfg.ReconnectMaxBackoff
+		}
+	}
+	e.log().Infof("Etcd.reconnect connected to %v", e.activeEndpoints())
+	if e.cfg.OnReconnect != nil {
+		e.cfg.OnReconnect()
+	}
+}
+
+// swapClient replaces the client with cli, on SecondaryEndpoints when
+// secondary is set. The kept keys are re-put on cli unless it is a read only
+// secondary, they stay tracked to be re-put on failing back. A re-put that
+// fails is retried every second. Claims keep their lease, which is renewed
+// on cli.
+func (e *Etcd) swapClient(cli *clientv3.Client, secondary bool) {
+	groups := e.stopKeepAlives()
+
+	reconnectTotal.Inc()
+	e.clientLock.Lock()
+	old := e.client
+	e.client = cli
+	if e.secondary != secondary {
+		e.switches++
+	}
+	e.secondary = secondary
+	e.clientLock.Unlock()
+	e.healthyLock.Lock()
+	e.healthyEndpoints = cli.Endpoints()
+	e.reconnecting = false
+	e.lastReconnect = time.Now()
+	e.healthyLock.Unlock()
+	old.Close()
+	readOnly := secondary && e.cfg.SecondaryReadOnly
+	e.resumeClaims(readOnly)
+	if readOnly {
+		return
+	}
+
+	for l, kv := range groups {
+		if err := e.regrant(e.ctx, l, kv); err != nil {
+			// nothing renews the old lease any more, keep trying like a
+			// lost keepalive does
+			e.log().Errorf("Etcd.reconnect re-put %d keys %v", len(kv), err)
+			e.keepers.Add(1)
+			go func(l *lease) {
+				defer e.keepers.Done()
+				e.regrantLoop(e.ctx, l, time.Second)
+			}(l)
+		}
+	}
+}
+
+// stopKeepAlives stops the keepalives of the old client before it closes
+// their channels, otherwise they would race to regrant on their own, and
+// frees their room at once so the re-grants fit under MaxLeases. It returns
+// the kept keys by lease, with an empty group for a shared lease.
+func (e *Etcd) stopKeepAlives() map[*lease]map[string]string {
+	groups := make(map[*lease]map[string]string)
+	e.liveKeyIDLock.Lock()
+	defer e.liveKeyIDLock.Unlock()
+	for k, lk := range e.liveKeyID {
+		if groups[lk.lease] == nil {
+			groups[lk.lease] = make(map[string]string)
+			lk.lease.cancel()
+			e.releaseRoom(lk.lease.room)
+		}
+		groups[lk.lease][k] = lk.value
+	}
+	for _, l := range e.shared {
+		if groups[l] == nil {
+			groups[l] = make(map[string]string)
+			l.cancel()
+			e.releaseRoom(l.room)
+		}
+	}
+	for _, l := range e.claims {
+		l.cancel()
+		e.releaseRoom(l.room)
+	}
+	return groups
+}
+
+// resumeClaims renews the claim leases on the new client. A claim is not
+// granted again, so one on a read only secondary or whose keepalive fails
+// to start is dropped as lost, like one the new client no longer knows is
+// once its keepalive channel closes.
+func (e *Etcd) resumeClaims(readOnly bool) {
+	e.liveKeyIDLock.Lock()
+	defer e.liveKeyIDLock.Unlock()
+	for id, l := range e.claims {
+		if !readOnly {
+			atomic.AddInt64(&e.leaseCount, 1)
+			err := e.startKeepAlive(l)
+			if err == nil {
+				continue
+			}
+			atomic.AddInt64(&e.leaseCount, -1)
+			e.log().Errorf("Etcd.reconnect claim lease=%x %v", id, err)
+		}
+		delete(e.claims, id)
+	}
+}
@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+func TestReconnect(t *testing.T) {
+	srv, ep := startEtcd(t, nil)
+	reconnected := make(chan struct{}, 1)
+	e := newTestEtcd(t, Config{
+		Endpoints:           []string{ep},
+		OperationTimeout:    300 * time.Millisecond,
+		HealthCheckInterval: 100 * time.Millisecond,
+		ReconnectBackoff:    50 * time.Millisecond,
+		ReconnectMaxBackoff: 200 * time.Millisecond,
+		OnReconnect:         func() { reconnected <- struct{}{} },
+	})
+	key := "ion://test/reconnect"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	before := e.liveKeyID[key].lease.id
+	e.liveKeyIDLock.RUnlock()
+
+	fn, events := collectEvents()
+	if _, err := e.Watch("ion://test/reconnect/", true, fn); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := srv.Config()
+	srv.Close()
+	time.Sleep(time.Second)
+	restarted, err := embed.StartEtcd(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restarted.Close)
+
+	select {
+	case <-reconnected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	e.liveKeyIDLock.RLock()
+	after := e.liveKeyID[key].lease.id
+	e.liveKeyIDLock.RUnlock()
+	if after == before {
+		t.Fatal("key was not re-granted on reconnect")
+	}
+	if v, err := e.get(key); err != nil || v != "v" {
+		t.Fatalf("get after reconnect = %q, %v", v, err)
+	}
+
+	// the watch resumes on the new client
+	e.keep("ion://test/reconnect/after", "1")
+	expectEvent(t, events, watchEvent{EventPut, "ion://test/reconnect/after", "1"})
+}
+
+func TestHealthyEndpoints(t *testing.T) {
+	_, good := startEtcd(t, nil)
+	srv, flaky := startEtcd(t, nil)
+	e := newTestEtcd(t, Config{
+		Endpoints:           []string{good, flaky},
+		OperationTimeout:    300 * time.Millisecond,
+		HealthCheckInterval: 100 * time.Millisecond,
+	})
+	waitEndpoints := func(want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !equalStrings(e.HealthyEndpoints(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("healthy endpoints %v, want %v", e.HealthyEndpoints(), want)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitEndpoints(good, flaky)
+
+	cfg := srv.Config()
+	srv.Close()
+	waitEndpoints(good)
+	if got := e.cli().Endpoints(); !equalStrings(got, []string{good}) {
+		t.Fatalf("client endpoints %v", got)
+	}
+	if _, err := e.get("ion://test/endpoints"); err != ErrKeyNotFound {
+		t.Fatalf("get with one endpoint down err = %v", err)
+	}
+
+	restarted, err := embed.StartEtcd(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(restarted.Close)
+	waitEndpoints(good, flaky)
+}
+
+func TestSwapClientRegrantRetry(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: time.Second, MaxLeases: 1})
+	key := "ion://test/swap/retry"
+	if err := e.keep(key, "v"); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	before := e.liveKeyID[key].lease
+	e.liveKeyIDLock.RUnlock()
+
+	// the re-put on the new client fails while the lease limit is taken
+	atomic.AddInt64(&e.leaseCount, 1)
+	cli, err := dial(e.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.swapClient(cli, false)
+	e.liveKeyIDLock.RLock()
+	still := e.liveKeyID[key].lease == before
+	e.liveKeyIDLock.RUnlock()
+	if !still {
+		t.Fatal("key re-put over the lease limit")
+	}
+	atomic.AddInt64(&e.leaseCount, -1)
+
+	// and is retried once there is room, before the old lease expires
+	time.Sleep(3 * time.Second)
+	e.liveKeyIDLock.RLock()
+	lk := e.liveKeyID[key]
+	e.liveKeyIDLock.RUnlock()
+	if lk == nil || lk.lease == before {
+		t.Fatal("key not re-granted after the failed re-put")
+	}
+	if v, err := e.get(key); err != nil || v != "v" {
+		t.Fatalf("get after the retry = %q, %v", v, err)
+	}
+}
+
+func TestSwapClientAtMaxLeases(t *testing.T) {
+	e := newTestEtcd(t, Config{MaxLeases: 2})
+	keys := []string{"ion://test/swap/max/a", "ion://test/swap/max/b"}
+	before := make(map[string]*lease)
+	for _, k := range keys {
+		if err := e.keep(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+		e.liveKeyIDLock.RLock()
+		before[k] = e.liveKeyID[k].lease
+		e.liveKeyIDLock.RUnlock()
+	}
+	if n := e.LeaseCount(); n != 2 {
+		t.Fatalf("lease count %d, want 2", n)
+	}
+	cli, err := dial(e.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old leases free their room before the re-put, not after
+	e.swapClient(cli, false)
+	for _, k := range keys {
+		e.liveKeyIDLock.RLock()
+		l := e.liveKeyID[k].lease
+		e.liveKeyIDLock.RUnlock()
+		if l == before[k] {
+			t.Fatalf("%s not re-granted at the lease limit", k)
+		}
+	}
+	// and the old keepalives exiting do not free it a second time
+	time.Sleep(500 * time.Millisecond)
+	if n := e.LeaseCount(); n != 2 {
+		t.Fatalf("lease count after the swap %d, want 2", n)
+	}
+	// stopping frees the room without waiting for the keepalives to exit
+	e.stopKeepAlives()
+	if n := e.LeaseCount(); n != 0 {
+		t.Fatalf("lease count right after stopping %d, want 0", n)
+	}
+}
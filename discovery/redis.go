@@ -0,0 +1,281 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/pion/ion/log"
+)
+
+const (
+	defaultRedisTTL = defaultGrantTimeout * time.Second
+	redisScanCount  = 100
+)
+
+// ErrKeyspaceNotifications is returned by NewRedis when the server does not
+// publish the keyspace events Watch relies on
+var ErrKeyspaceNotifications = errors.New("redis keyspace notifications disabled, set notify-keyspace-events to at least Kg$x")
+
+// RedisConfig configures a Redis backed Registry
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	// TTL of kept keys, refreshed at a third of it, default 5s, at least 1s
+	TTL time.Duration
+}
+
+// Redis is a Registry for small deployments that already run redis. Kept
+// keys are SET with an expiry that a background goroutine refreshes like an
+// etcd keepalive. Watch is built on keyspace notifications, which are off
+// by default and must be enabled server side, e.g. with
+// CONFIG SET notify-keyspace-events Kg$x
+type Redis struct {
+	client *redis.Client
+	db     int
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	kept map[string]string
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ Registry = (*Redis)(nil)
+
+func NewRedis(cfg RedisConfig) (*Redis, error) {
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultRedisTTL
+	}
+	if cfg.TTL < time.Second {
+		return nil, fmt.Errorf("redis ttl %v is less than 1s", cfg.TTL)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	res, err := client.ConfigGet("notify-keyspace-events").Result()
+	if err != nil {
+		client.Close()
+		log.Errorf("NewRedis err=%v", err)
+		return nil, err
+	}
+	var flags string
+	if len(res) == 2 {
+		flags, _ = res[1].(string)
+	}
+	if !keyspaceEventsEnabled(flags) {
+		client.Close()
+		return nil, fmt.Errorf("%w (got %q)", ErrKeyspaceNotifications, flags)
+	}
+	return newRedis(client, cfg), nil
+}
+
+// newRedis starts the refresher on a client that passed the keyspace check
+func newRedis(client *redis.Client, cfg RedisConfig) *Redis {
+	r := &Redis{
+		client: client,
+		db:     cfg.DB,
+		ttl:    cfg.TTL,
+		kept:   make(map[string]string),
+		quit:   make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.refresh()
+	return r
+}
+
+// keyspaceEventsEnabled reports whether flags publish keyspace events for
+// string sets, generic deletes and expiries
+func keyspaceEventsEnabled(flags string) bool {
+	if !strings.Contains(flags, "K") {
+		return false
+	}
+	if strings.Contains(flags, "A") {
+		return true
+	}
+	return strings.Contains(flags, "g") && strings.Contains(flags, "$") && strings.Contains(flags, "x")
+}
+
+// refresh pushes the expiry of every kept key forward, a key that vanished
+// in between, e.g. after a server restart or failover, is set again
+func (r *Redis) refresh() {
+	defer r.wg.Done()
+	tick := time.NewTicker(r.ttl / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-tick.C:
+		}
+		r.mu.Lock()
+		keys := make([]string, 0, len(r.kept))
+		for k := range r.kept {
+			keys = append(keys, k)
+		}
+		r.mu.Unlock()
+		for _, k := range keys {
+			ok, err := r.client.Expire(k, r.ttl).Result()
+			if err != nil {
+				log.Errorf("Redis.refresh %s %v", k, err)
+				continue
+			}
+			if !ok {
+				r.restore(k)
+			}
+		}
+	}
+}
+
+// restore sets a kept key that is gone from the server again, holding mu so
+// a concurrent Del does not race it back in
+func (r *Redis) restore(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.kept[key]
+	if !ok {
+		return
+	}
+	log.Infof("Redis.refresh %s vanished, setting it again", key)
+	if err := r.client.Set(key, value, r.ttl).Err(); err != nil {
+		log.Errorf("Redis.refresh %s %v", key, err)
+	}
+}
+
+func (r *Redis) Keep(key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err = r.client.Set(key, value, r.ttl).Err(); err != nil {
+		log.Errorf("Redis.Keep %s %v", key, err)
+		return err
+	}
+	r.mu.Lock()
+	r.kept[key] = value
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Redis) Update(key, value string) error {
+	return r.Keep(key, value)
+}
+
+func (r *Redis) Del(key string) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	r.mu.Lock()
+	delete(r.kept, key)
+	r.mu.Unlock()
+	return r.client.Del(key).Err()
+}
+
+func (r *Redis) Get(key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	v, err = r.client.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	}
+	return v, err
+}
+
+// GetByPrefix walks the keyspace with SCAN, it is not a point in time snapshot
+func (r *Redis) GetByPrefix(prefix string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	m = make(map[string]string)
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, escapeGlob(prefix)+"*", redisScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			v, err := r.client.Get(k).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+		}
+		if next == 0 {
+			return m, nil
+		}
+		cursor = next
+	}
+}
+
+func (r *Redis) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	channel := fmt.Sprintf("__keyspace@%d__:", r.db)
+	var sub *redis.PubSub
+	if prefix {
+		sub = r.client.PSubscribe(channel + escapeGlob(key) + "*")
+	} else {
+		sub = r.client.Subscribe(channel + key)
+	}
+	// wait for the subscription to be confirmed so no event is missed
+	if _, err := sub.Receive(); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for msg := range sub.Channel() {
+			k := strings.TrimPrefix(msg.Channel, channel)
+			switch msg.Payload {
+			case "set":
+				v, err := r.client.Get(k).Result()
+				if err == nil {
+					fn(EventPut, k, v)
+				}
+			case "del", "expired", "evicted":
+				fn(EventDelete, k, "")
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { sub.Close() }) }, nil
+}
+
+// escapeGlob quotes the characters SCAN and PSUBSCRIBE treat as patterns
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Close deletes every kept key and closes the client, open watches are
+// closed with it
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	keys := make([]string, 0, len(r.kept))
+	for k := range r.kept {
+		keys = append(keys, k)
+	}
+	r.kept = make(map[string]string)
+	r.mu.Unlock()
+	close(r.quit)
+	var err error
+	if len(keys) > 0 {
+		err = r.client.Del(keys...).Err()
+	}
+	if cerr := r.client.Close(); err == nil {
+		err = cerr
+	}
+	r.wg.Wait()
+	return err
+}
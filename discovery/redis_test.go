@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestKeyspaceEventsEnabled(t *testing.T) {
+	cases := map[string]bool{
+		"":     false,
+		"KEA":  true,
+		"Kg$x": true,
+		"Eg$x": false,
+		"Kg$":  false,
+	}
+	for flags, want := range cases {
+		if got := keyspaceEventsEnabled(flags); got != want {
+			t.Errorf("keyspaceEventsEnabled(%q) = %v, want %v", flags, got, want)
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got := escapeGlob("ion://node/[a]*?"); got != `ion://node/\[a\]\*\?` {
+		t.Fatalf("escapeGlob = %s", got)
+	}
+}
+
+func TestNewRedisTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{-time.Second, time.Nanosecond, 500 * time.Millisecond} {
+		// rejected before dialing the unreachable address
+		if _, err := NewRedis(RedisConfig{Addr: "127.0.0.1:0", TTL: ttl}); err == nil || !strings.Contains(err.Error(), "ttl") {
+			t.Fatalf("NewRedis ttl %v err = %v", ttl, err)
+		}
+	}
+}
+
+// newTestRedis runs a Redis registry against miniredis, which has no CONFIG
+// command, so the keyspace check of NewRedis is skipped
+func newTestRedis(t *testing.T, ttl time.Duration) (*Redis, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	return newRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), RedisConfig{TTL: ttl}), mr
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisKeep(t *testing.T) {
+	ttl := 300 * time.Millisecond
+	r, mr := newTestRedis(t, ttl)
+	if err := r.Keep("ion://node/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.TTL("ion://node/a"); got != ttl {
+		t.Fatalf("ttl = %v, want %v", got, ttl)
+	}
+	if v, err := r.Get("ion://node/a"); err != nil || v != "1" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	if _, err := r.Get("ion://node/b"); err != ErrKeyNotFound {
+		t.Fatalf("missing key err = %v", err)
+	}
+	r.Keep("ion://room/a", "x")
+	if kv, err := r.GetByPrefix("ion://node/"); err != nil || len(kv) != 1 || kv["ion://node/a"] != "1" {
+		t.Fatalf("prefix read = %v, %v", kv, err)
+	}
+
+	mr.FastForward(ttl / 2)
+	waitFor(t, "refresh", func() bool { return mr.TTL("ion://node/a") == ttl })
+
+	r.Close()
+	if mr.Exists("ion://node/a") || mr.Exists("ion://room/a") {
+		t.Fatal("kept keys survived Close")
+	}
+}
+
+func TestRedisExpiry(t *testing.T) {
+	ttl := 300 * time.Millisecond
+	r, mr := newTestRedis(t, ttl)
+	defer r.Close()
+	r.Keep("ion://node/a", "1")
+	r.Keep("ion://node/b", "2")
+	if err := r.Del("ion://node/b"); err != nil {
+		t.Fatal(err)
+	}
+	r.client.Set("ion://node/b", "2", ttl)
+
+	// both keys expire, only the kept one is set again
+	mr.FastForward(ttl)
+	if mr.Exists("ion://node/a") || mr.Exists("ion://node/b") {
+		t.Fatal("keys did not expire")
+	}
+	waitFor(t, "vanished key to be set again", func() bool {
+		v, err := mr.Get("ion://node/a")
+		return err == nil && v == "1"
+	})
+	if got := mr.TTL("ion://node/a"); got != ttl {
+		t.Fatalf("restored ttl = %v, want %v", got, ttl)
+	}
+	time.Sleep(ttl)
+	if mr.Exists("ion://node/b") {
+		t.Fatal("deleted key was set again")
+	}
+}
+
+// miniredis does not emit keyspace notifications, the test publishes them
+// the way a server with notify-keyspace-events Kg$x would
+func TestRedisWatch(t *testing.T) {
+	r, mr := newTestRedis(t, time.Second)
+	defer r.Close()
+	fn, ch := collectEvents()
+	stop, err := r.Watch("ion://node/", true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	keyFn, keyCh := collectEvents()
+	stopKey, err := r.Watch("ion://node/a", false, keyFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopKey()
+
+	notify := func(key, event string) { mr.Publish("__keyspace@0__:"+key, event) }
+	mr.Set("ion://node/a", "1")
+	notify("ion://node/a", "set")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "1"})
+	expectEvent(t, keyCh, watchEvent{EventPut, "ion://node/a", "1"})
+
+	mr.Set("ion://room/a", "x")
+	notify("ion://room/a", "set")
+	mr.Set("ion://node/b", "2")
+	notify("ion://node/b", "set")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/b", "2"})
+
+	mr.Del("ion://node/b")
+	notify("ion://node/b", "expired")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/b", ""})
+	mr.Del("ion://node/a")
+	notify("ion://node/a", "del")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/a", ""})
+	expectEvent(t, keyCh, watchEvent{EventDelete, "ion://node/a", ""})
+
+	if _, err := r.Watch("ion://node/", true, nil); err == nil {
+		t.Fatal("nil watch func accepted")
+	}
+}
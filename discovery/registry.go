@@ -0,0 +1,70 @@
+package discovery
+
+import "context"
+
+// Registry is a key value store where a node keeps its registration alive
+// and watches others, Etcd is the default backend
+type Registry interface {
+	// Keep puts key bound to the lifetime of this registry
+	Keep(key, value string) error
+	// Update changes the value of a kept key, keeping it if it is not
+	Update(key, value string) error
+	Del(key string) error
+	// Get returns ErrKeyNotFound if key does not exist
+	Get(key string) (string, error)
+	GetByPrefix(prefix string) (map[string]string, error)
+	Watch(key string, prefix bool, fn WatchFunc) (func(), error)
+	// Close drops every kept key and releases the backend
+	Close() error
+}
+
+// SnapshotWatcher is implemented by registries that can read a prefix and
+// watch it from that read atomically, without missing a change in between
+type SnapshotWatcher interface {
+	SnapshotWatch(prefix string, fn WatchFunc) (map[string]string, func(), error)
+}
+
+var (
+	_ Registry        = (*Etcd)(nil)
+	_ SnapshotWatcher = (*Etcd)(nil)
+)
+
+// NewRegistry returns an etcd backed Registry
+func NewRegistry(cfg Config) (Registry, error) {
+	e, err := newEtcdWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Etcd) Keep(key, value string) error {
+	return e.keep(key, value)
+}
+
+func (e *Etcd) Update(key, value string) error {
+	return e.update(key, value)
+}
+
+func (e *Etcd) Del(key string) error {
+	return e.del(key)
+}
+
+func (e *Etcd) Get(key string) (string, error) {
+	return e.get(key)
+}
+
+func (e *Etcd) GetByPrefix(prefix string) (map[string]string, error) {
+	return e.getByPrefix(prefix)
+}
+
+func (e *Etcd) Close() error {
+	return e.close()
+}
+
+// CloseContext is Close bounded by ctx instead of OperationTimeout. Revoking
+// a lease drops all of its keys at once, so the node disappears right away
+// rather than when the TTL runs out.
+func (e *Etcd) CloseContext(ctx context.Context) error {
+	return e.closeCtx(ctx)
+}
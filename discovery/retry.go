@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = time.Millisecond * 50
+	defaultRetryMaxDelay  = time.Second
+	defaultRetryJitter    = 0.2
+)
+
+// RetryPolicy retries get, getByPrefix, keep, update and del on transient
+// errors: timeouts, no leader and unavailable endpoints. Every other error,
+// ErrKeyNotFound included, is returned at once.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try, default 3, 1 never retries
+	MaxAttempts int
+	// BaseDelay doubles after every attempt up to MaxDelay, default 50ms and 1s
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction of each delay taken off at random, so clients
+	// failing together do not retry together, default 0.2
+	Jitter float64
+}
+
+func (p *RetryPolicy) setDefaults() error {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryAttempts
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	if p.Jitter == 0 {
+		p.Jitter = defaultRetryJitter
+	}
+	if p.MaxAttempts < 0 || p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay || p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("invalid retry policy")
+	}
+	return nil
+}
+
+// retry runs op until it succeeds, fails for good or MaxAttempts is reached,
+// ctx bounds the whole of it including the delays
+func (e *Etcd) retry(ctx context.Context, op func() error) error {
+	p := e.cfg.Retry
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		wait := delay - time.Duration(rand.Float64()*p.Jitter*float64(delay))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-e.ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+}
+
+// retryable tells transient errors, which may go away with a new leader or
+// endpoint, apart from those retrying cannot fix
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrConnClosed) {
+		return true
+	}
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrNoLeader, rpctypes.ErrLeaderChanged, rpctypes.ErrNotCapable, rpctypes.ErrTooManyRequests:
+		return true
+	}
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.Unavailable
+}
@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flaky fails its first n calls with err
+type flaky struct {
+	n, calls int
+	err      error
+}
+
+func (f *flaky) op() error {
+	f.calls++
+	if f.calls <= f.n {
+		return f.err
+	}
+	return nil
+}
+
+func newRetryEtcd(t *testing.T, p RetryPolicy) *Etcd {
+	if err := p.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	return &Etcd{cfg: Config{Retry: p}, ctx: context.Background()}
+}
+
+func TestRetry(t *testing.T) {
+	e := newRetryEtcd(t, RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond})
+	transient := etcdError(rpctypes.ErrGRPCTimeout)
+
+	f := &flaky{n: 2, err: transient}
+	if err := e.retry(context.Background(), f.op); err != nil || f.calls != 3 {
+		t.Fatalf("retry = %v after %d calls, want success on the 3rd", err, f.calls)
+	}
+	f = &flaky{n: 5, err: transient}
+	if err := e.retry(context.Background(), f.op); err != transient || f.calls != 3 {
+		t.Fatalf("retry = %v after %d calls, want the error after 3", err, f.calls)
+	}
+	f = &flaky{n: 5, err: ErrKeyNotFound}
+	if err := e.retry(context.Background(), f.op); err != ErrKeyNotFound || f.calls != 1 {
+		t.Fatalf("retry = %v after %d calls, want no retry", err, f.calls)
+	}
+
+	e = newRetryEtcd(t, RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	f = &flaky{n: 10, err: transient}
+	start := time.Now()
+	if err := e.retry(ctx, f.op); err != transient || f.calls != 1 {
+		t.Fatalf("retry = %v after %d calls", err, f.calls)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("retry outlived its context by %v", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{etcdError(context.DeadlineExceeded), true},
+		{etcdError(rpctypes.ErrGRPCNoLeader), true},
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{fmt.Errorf("get: %w", etcdError(rpctypes.ErrGRPCTimeoutDueToLeaderFail)), true},
+		{context.Canceled, false},
+		{ErrKeyNotFound, false},
+		{etcdError(rpctypes.ErrGRPCAuthFailed), false},
+		{etcdError(rpctypes.ErrGRPCCompacted), false},
+	} {
+		if got := retryable(c.err); got != c.want {
+			t.Errorf("retryable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	var p RetryPolicy
+	if err := p.setDefaults(); err != nil || p.MaxAttempts != 3 {
+		t.Fatalf("defaults %+v, %v", p, err)
+	}
+	if err := (&RetryPolicy{Jitter: 2}).setDefaults(); err == nil {
+		t.Fatal("jitter over 1 accepted")
+	}
+}
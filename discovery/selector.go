@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ErrNoNodes is returned when there is no node to pick from
+var ErrNoNodes = errors.New("no service nodes")
+
+const (
+	// MetaLoad is the Meta field holding the current load of a node
+	MetaLoad = "load"
+	// MetaCapacity is the Meta field weighting a node for PickWeighted
+	MetaCapacity = "capacity"
+)
+
+// NodeSelector picks a node of one service for a new session. It is fed by
+// WatchServices through Watch, or by Add and Remove, and may be picked from
+// while membership changes.
+type NodeSelector struct {
+	mu    sync.RWMutex
+	nodes map[string]ServiceNode
+	rand  *rand.Rand
+}
+
+func NewNodeSelector() *NodeSelector {
+	return &NodeSelector{
+		nodes: make(map[string]ServiceNode),
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// Watch keeps the selector in sync with the nodes of service name, the
+// returned func stops watching
+func (s *NodeSelector) Watch(services *Services, name string) (func(), error) {
+	return services.WatchServices(name, s.Add, s.Add, s.Remove)
+}
+
+// Add adds node or replaces the node with the same ID
+func (s *NodeSelector) Add(node ServiceNode) {
+	s.mu.Lock()
+	s.nodes[node.ID] = node
+	s.mu.Unlock()
+}
+
+func (s *NodeSelector) Remove(node ServiceNode) {
+	s.mu.Lock()
+	delete(s.nodes, node.ID)
+	s.mu.Unlock()
+}
+
+// Nodes returns the known nodes sorted by ID
+func (s *NodeSelector) Nodes() []ServiceNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted()
+}
+
+// sorted returns the nodes sorted by ID, mu must be held
+func (s *NodeSelector) sorted() []ServiceNode {
+	nodes := make([]ServiceNode, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// PickLeastLoaded returns the node with the lowest MetaLoad, the smallest ID
+// among equally loaded ones. A node without a valid load counts as 0.
+func (s *NodeSelector) PickLeastLoaded() (ServiceNode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := s.sorted()
+	if len(nodes) == 0 {
+		return ServiceNode{}, ErrNoNodes
+	}
+	best, bestLoad := nodes[0], metaFloat(nodes[0], MetaLoad, 0)
+	for _, n := range nodes[1:] {
+		if l := metaFloat(n, MetaLoad, 0); l < bestLoad {
+			best, bestLoad = n, l
+		}
+	}
+	return best, nil
+}
+
+// PickWeighted returns a random node with a probability proportional to its
+// MetaCapacity, a node without a valid capacity weighs 1 and one with a
+// capacity of 0 or less is never picked
+func (s *NodeSelector) PickWeighted() (ServiceNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := s.sorted()
+	var total float64
+	weights := make([]float64, len(nodes))
+	for i, n := range nodes {
+		if w := metaFloat(n, MetaCapacity, 1); w > 0 {
+			weights[i] = w
+			total += w
+		}
+	}
+	if total == 0 {
+		return ServiceNode{}, ErrNoNodes
+	}
+	// rand is not safe for concurrent use, hence the write lock
+	r := s.rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return nodes[i], nil
+		}
+		r -= w
+	}
+	// rounding may leave r at the very end
+	for i := len(nodes) - 1; ; i-- {
+		if weights[i] > 0 {
+			return nodes[i], nil
+		}
+	}
+}
+
+func metaFloat(n ServiceNode, field string, def float64) float64 {
+	f, err := strconv.ParseFloat(n.Meta[field], 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testNode(id string, meta map[string]string) ServiceNode {
+	return ServiceNode{ID: id, Name: "sfu", Meta: meta}
+}
+
+func TestPickLeastLoaded(t *testing.T) {
+	s := NewNodeSelector()
+	if _, err := s.PickLeastLoaded(); err != ErrNoNodes {
+		t.Fatalf("empty selector err = %v, want ErrNoNodes", err)
+	}
+	s.Add(testNode("c", map[string]string{MetaLoad: "0.2"}))
+	s.Add(testNode("b", map[string]string{MetaLoad: "0.5"}))
+	s.Add(testNode("a", map[string]string{MetaLoad: "0.5"}))
+	if n, _ := s.PickLeastLoaded(); n.ID != "c" {
+		t.Fatalf("picked %s, want c", n.ID)
+	}
+	s.Remove(testNode("c", nil))
+	// a tie goes to the smallest id
+	for i := 0; i < 10; i++ {
+		if n, _ := s.PickLeastLoaded(); n.ID != "a" {
+			t.Fatalf("tie picked %s, want a", n.ID)
+		}
+	}
+	s.Add(testNode("b", map[string]string{MetaLoad: "0.1"}))
+	if n, _ := s.PickLeastLoaded(); n.ID != "b" {
+		t.Fatalf("picked %s after update, want b", n.ID)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	s := NewNodeSelector()
+	if _, err := s.PickWeighted(); err != ErrNoNodes {
+		t.Fatalf("empty selector err = %v, want ErrNoNodes", err)
+	}
+	s.Add(testNode("a", map[string]string{MetaCapacity: "3"}))
+	s.Add(testNode("b", map[string]string{MetaCapacity: "1"}))
+	s.Add(testNode("full", map[string]string{MetaCapacity: "0"}))
+	count := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		n, err := s.PickWeighted()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[n.ID]++
+	}
+	if count["full"] != 0 {
+		t.Fatalf("node without capacity picked %d times", count["full"])
+	}
+	if r := float64(count["a"]) / float64(count["b"]); r < 2.5 || r > 3.5 {
+		t.Fatalf("a/b picked %v, want about 3", count)
+	}
+	s.Remove(testNode("a", nil))
+	s.Remove(testNode("b", nil))
+	if _, err := s.PickWeighted(); err != ErrNoNodes {
+		t.Fatalf("only zero capacity err = %v, want ErrNoNodes", err)
+	}
+}
+
+func TestNodeSelectorWatch(t *testing.T) {
+	m := newTestMemory(t, 0)
+	services := NewServices(m)
+	s := NewNodeSelector()
+	stop, err := s.Watch(services, "sfu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.PickLeastLoaded()
+			s.PickWeighted()
+		}
+	}()
+	services.Register(ServiceNode{ID: "1", Name: "sfu", Meta: map[string]string{MetaLoad: "9"}})
+	services.Register(ServiceNode{ID: "2", Name: "sfu", Meta: map[string]string{MetaLoad: "1"}})
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.Nodes()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, err := s.PickLeastLoaded(); err != nil || n.ID != "2" {
+		t.Fatalf("picked %v, %v", n, err)
+	}
+}
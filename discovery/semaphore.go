@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+// ErrSemaphoreFull is returned by TryAcquire when every slot is held
+var ErrSemaphoreFull = errors.New("semaphore full")
+
+// Semaphore lets at most limit holders in at once across every instance
+// using the same prefix, e.g. the sessions one SFU admits. Each acquirer
+// queues a key on its session lease under prefix and holds a slot while
+// its key is among the limit oldest, so a slot held by a dead node is freed
+// once its lease expires.
+type Semaphore struct {
+	session *concurrency.Session
+	prefix  string
+	limit   int64
+	seq     uint64
+}
+
+// NewSemaphore returns the semaphore prefix admitting limit holders, its
+// session lease lives ttl after the holder stops renewing it, GrantTTL when
+// ttl is zero
+func (e *Etcd) NewSemaphore(prefix string, limit int, ttl time.Duration) (*Semaphore, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("semaphore %s limit %d is less than 1", prefix, limit)
+	}
+	if ttl == 0 {
+		ttl = time.Duration(e.grantTTL()) * time.Second
+	}
+	if ttl < time.Second {
+		return nil, fmt.Errorf("semaphore %s ttl %v is less than 1s", prefix, ttl)
+	}
+	s, err := concurrency.NewSession(e.cli(), concurrency.WithTTL(int(ttl/time.Second)))
+	if err != nil {
+		e.log().Errorf("Etcd.NewSemaphore %s %v", prefix, err)
+		return nil, etcdError(err)
+	}
+	return &Semaphore{session: s, prefix: prefix + "/", limit: int64(limit)}, nil
+}
+
+// Acquire blocks until a slot is free or ctx is canceled, release gives the
+// slot back
+func (s *Semaphore) Acquire(ctx context.Context) (release func(), err error) {
+	return s.acquire(ctx, true)
+}
+
+// TryAcquire takes a slot or returns ErrSemaphoreFull right away
+func (s *Semaphore) TryAcquire(ctx context.Context) (release func(), err error) {
+	return s.acquire(ctx, false)
+}
+
+func (s *Semaphore) acquire(ctx context.Context, wait bool) (func(), error) {
+	cli := s.session.Client()
+	key := fmt.Sprintf("%s%x-%d", s.prefix, s.session.Lease(), atomic.AddUint64(&s.seq, 1))
+	if _, err := cli.Put(ctx, key, "", clientv3.WithLease(s.session.Lease())); err != nil {
+		return nil, etcdError(err)
+	}
+	del := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultOperationTimeout)
+		defer cancel()
+		cli.Delete(ctx, key)
+	}
+	for {
+		resp, err := cli.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+			clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend),
+			clientv3.WithLimit(s.limit))
+		if err != nil {
+			del()
+			return nil, etcdError(err)
+		}
+		for _, kv := range resp.Kvs {
+			if string(kv.Key) == key {
+				var once sync.Once
+				return func() { once.Do(del) }, nil
+			}
+		}
+		if !wait {
+			del()
+			return nil, ErrSemaphoreFull
+		}
+		// a key ahead of ours has to go before we get a slot
+		wctx, cancel := context.WithCancel(ctx)
+		wch := cli.Watch(wctx, s.prefix, clientv3.WithPrefix(), clientv3.WithFilterPut(),
+			clientv3.WithRev(resp.Header.Revision+1))
+		select {
+		case <-wch:
+		case <-ctx.Done():
+		}
+		cancel()
+		if ctx.Err() != nil {
+			del()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close revokes the session, releasing every slot it holds
+func (s *Semaphore) Close() error {
+	return s.session.Close()
+}
@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	e := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	const limit, acquirers = 3, 12
+	var held, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < acquirers; i++ {
+		s, err := e.NewSemaphore("ion://test/sema/sfu1", limit, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for r := 0; r < 3; r++ {
+				release, err := s.Acquire(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n := atomic.AddInt32(&held, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&held, -1)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	if peak > limit {
+		t.Fatalf("%d holders at once, limit %d", peak, limit)
+	}
+	if peak == 0 {
+		t.Fatal("nothing acquired")
+	}
+}
+
+func TestSemaphoreFull(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	holder, err := e.NewSemaphore("ion://test/sema/full", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := e.NewSemaphore("ion://test/sema/full", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	ctx := context.Background()
+	if _, err := holder.TryAcquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.TryAcquire(ctx); err != ErrSemaphoreFull {
+		t.Fatalf("second acquire err = %v, want ErrSemaphoreFull", err)
+	}
+
+	// the slot of a holder whose lease is gone is given back
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := other.Acquire(ctx)
+		acquired <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	holder.Close()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slot of a dead holder not released")
+	}
+}
+
+func TestNewSemaphoreTTL(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	for _, ttl := range []time.Duration{-time.Second, 500 * time.Millisecond} {
+		if s, err := e.NewSemaphore("ion://test/sema/ttl", 1, ttl); err == nil {
+			s.Close()
+			t.Fatalf("ttl %v accepted", ttl)
+		}
+	}
+}
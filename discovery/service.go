@@ -0,0 +1,466 @@
+package discovery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/ion/log"
+)
+
+var servicePrefix = Join("node").Prefix()
+
+const defaultSnapshotInterval = 100 * time.Millisecond
+
+// ErrDuplicateRegistration is returned by Register when the node id is
+// already registered by another instance, e.g. two processes configured with
+// the same id. A crashed instance holds its id until its TTL runs out.
+var ErrDuplicateRegistration = errors.New("node registered by another instance")
+
+// Health is what a live node says about itself, its lease only tells that
+// it is alive
+type Health int
+
+const (
+	// Healthy is the zero Health, nodes that never set one are healthy
+	Healthy Health = iota
+	// Draining nodes finish their sessions but take no new ones
+	Draining
+	Unhealthy
+)
+
+var healthNames = map[Health]string{Healthy: "healthy", Draining: "draining", Unhealthy: "unhealthy"}
+
+func (h Health) String() string {
+	if name, ok := healthNames[h]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+func (h Health) MarshalText() ([]byte, error) {
+	if _, ok := healthNames[h]; !ok {
+		return nil, fmt.Errorf("unknown health %d", int(h))
+	}
+	return []byte(h.String()), nil
+}
+
+func (h *Health) UnmarshalText(b []byte) error {
+	for v, name := range healthNames {
+		if name == string(b) {
+			*h = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health %q", b)
+}
+
+// ServiceNode is a registered ion node, stored as JSON under serviceKey
+type ServiceNode struct {
+	ID   string            `json:"id"`
+	Name string            `json:"name"`
+	Addr string            `json:"addr"`
+	Meta map[string]string `json:"meta,omitempty"`
+	// Health is changed by registering the node again
+	Health Health `json:"health,omitempty"`
+	// Instance tells apart processes registering the same id, Register
+	// fills it with the fingerprint of its Services when empty
+	Instance string `json:"instance,omitempty"`
+	// Successor is the instance a Draining node is handed over to
+	Successor string `json:"successor,omitempty"`
+}
+
+// serviceKey is the key of a node, ion://node/<name>/<id>
+func serviceKey(name, id string) string {
+	return ForNode(name, id).String()
+}
+
+func (n ServiceNode) marshal() (string, error) {
+	b, err := json.Marshal(n)
+	return string(b), err
+}
+
+// newInstance returns a fingerprint unique to this process and call, pid,
+// start time and random bytes
+func newInstance() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%d-%s", os.Getpid(), time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+func unmarshalServiceNode(value string) (ServiceNode, error) {
+	var n ServiceNode
+	err := json.Unmarshal([]byte(value), &n)
+	return n, err
+}
+
+// Services registers nodes in a Registry under one key layout, so sfu, biz
+// and islb nodes all encode and find each other the same way
+type Services struct {
+	registry Registry
+	instance string
+	// SweepPrefixes are scanned by DeregisterOwner, only the nodes under
+	// ion://node/ when empty
+	SweepPrefixes []string
+	// SnapshotInterval is how long SnapshotStream gathers a burst of changes
+	// into one snapshot, defaultSnapshotInterval when 0
+	SnapshotInterval time.Duration
+
+	mu    sync.Mutex
+	nodes map[string]ServiceNode
+}
+
+func NewServices(r Registry) *Services {
+	return &Services{
+		registry: r,
+		instance: newInstance(),
+		nodes:    make(map[string]ServiceNode),
+	}
+}
+
+// Instance is the fingerprint Register gives nodes, embed it as "instance"
+// in other JSON values so DeregisterOwner finds them too
+func (s *Services) Instance() string {
+	return s.instance
+}
+
+// layout checks node and returns it as Register writes it, under key with
+// value. The name and id are escaped by ForNode, so sfu/a with b and sfu
+// with a/b are two keys.
+func (s *Services) layout(node ServiceNode) (ServiceNode, KV, error) {
+	if node.ID == "" || node.Name == "" {
+		return node, KV{}, fmt.Errorf("service node needs an id and a name: %+v", node)
+	}
+	if node.Instance == "" {
+		node.Instance = s.instance
+	}
+	value, err := node.marshal()
+	if err != nil {
+		return node, KV{}, err
+	}
+	return node, KV{Key: serviceKey(node.Name, node.ID), Value: value}, nil
+}
+
+// PreviewRegister returns the keys and values Register would write for
+// node without contacting the registry, so tooling can lint a key layout.
+// Their revisions are left 0.
+func (s *Services) PreviewRegister(node ServiceNode) ([]KV, error) {
+	_, kv, err := s.layout(node)
+	if err != nil {
+		return nil, err
+	}
+	return []KV{kv}, nil
+}
+
+// Register keeps node alive in the registry until Deregister or Close. It
+// returns ErrDuplicateRegistration rather than overwrite the node of another
+// instance, re-registering to update a node of this one is fine.
+func (s *Services) Register(node ServiceNode) error {
+	node, kv, err := s.layout(node)
+	if err != nil {
+		return err
+	}
+	key := kv.Key
+	// the check and the keep are not atomic, two instances starting at once
+	// may both pass it
+	if value, err := s.registry.Get(key); err == nil {
+		if old, err := unmarshalServiceNode(value); err == nil && old.Instance != "" && old.Instance != node.Instance {
+			return fmt.Errorf("%w: %s is held by %s", ErrDuplicateRegistration, key, old.Instance)
+		}
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	if err := s.registry.Keep(key, kv.Value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.nodes[node.ID] = node
+	s.mu.Unlock()
+	return nil
+}
+
+// Deregister deletes a node registered by this instance
+func (s *Services) Deregister(id string) error {
+	s.mu.Lock()
+	node, ok := s.nodes[id]
+	delete(s.nodes, id)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("service node %s is not registered", id)
+	}
+	return s.registry.Del(serviceKey(node.Name, node.ID))
+}
+
+// DeregisterOwner deletes every JSON value under SweepPrefixes whose
+// "instance" is fingerprint, e.g. what a crashed predecessor left before its
+// TTL runs out, and returns how many were deleted
+func (s *Services) DeregisterOwner(fingerprint string) (int, error) {
+	if fingerprint == "" {
+		return 0, errors.New("empty owner fingerprint")
+	}
+	prefixes := s.SweepPrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{servicePrefix}
+	}
+	n := 0
+	for _, prefix := range prefixes {
+		m, err := s.registry.GetByPrefix(prefix)
+		if err != nil {
+			return n, err
+		}
+		for key, value := range m {
+			var owner struct {
+				Instance string `json:"instance"`
+			}
+			if json.Unmarshal([]byte(value), &owner) != nil || owner.Instance != fingerprint {
+				continue
+			}
+			if err := s.registry.Del(key); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	s.mu.Lock()
+	for id, node := range s.nodes {
+		if node.Instance == fingerprint {
+			delete(s.nodes, id)
+		}
+	}
+	s.mu.Unlock()
+	return n, nil
+}
+
+// Get returns the node id of service name
+func (s *Services) Get(name, id string) (ServiceNode, error) {
+	value, err := s.registry.Get(serviceKey(name, id))
+	if err != nil {
+		return ServiceNode{}, err
+	}
+	return unmarshalServiceNode(value)
+}
+
+// WatchServices reports the nodes of service name: onAdd fires for every node
+// already registered, then for every new one, onUpdate when a known node
+// changes and onDel when it goes away. Any callback may be nil, they are
+// called one at a time. The returned func stops watching.
+// The service_nodes gauge of name follows the count of nodes while it runs,
+// expired nodes included.
+func (s *Services) WatchServices(name string, onAdd, onUpdate, onDel func(ServiceNode)) (func(), error) {
+	prefix := Join("node", name).Prefix()
+	gauge := serviceNodes.WithLabelValues(name)
+	var mu sync.Mutex
+	known := make(map[string]ServiceNode)
+	call := func(f func(ServiceNode), n ServiceNode) {
+		if f != nil {
+			f(n)
+		}
+	}
+
+	handle := func(typ EventType, key, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		old, ok := known[key]
+		if typ == EventDelete {
+			if ok {
+				delete(known, key)
+				gauge.Set(float64(len(known)))
+				call(onDel, old)
+			}
+			return
+		}
+		n, err := unmarshalServiceNode(value)
+		if err != nil {
+			log.Errorf("Services.WatchServices %s %v", key, err)
+			return
+		}
+		known[key] = n
+		gauge.Set(float64(len(known)))
+		if ok {
+			call(onUpdate, n)
+		} else {
+			call(onAdd, n)
+		}
+	}
+
+	// events wait for the snapshot to be reported first
+	mu.Lock()
+	defer mu.Unlock()
+	snapshot, cancel, err := s.snapshotWatch(prefix, handle)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range snapshot {
+		n, err := unmarshalServiceNode(value)
+		if err != nil {
+			log.Errorf("Services.WatchServices %s %v", key, err)
+			continue
+		}
+		known[key] = n
+		call(onAdd, n)
+	}
+	gauge.Set(float64(len(known)))
+	return cancel, nil
+}
+
+// snapshotWatch reads prefix and watches it, atomically when the registry
+// is a SnapshotWatcher
+func (s *Services) snapshotWatch(prefix string, fn WatchFunc) (map[string]string, func(), error) {
+	if sw, ok := s.registry.(SnapshotWatcher); ok {
+		return sw.SnapshotWatch(prefix, fn)
+	}
+	// a change between the read and the watch start may be missed
+	snapshot, err := s.registry.GetByPrefix(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	cancel, err := s.registry.Watch(prefix, true, fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshot, cancel, nil
+}
+
+// SnapshotStream publishes the whole set of nodes under prefix, keyed by
+// their key, first as it is and then after every burst of changes. Each map
+// is a fresh copy and a consumer that falls behind only gets the latest.
+// The returned func stops the stream and closes the channel.
+func (s *Services) SnapshotStream(prefix string) (<-chan map[string]ServiceNode, func(), error) {
+	interval := s.SnapshotInterval
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	var mu sync.Mutex
+	nodes := make(map[string]ServiceNode)
+	changed := make(chan struct{}, 1)
+	set := func(key, value string) {
+		n, err := unmarshalServiceNode(value)
+		if err != nil {
+			log.Errorf("Services.SnapshotStream %s %v", key, err)
+			return
+		}
+		nodes[key] = n
+	}
+	snapshot, cancel, err := s.snapshotWatch(prefix, func(typ EventType, key, value string) {
+		mu.Lock()
+		if typ == EventDelete {
+			delete(nodes, key)
+		} else {
+			set(key, value)
+		}
+		mu.Unlock()
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make(chan map[string]ServiceNode, 1)
+	publish := func() {
+		mu.Lock()
+		m := make(map[string]ServiceNode, len(nodes))
+		for k, n := range nodes {
+			m[k] = n
+		}
+		mu.Unlock()
+		// replace a snapshot not consumed yet
+		select {
+		case <-out:
+		default:
+		}
+		out <- m
+	}
+	mu.Lock()
+	for k, v := range snapshot {
+		set(k, v)
+	}
+	mu.Unlock()
+	publish()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-done:
+				return
+			case <-changed:
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(interval):
+			}
+			publish()
+		}
+	}()
+	var once sync.Once
+	return out, func() {
+		once.Do(func() {
+			cancel()
+			close(done)
+		})
+	}, nil
+}
+
+// WatchHealthy calls onChange with the Healthy nodes of service name sorted
+// by id, first as they are and then whenever that set changes. A node
+// leaves it as soon as it registers as Draining or Unhealthy, before its
+// lease would expire. The returned func stops watching.
+func (s *Services) WatchHealthy(name string, onChange func([]ServiceNode)) (func(), error) {
+	if onChange == nil {
+		return nil, errors.New("onChange is nil")
+	}
+	var mu sync.Mutex
+	nodes := make(map[string]ServiceNode)
+	var last []ServiceNode
+	started := false
+	report := func() {
+		healthy := []ServiceNode{}
+		for _, n := range nodes {
+			if n.Health == Healthy {
+				healthy = append(healthy, n)
+			}
+		}
+		sort.Slice(healthy, func(i, j int) bool { return healthy[i].ID < healthy[j].ID })
+		if last != nil && reflect.DeepEqual(healthy, last) {
+			return
+		}
+		last = healthy
+		onChange(healthy)
+	}
+	set := func(n ServiceNode) {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes[n.ID] = n
+		if started {
+			report()
+		}
+	}
+	del := func(n ServiceNode) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(nodes, n.ID)
+		if started {
+			report()
+		}
+	}
+	cancel, err := s.WatchServices(name, set, set, del)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	started = true
+	report()
+	mu.Unlock()
+	return cancel, nil
+}
@@ -0,0 +1,341 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServiceNodeMarshal(t *testing.T) {
+	n := ServiceNode{ID: "sfu1", Name: "sfu", Addr: "10.0.0.1:5000", Meta: map[string]string{"load": "10"}}
+	value, err := n.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unmarshalServiceNode(value)
+	if err != nil || !reflect.DeepEqual(got, n) {
+		t.Fatalf("round trip = %+v, %v", got, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	n := ServiceNode{ID: "sfu1", Name: "sfu", Addr: "10.0.0.1:5000"}
+	if err := s.Register(n); err != nil {
+		t.Fatal(err)
+	}
+	n.Instance = s.instance
+	if got, err := s.Get("sfu", "sfu1"); err != nil || !reflect.DeepEqual(got, n) {
+		t.Fatalf("Get = %+v, %v", got, err)
+	}
+	if _, err := m.Get("ion://node/sfu/sfu1"); err != nil {
+		t.Fatalf("node not under its conventional key: %v", err)
+	}
+	if err := s.Deregister("sfu1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("ion://node/sfu/sfu1"); err != ErrKeyNotFound {
+		t.Fatalf("key left after Deregister: %v", err)
+	}
+	if err := s.Deregister("sfu1"); err == nil {
+		t.Fatal("second Deregister succeeded")
+	}
+}
+
+func TestWatchServices(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	s.Register(ServiceNode{ID: "a", Name: "sfu"})
+
+	events := make(chan string, 10)
+	record := func(kind string) func(ServiceNode) {
+		return func(n ServiceNode) { events <- kind + " " + n.ID + " " + n.Addr }
+	}
+	cancel, err := s.WatchServices("sfu", record("add"), record("update"), record("del"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	s.Register(ServiceNode{ID: "b", Name: "sfu"})
+	s.Register(ServiceNode{ID: "a", Name: "sfu", Addr: "moved"})
+	s.Register(ServiceNode{ID: "c", Name: "biz"})
+	s.Deregister("b")
+	for _, want := range []string{"add a ", "add b ", "update a moved", "del b "} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("event %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event, want %q", want)
+		}
+	}
+}
+
+func TestSnapshotStream(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	s.SnapshotInterval = 50 * time.Millisecond
+	s.Register(ServiceNode{ID: "a", Name: "sfu"})
+
+	snapshots, cancel, err := s.SnapshotStream(servicePrefix + "sfu/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := <-snapshots
+	if len(first) != 1 || first[serviceKey("sfu", "a")].ID != "a" {
+		t.Fatalf("first snapshot %+v", first)
+	}
+
+	for i := 0; i < 20; i++ {
+		s.Register(ServiceNode{ID: "b", Name: "sfu", Addr: fmt.Sprint(i)})
+	}
+	s.Deregister("a")
+	var last map[string]ServiceNode
+	n := 0
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case last = <-snapshots:
+			n++
+		case <-timeout:
+			done = true
+		}
+	}
+	if n == 0 || n > 3 {
+		t.Fatalf("%d snapshots for a burst of 21 changes", n)
+	}
+	want := map[string]ServiceNode{serviceKey("sfu", "b"): {ID: "b", Name: "sfu", Addr: "19", Instance: s.instance}}
+	if !reflect.DeepEqual(last, want) {
+		t.Fatalf("last snapshot %+v, want %+v", last, want)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-snapshots; ok {
+		t.Fatal("stream not closed after cancel")
+	}
+}
+
+// wrappingRegistry wraps the errors of Get like a backend adding context
+type wrappingRegistry struct {
+	*MemoryRegistry
+}
+
+func (r wrappingRegistry) Get(key string) (string, error) {
+	v, err := r.MemoryRegistry.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("get %s: %w", key, err)
+	}
+	return v, nil
+}
+
+func TestRegisterWrappedNotFound(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(wrappingRegistry{m})
+	if err := s.Register(ServiceNode{ID: "sfu1", Name: "sfu"}); err != nil {
+		t.Fatalf("register of a new node = %v", err)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	first, second := NewServices(m), NewServices(m)
+	if first.instance == second.instance {
+		t.Fatalf("two Services share instance %s", first.instance)
+	}
+	if err := first.Register(ServiceNode{ID: "sfu1", Name: "sfu"}); err != nil {
+		t.Fatal(err)
+	}
+	// updating its own node is not a conflict
+	if err := first.Register(ServiceNode{ID: "sfu1", Name: "sfu", Addr: "moved"}); err != nil {
+		t.Fatal(err)
+	}
+	err := second.Register(ServiceNode{ID: "sfu1", Name: "sfu", Addr: "other"})
+	if !errors.Is(err, ErrDuplicateRegistration) {
+		t.Fatalf("second register err = %v", err)
+	}
+	if got, _ := first.Get("sfu", "sfu1"); got.Addr != "moved" || got.Instance != first.instance {
+		t.Fatalf("node overwritten %+v", got)
+	}
+
+	first.Deregister("sfu1")
+	if err := second.Register(ServiceNode{ID: "sfu1", Name: "sfu"}); err != nil {
+		t.Fatalf("register after the other deregistered: %v", err)
+	}
+}
+
+func TestDeregisterOwner(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	old, other := NewServices(m), NewServices(m)
+	old.Register(ServiceNode{ID: "sfu1", Name: "sfu"})
+	old.Register(ServiceNode{ID: "sfu2", Name: "sfu"})
+	other.Register(ServiceNode{ID: "sfu3", Name: "sfu"})
+	m.Keep("ion://stream/1", `{"instance":"`+old.Instance()+`"}`)
+	m.Keep("ion://stream/2", `{"instance":"`+other.Instance()+`"}`)
+	m.Keep("ion://stream/3", "not json")
+	m.Keep("ion://other/1", `{"instance":"`+old.Instance()+`"}`)
+
+	s := NewServices(m)
+	s.SweepPrefixes = []string{servicePrefix, "ion://stream/"}
+	n, err := s.DeregisterOwner(old.Instance())
+	if err != nil || n != 3 {
+		t.Fatalf("DeregisterOwner = %d, %v, want 3", n, err)
+	}
+	left, _ := m.GetByPrefix("ion://")
+	want := []string{"ion://node/sfu/sfu3", "ion://other/1", "ion://stream/2", "ion://stream/3"}
+	if len(left) != len(want) {
+		t.Fatalf("left %v, want %v", left, want)
+	}
+	for _, k := range want {
+		if _, ok := left[k]; !ok {
+			t.Fatalf("%s deleted, left %v", k, left)
+		}
+	}
+}
+
+func TestHealthJSON(t *testing.T) {
+	value, _ := ServiceNode{ID: "a", Name: "sfu", Health: Draining}.marshal()
+	if !strings.Contains(value, `"health":"draining"`) {
+		t.Fatalf("value %s", value)
+	}
+	if n, err := unmarshalServiceNode(value); err != nil || n.Health != Draining {
+		t.Fatalf("unmarshal = %+v, %v", n, err)
+	}
+	// values written before Health existed are healthy
+	if n, err := unmarshalServiceNode(`{"id":"a","name":"sfu"}`); err != nil || n.Health != Healthy {
+		t.Fatalf("unmarshal without health = %+v, %v", n, err)
+	}
+	if _, err := unmarshalServiceNode(`{"id":"a","health":"sleepy"}`); err == nil {
+		t.Fatal("unknown health accepted")
+	}
+}
+
+func TestWatchHealthy(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	s.Register(ServiceNode{ID: "a", Name: "sfu"})
+	s.Register(ServiceNode{ID: "b", Name: "sfu", Health: Unhealthy})
+
+	sets := make(chan []string, 10)
+	cancel, err := s.WatchHealthy("sfu", func(nodes []ServiceNode) {
+		ids := []string{}
+		for _, n := range nodes {
+			ids = append(ids, n.ID)
+		}
+		sets <- ids
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-sets:
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("healthy %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no change, want %v", want)
+		}
+	}
+	expect("a")
+	s.Register(ServiceNode{ID: "c", Name: "sfu"})
+	expect("a", "c")
+	s.Register(ServiceNode{ID: "a", Name: "sfu", Health: Draining})
+	expect("c")
+	// changes outside the healthy set are not reported
+	s.Register(ServiceNode{ID: "b", Name: "sfu", Health: Draining})
+	s.Register(ServiceNode{ID: "b", Name: "sfu"})
+	expect("b", "c")
+}
+
+func TestPreviewRegister(t *testing.T) {
+	m := newTestMemory(t, 0)
+	defer m.Close()
+	s := NewServices(m)
+	nodes := []ServiceNode{
+		{ID: "sfu1", Name: "sfu", Addr: "10.0.0.1:5000", Meta: map[string]string{"load": "10"}},
+		{ID: "biz1", Name: "biz", Addr: "10.0.0.2:5000", Health: Draining},
+		{ID: "islb1", Name: "islb", Addr: "10.0.0.3:5000", Instance: "other"},
+	}
+	want := map[string]string{}
+	for _, n := range nodes {
+		kvs, err := s.PreviewRegister(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, kv := range kvs {
+			want[kv.Key] = kv.Value
+		}
+	}
+	if all, _ := m.GetByPrefix(""); len(all) != 0 {
+		t.Fatalf("preview wrote %v", all)
+	}
+	for _, n := range nodes {
+		if err := s.Register(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := m.GetByPrefix(""); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("registered %v, %v, previewed %v", got, err, want)
+	}
+
+	if _, err := s.PreviewRegister(ServiceNode{Name: "sfu"}); err == nil {
+		t.Fatal("preview of a node without id succeeded")
+	}
+	// a / inside the name or id cannot make two nodes collide
+	a, _ := s.PreviewRegister(ServiceNode{ID: "a/b", Name: "sfu"})
+	b, _ := s.PreviewRegister(ServiceNode{ID: "b", Name: "sfu/a"})
+	if a[0].Key == b[0].Key || strings.HasPrefix(b[0].Key, Join("node", "sfu").Prefix()) {
+		t.Fatalf("keys %s and %s collide", a[0].Key, b[0].Key)
+	}
+}
+
+func TestServiceNodesGauge(t *testing.T) {
+	m := newTestMemory(t, 60*time.Millisecond)
+	defer m.Close()
+	s := NewServices(m)
+	gauge := serviceNodes.WithLabelValues("gauge")
+	expect := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for testutil.ToFloat64(gauge) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("service_nodes = %v, want %v", testutil.ToFloat64(gauge), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	s.Register(ServiceNode{ID: "1", Name: "gauge"})
+	stop, err := s.WatchServices("gauge", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	expect(1)
+	s.Register(ServiceNode{ID: "2", Name: "gauge"})
+	s.Register(ServiceNode{ID: "3", Name: "gauge"})
+	expect(3)
+	s.Register(ServiceNode{ID: "3", Name: "gauge", Health: Draining})
+	s.Deregister("2")
+	expect(2)
+	s.Register(ServiceNode{ID: "other", Name: "gaugeother"})
+	m.StopKeepAlive()
+	expect(0)
+}
@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pion/ion/log"
+)
+
+// DeregisterOnSignal removes this node's registrations from r once a signal
+// arrives on sig, so clients stop being routed to it right away rather than
+// after the lease TTL. With a nil sig it installs a handler for SIGINT and
+// SIGTERM, which then no longer terminate the process: the caller exits
+// after done is closed. Only keys are deleted, or when there are none every
+// key r keeps by closing it. stop removes the handler without deregistering.
+//
+// On Kubernetes SIGTERM is sent after the preStop hook returns, so a preStop
+// sleep meant to drain the load balancer also delays deregistration. Keep the
+// sleep shorter than terminationGracePeriodSeconds minus the OperationTimeout
+// the deletes may take.
+func DeregisterOnSignal(r Registry, sig <-chan os.Signal, keys ...string) (done <-chan struct{}, stop func()) {
+	var notify chan os.Signal
+	if sig == nil {
+		notify = make(chan os.Signal, 1)
+		signal.Notify(notify, syscall.SIGINT, syscall.SIGTERM)
+		sig = notify
+	}
+	quit := make(chan struct{})
+	d := make(chan struct{})
+	go func() {
+		defer close(d)
+		select {
+		case <-quit:
+			return
+		case s := <-sig:
+			log.Infof("discovery deregister on %v", s)
+		}
+		if len(keys) == 0 {
+			if err := r.Close(); err != nil {
+				log.Errorf("discovery deregister %v", err)
+			}
+			return
+		}
+		for _, k := range keys {
+			if err := r.Del(k); err != nil {
+				log.Errorf("discovery deregister %s %v", k, err)
+			}
+		}
+	}()
+	var once sync.Once
+	return d, func() {
+		once.Do(func() {
+			if notify != nil {
+				signal.Stop(notify)
+			}
+			close(quit)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package discovery
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeregisterOnSignal(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	node := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	other := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	node.Keep("ion://node/sfu/1", "a")
+	node.Keep("ion://stream/1", "s")
+	other.Keep("ion://node/sfu/2", "b")
+
+	sig := make(chan os.Signal, 1)
+	done, stop := DeregisterOnSignal(node, sig, "ion://node/sfu/1")
+	defer stop()
+	sig <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not deregistered")
+	}
+	if _, err := other.Get("ion://node/sfu/1"); err != ErrKeyNotFound {
+		t.Fatalf("own key after signal err = %v, want ErrKeyNotFound", err)
+	}
+	if v, _ := other.Get("ion://stream/1"); v != "s" {
+		t.Fatalf("key outside the deregistered set removed, got %q", v)
+	}
+	if v, _ := other.Get("ion://node/sfu/2"); v != "b" {
+		t.Fatalf("other node key removed, got %q", v)
+	}
+}
+
+func TestDeregisterOnSignalStop(t *testing.T) {
+	m := newTestMemory(t, 0)
+	m.Keep("ion://node/sfu/1", "a")
+	sig := make(chan os.Signal, 1)
+	done, stop := DeregisterOnSignal(m, sig)
+	stop()
+	<-done
+	sig <- syscall.SIGTERM
+	if _, err := m.Get("ion://node/sfu/1"); err != nil {
+		t.Fatalf("stopped handler deregistered: %v", err)
+	}
+}
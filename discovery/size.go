@@ -0,0 +1,35 @@
+package discovery
+
+import "fmt"
+
+const (
+	defaultValueWarnSize = 512 * 1024
+	// etcd rejects requests over 1.5MiB by default, this leaves room for the
+	// key and the rest of the request
+	defaultMaxValueSize = 1536*1024 - 64*1024
+)
+
+// valueSize is how many bytes value takes in etcd, after any compression
+func (e *Etcd) valueSize(value string) int {
+	if t := e.cfg.CompressThreshold; t > 0 && len(value) >= t {
+		return len(e.encodeValue(value))
+	}
+	return len(value)
+}
+
+// checkValue records the size of value about to be written to key, and
+// rejects it over MaxValueSize before etcd would
+func (e *Etcd) checkValue(key, value string) error {
+	n := e.valueSize(value)
+	valueSize.Observe(float64(n))
+	if n > e.cfg.MaxValueSize {
+		largeValues.WithLabelValues("rejected").Inc()
+		e.log().Errorf("Etcd.checkValue %s value of %d bytes over MaxValueSize %d", key, n, e.cfg.MaxValueSize)
+		return fmt.Errorf("%w: %s is %d bytes, the limit is %d", ErrValueTooLarge, key, n, e.cfg.MaxValueSize)
+	}
+	if n >= e.cfg.ValueWarnSize {
+		largeValues.WithLabelValues("warned").Inc()
+		e.log().Errorf("Etcd.checkValue %s value of %d bytes over ValueWarnSize %d, etcd rejects it from %d", key, n, e.cfg.ValueWarnSize, e.cfg.MaxValueSize)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValueSize(t *testing.T) {
+	e := newTestEtcd(t, Config{ValueWarnSize: 100, MaxValueSize: 1000})
+	warned := func() float64 { return testutil.ToFloat64(largeValues.WithLabelValues("warned")) }
+	rejected := func() float64 { return testutil.ToFloat64(largeValues.WithLabelValues("rejected")) }
+
+	w, r := warned(), rejected()
+	if err := e.keep("ion://test/size/small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if warned() != w {
+		t.Fatal("small value warned")
+	}
+	big := strings.Repeat("x", 500)
+	if err := e.keep("ion://test/size/big", big); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.update("ion://test/size/big", big+"y"); err != nil {
+		t.Fatal(err)
+	}
+	if got := warned() - w; got != 2 {
+		t.Fatalf("%v warnings, want 2", got)
+	}
+
+	huge := strings.Repeat("x", 1001)
+	if err := e.keep("ion://test/size/huge", huge); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("keep err = %v, want ErrValueTooLarge", err)
+	}
+	if err := e.update("ion://test/size/big", huge); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("update err = %v, want ErrValueTooLarge", err)
+	}
+	if err := e.PutStatic("ion://test/size/huge", huge); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("PutStatic err = %v, want ErrValueTooLarge", err)
+	}
+	if err := e.PutJSON("ion://test/size/huge", huge); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("PutJSON err = %v, want ErrValueTooLarge", err)
+	}
+	if got := rejected() - r; got != 4 {
+		t.Fatalf("%v rejections, want 4", got)
+	}
+
+	// every other write path checks too
+	ctx := context.Background()
+	writes := map[string]func() error{
+		"CompareAndSwap": func() error {
+			_, err := e.CompareAndSwap("ion://test/size/big", big+"y", huge)
+			return err
+		},
+		"Txn": func() error {
+			_, err := e.Txn().If(KeyExists("ion://test/size/big")).Else(OpPutStatic("ion://test/size/huge", huge)).Commit(ctx)
+			return err
+		},
+		"ApplyDesired": func() error {
+			_, _, _, err := e.ApplyDesired("ion://test/size/desired/", map[string]string{"ion://test/size/desired/a": huge})
+			return err
+		},
+		"PutAll": func() error {
+			return e.PutAll(ctx, map[string]string{"ion://test/size/huge": huge})
+		},
+		"TakeOver": func() error {
+			_, err := e.TakeOver("ion://test/size/big", big+"y", huge)
+			return err
+		},
+	}
+	for name, write := range writes {
+		r := rejected()
+		if err := write(); !errors.Is(err, ErrValueTooLarge) {
+			t.Fatalf("%s err = %v, want ErrValueTooLarge", name, err)
+		}
+		if rejected() != r+1 {
+			t.Fatalf("%s rejection not counted", name)
+		}
+	}
+	if _, err := e.Incr("ion://test/size/counter", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.get("ion://test/size/huge"); err != ErrKeyNotFound {
+		t.Fatalf("rejected value stored, get err = %v", err)
+	}
+	if v, err := e.get("ion://test/size/big"); err != nil || v != big+"y" {
+		t.Fatalf("big = %d bytes, %v, want the last accepted update", len(v), err)
+	}
+
+	// the limits apply to the compressed size
+	c := newTestEtcd(t, Config{Endpoints: e.cfg.Endpoints, MaxValueSize: 1000, CompressThreshold: 64})
+	if err := c.keep("ion://test/size/compressed", huge); err != nil {
+		t.Fatalf("compressible value err = %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// claimKey marks slot of pool as claimed
+func claimKey(pool, slot string) string {
+	return Join("claim", pool, slot).String()
+}
+
+// ClaimSlot claims the first unclaimed key under poolPrefix, in key order,
+// and returns it with the func releasing it. The slots are the keys put
+// under poolPrefix beforehand, e.g. with PutStatic; the claim is a separate
+// key on a lease of its own, so the slot is freed by etcd once this instance
+// dies. The claim lease is renewed across reconnects, but one that is lost
+// is not re-granted, as another instance may have claimed the slot
+// meanwhile, and release then returns ErrLeaseExpired. ErrNoSlots means
+// every slot is claimed.
+func (e *Etcd) ClaimSlot(poolPrefix string) (slotKey string, release func() error, err error) {
+	defer observe(opPut, time.Now(), &err)
+	if err := e.writable(); err != nil {
+		return "", nil, err
+	}
+	claimed := make(map[string]bool)
+	err = e.getByPrefixFunc(Join("claim", poolPrefix).Prefix(), func(key, _ string) error {
+		claimed[key] = true
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	var slots []string
+	err = e.getByPrefixFunc(poolPrefix, func(key, _ string) error {
+		slots = append(slots, key)
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, slot := range slots {
+		claim := claimKey(poolPrefix, slot)
+		if claimed[claim] {
+			continue
+		}
+		l, err := e.claim(claim, slot)
+		if err != nil {
+			e.log().Errorf("Etcd.ClaimSlot %s %v", slot, err)
+			return "", nil, err
+		}
+		if l == nil {
+			// claimed by another instance since the read
+			continue
+		}
+		var once sync.Once
+		release = func() (err error) {
+			once.Do(func() { err = e.unclaim(l) })
+			return err
+		}
+		return slot, release, nil
+	}
+	return "", nil, ErrNoSlots
+}
+
+// claim puts key on a new lease kept alive until unclaim if key does not
+// exist, a nil lease means it did
+func (e *Etcd) claim(key, value string) (*lease, error) {
+	if err := e.leaseRoom(); err != nil {
+		return nil, err
+	}
+	ttl := e.grantTTL()
+	ctx, cancel := e.opContext(e.ctx)
+	resp, err := e.cli().Grant(ctx, ttl)
+	cancel()
+	if err != nil {
+		return nil, etcdError(err)
+	}
+	ctx, cancel = e.opContext(e.ctx)
+	txn, err := e.cli().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(resp.ID))).
+		Commit()
+	cancel()
+	if err != nil || !txn.Succeeded {
+		e.revokeLease(resp.ID)
+		return nil, etcdError(err)
+	}
+	// not tracked, so a lost lease is not re-granted with the claim on it
+	l, err := e.keepAlive(resp.ID, ttl)
+	if err != nil {
+		e.revokeLease(resp.ID)
+		return nil, err
+	}
+	e.liveKeyIDLock.Lock()
+	e.claims[l.id] = l
+	e.liveKeyIDLock.Unlock()
+	return l, nil
+}
+
+// unclaim revokes the lease of a claim, which deletes it
+func (e *Etcd) unclaim(l *lease) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	e.liveKeyIDLock.Lock()
+	delete(e.claims, l.id)
+	// under the lock, swapClient replaces cancel when it renews the claim
+	l.cancel()
+	e.liveKeyIDLock.Unlock()
+	ctx, cancel := e.opContext(context.Background())
+	defer cancel()
+	_, err = e.cli().Revoke(ctx, l.id)
+	return etcdError(err)
+}
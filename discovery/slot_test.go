@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+func TestClaimSlot(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	const pool, k = "ion://test/pool/", 3
+	for i := 0; i < k; i++ {
+		if err := e.PutStatic(fmt.Sprintf("%sslot%d", pool, i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	got := make(map[string]func() error)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slot, release, err := e.ClaimSlot(pool)
+			if errors.Is(err, ErrNoSlots) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if _, dup := got[slot]; dup {
+				t.Errorf("%s claimed twice", slot)
+			}
+			got[slot] = release
+		}()
+	}
+	wg.Wait()
+	if len(got) != k {
+		t.Fatalf("%d claims succeeded, want %d", len(got), k)
+	}
+	if _, _, err := e.ClaimSlot(pool); !errors.Is(err, ErrNoSlots) {
+		t.Fatalf("claim of a full pool err = %v, want ErrNoSlots", err)
+	}
+
+	for slot, release := range got {
+		if err := release(); err != nil {
+			t.Fatalf("release %s: %v", slot, err)
+		}
+		// releasing twice is a no-op
+		if err := release(); err != nil {
+			t.Fatalf("second release %s: %v", slot, err)
+		}
+	}
+	if m, err := e.getByPrefix(Join("claim").Prefix()); err != nil || len(m) != 0 {
+		t.Fatalf("claims left %v, %v", m, err)
+	}
+	slot, release, err := e.ClaimSlot(pool)
+	if err != nil || slot != pool+"slot0" {
+		t.Fatalf("claim after release = %q, %v", slot, err)
+	}
+	release()
+}
+
+func TestClaimSlotCrash(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	crashed := newTestEtcd(t, Config{Endpoints: e.cfg.Endpoints, GrantTTL: time.Second})
+	const pool = "ion://test/crash/"
+	if err := e.PutStatic(pool+"only", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := crashed.ClaimSlot(pool); err != nil {
+		t.Fatal(err)
+	}
+	// stops renewing without revoking, as a dead process would
+	crashed.stop()
+	if _, _, err := e.ClaimSlot(pool); !errors.Is(err, ErrNoSlots) {
+		t.Fatalf("claim while held err = %v, want ErrNoSlots", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		slot, _, err := e.ClaimSlot(pool)
+		if err == nil && slot == pool+"only" {
+			return
+		}
+		if !errors.Is(err, ErrNoSlots) || time.Now().After(deadline) {
+			t.Fatalf("claim after crash = %q, %v", slot, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestClaimSlotReconnect(t *testing.T) {
+	e := newTestEtcd(t, Config{GrantTTL: time.Second})
+	const pool = "ion://test/reconnect/"
+	if err := e.PutStatic(pool+"only", ""); err != nil {
+		t.Fatal(err)
+	}
+	slot, release, err := e.ClaimSlot(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := dial(e.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.swapClient(cli, false)
+	// outlive the lease ttl a few times over on the new client
+	time.Sleep(3 * time.Second)
+	if _, err := e.get(claimKey(pool, slot)); err != nil {
+		t.Fatalf("claim after reconnect: %v", err)
+	}
+	if err := release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a claim whose lease is gone is dropped, not re-granted
+	if _, release, err = e.ClaimSlot(pool); err != nil {
+		t.Fatal(err)
+	}
+	e.liveKeyIDLock.RLock()
+	var id clientv3.LeaseID
+	for id = range e.claims {
+	}
+	e.liveKeyIDLock.RUnlock()
+	if _, err := e.cli().Revoke(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		e.liveKeyIDLock.RLock()
+		n := len(e.claims)
+		e.liveKeyIDLock.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lost claim still tracked")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := release(); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("release of a lost claim = %v, want ErrLeaseExpired", err)
+	}
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SRV services etcd members are published under, as for etcd --discovery-srv
+const (
+	etcdClientSRV    = "etcd-client"
+	etcdClientSSLSRV = "etcd-client-ssl"
+)
+
+// resolveEndpoints returns the members published under DiscoverySRV, https
+// ones from _etcd-client-ssl._tcp.<domain> and http ones from
+// _etcd-client._tcp.<domain>, sorted so lists compare
+func (c *Config) resolveEndpoints(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	var errs []error
+	for _, rec := range []struct{ service, scheme string }{
+		{etcdClientSSLSRV, "https"},
+		{etcdClientSRV, "http"},
+	} {
+		_, srvs, err := c.Resolver.LookupSRV(ctx, rec.service, "tcp", c.DiscoverySRV)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			seen[rec.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))] = true
+		}
+	}
+	if len(seen) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("etcd discovery %s: %w", c.DiscoverySRV, errors.Join(errs...))
+		}
+		return nil, fmt.Errorf("etcd discovery %s: no member in the _%s._tcp or _%s._tcp SRV records", c.DiscoverySRV, etcdClientSSLSRV, etcdClientSRV)
+	}
+	endpoints := make([]string, 0, len(seen))
+	for ep := range seen {
+		endpoints = append(endpoints, ep)
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// rediscover resolves DiscoverySRV again and makes the monitor probe the
+// members found from now on, it keeps the current ones when none is found
+func (e *Etcd) rediscover() {
+	ctx, cancel := e.opContext(e.ctx)
+	endpoints, err := e.cfg.resolveEndpoints(ctx)
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.rediscover %v", err)
+		return
+	}
+	if !equalStrings(endpoints, e.cfg.Endpoints) {
+		e.log().Infof("Etcd.rediscover members %v", endpoints)
+		e.cfg.Endpoints = endpoints
+	}
+}
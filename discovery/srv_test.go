@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// srvOf returns the SRV record of a host:port endpoint
+func srvOf(t *testing.T, endpoint string) *net.SRV {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.SRV{Target: host + ".", Port: uint16(p)}
+}
+
+func TestResolveEndpoints(t *testing.T) {
+	r := &stubResolver{records: map[string][]*net.SRV{}}
+	cfg := Config{DiscoverySRV: "ion.local", Resolver: r}
+	if _, err := cfg.resolveEndpoints(context.Background()); err == nil || !strings.Contains(err.Error(), "no member") {
+		t.Fatalf("resolve without records err = %v", err)
+	}
+	r.set("_etcd-client._tcp.ion.local", &net.SRV{Target: "b.ion.local.", Port: 2379}, &net.SRV{Target: "a.ion.local.", Port: 2379})
+	r.set("_etcd-client-ssl._tcp.ion.local", &net.SRV{Target: "c.ion.local.", Port: 2379})
+	got, err := cfg.resolveEndpoints(context.Background())
+	want := []string{"http://a.ion.local:2379", "http://b.ion.local:2379", "https://c.ion.local:2379"}
+	if err != nil || !equalStrings(got, want) {
+		t.Fatalf("resolve = %v, %v, want %v", got, err, want)
+	}
+	if err := (&Config{DiscoverySRV: "ion.local", Endpoints: want}).setDefaults(); err == nil {
+		t.Fatal("Endpoints and DiscoverySRV accepted together")
+	}
+}
+
+func TestDiscoverySRV(t *testing.T) {
+	_, first := startEtcd(t, nil)
+	r := &stubResolver{records: map[string][]*net.SRV{}}
+	r.set("_etcd-client._tcp.ion.local", srvOf(t, first))
+	e := newTestEtcd(t, Config{
+		DiscoverySRV:        "ion.local",
+		DiscoveryInterval:   100 * time.Millisecond,
+		Resolver:            r,
+		HealthCheckInterval: 100 * time.Millisecond,
+	})
+	if got := e.cli().Endpoints(); !equalStrings(got, []string{"http://" + first}) {
+		t.Fatalf("endpoints %v, want %v", got, first)
+	}
+	if err := e.keep("ion://test/srv", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second member published later is picked up
+	_, second := startEtcd(t, nil)
+	r.set("_etcd-client._tcp.ion.local", srvOf(t, first), srvOf(t, second))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(e.HealthyEndpoints()) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("healthy endpoints %v", e.HealthyEndpoints())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,251 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pion/ion/log"
+	"sigs.k8s.io/yaml"
+)
+
+// changes of the file within it are read once, an editor truncating then
+// writing it must not look like every node left
+const staticFileSettle = time.Millisecond * 100
+
+// staticFileContent is the layout of the file of a StaticFile
+type staticFileContent struct {
+	// Nodes are registered under ion://node/<name>/<id> like Register does
+	Nodes []ServiceNode `json:"nodes"`
+	// Keys are served as they are, e.g. settings read with Get
+	Keys map[string]string `json:"keys"`
+}
+
+// StaticFile is a read only Registry on a local YAML or JSON file, for
+// single host and air-gapped deployments that run no etcd. The file lists
+// nodes and plain keys:
+//
+//	nodes:
+//	  - id: sfu-1
+//	    name: sfu
+//	    addr: 10.0.0.1:5000
+//	keys:
+//	  ion://config/region: eu
+//
+// It is read again whenever it changes and watches get the difference. A
+// file that does not parse keeps the last content. Keep, Update and Del
+// return ErrReadOnly.
+type StaticFile struct {
+	path    string
+	watcher *fsnotify.Watcher
+
+	mu      sync.Mutex
+	kv      map[string]string
+	watches map[*staticWatch]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type staticWatch struct {
+	key    string
+	prefix bool
+	fn     WatchFunc
+}
+
+var _ Registry = (*StaticFile)(nil)
+
+// NewStaticFile loads path and watches it for changes
+func NewStaticFile(path string) (*StaticFile, error) {
+	kv, err := loadStaticFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// the directory, as editors replace the file rather than write it
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	s := &StaticFile{
+		path:    path,
+		watcher: w,
+		kv:      kv,
+		watches: make(map[*staticWatch]struct{}),
+		done:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.watchFile()
+	return s, nil
+}
+
+// loadStaticFile returns the keys of the file at path
+func loadStaticFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c staticFileContent
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("static registry %s: %w", path, err)
+	}
+	kv := make(map[string]string, len(c.Nodes)+len(c.Keys))
+	for k, v := range c.Keys {
+		kv[k] = v
+	}
+	for _, n := range c.Nodes {
+		if n.ID == "" || n.Name == "" {
+			return nil, fmt.Errorf("static registry %s: node %+v needs an id and a name", path, n)
+		}
+		k := serviceKey(n.Name, n.ID)
+		if _, dup := kv[k]; dup {
+			return nil, fmt.Errorf("static registry %s: %s listed twice", path, k)
+		}
+		v, err := n.marshal()
+		if err != nil {
+			return nil, err
+		}
+		kv[k] = v
+	}
+	return kv, nil
+}
+
+func (s *StaticFile) Keep(key, value string) error {
+	return ErrReadOnly
+}
+
+func (s *StaticFile) Update(key, value string) error {
+	return ErrReadOnly
+}
+
+func (s *StaticFile) Del(key string) error {
+	return ErrReadOnly
+}
+
+func (s *StaticFile) Get(key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.kv[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return v, nil
+}
+
+func (s *StaticFile) GetByPrefix(prefix string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return matching(s.kv, prefix, true), nil
+}
+
+// matching returns the keys of kv that are key, or under it with prefix
+func matching(kv map[string]string, key string, prefix bool) map[string]string {
+	m := make(map[string]string)
+	for k, v := range kv {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Watch calls fn with the changes of key, or of the keys under it with
+// prefix, each time the file is read again
+func (s *StaticFile) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	w := &staticWatch{key: key, prefix: prefix, fn: fn}
+	s.mu.Lock()
+	s.watches[w] = struct{}{}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.watches, w)
+		s.mu.Unlock()
+	}, nil
+}
+
+// watchFile reloads the file once its changes settled
+func (s *StaticFile) watchFile() {
+	defer s.wg.Done()
+	name := filepath.Clean(s.path)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-s.done:
+			return
+		case ev, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) == name {
+				settle = time.After(staticFileSettle)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("StaticFile.watch %s %v", s.path, err)
+		case <-settle:
+			settle = nil
+			s.reload()
+		}
+	}
+}
+
+// reload reads the file again and hands the difference to every watch
+func (s *StaticFile) reload() {
+	kv, err := loadStaticFile(s.path)
+	if err != nil {
+		log.Errorf("StaticFile.reload %v, keeping the last content", err)
+		return
+	}
+	s.mu.Lock()
+	prev := s.kv
+	s.kv = kv
+	watches := make([]*staticWatch, 0, len(s.watches))
+	for w := range s.watches {
+		watches = append(watches, w)
+	}
+	s.mu.Unlock()
+	for _, w := range watches {
+		w := w
+		diffValues(matching(prev, w.key, w.prefix), matching(kv, w.key, w.prefix), func(typ EventType, key, value string) {
+			// stopped since the watches were copied, e.g. by an earlier fn
+			if s.watching(w) {
+				w.fn(typ, key, value)
+			}
+		})
+	}
+}
+
+// watching reports whether w was not stopped yet
+func (s *StaticFile) watching(w *staticWatch) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.watches[w]
+	return ok
+}
+
+// Close stops watching the file, calls after the first return nil
+func (s *StaticFile) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.watcher.Close()
+		s.wg.Wait()
+	})
+	return err
+}
@@ -0,0 +1,153 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ion-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+nodes:
+  - id: sfu-1
+    name: sfu
+    addr: 10.0.0.1:5000
+  - id: sfu-2
+    name: sfu
+    addr: 10.0.0.2:5000
+keys:
+  ion://config/region: eu
+`)
+	s, err := NewStaticFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, err := s.Get("ion://config/region"); err != nil || v != "eu" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	prefix := Join("node", "sfu").Prefix()
+	m, err := s.GetByPrefix(prefix)
+	if err != nil || len(m) != 2 {
+		t.Fatalf("GetByPrefix = %v, %v", m, err)
+	}
+	n, err := unmarshalServiceNode(m[serviceKey("sfu", "sfu-1")])
+	if err != nil || n.Addr != "10.0.0.1:5000" {
+		t.Fatalf("node %+v, %v", n, err)
+	}
+	if err := s.Keep("k", "v"); err != ErrReadOnly {
+		t.Fatalf("Keep err = %v, want ErrReadOnly", err)
+	}
+
+	fn, events := collectEvents()
+	stop, err := s.Watch(prefix, true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// sfu-1 moves, sfu-2 leaves and sfu-3 joins; JSON is YAML too
+	write(`{"nodes": [
+		{"id": "sfu-1", "name": "sfu", "addr": "10.0.0.9:5000"},
+		{"id": "sfu-3", "name": "sfu", "addr": "10.0.0.3:5000"}
+	]}`)
+	got := make(map[string]EventType)
+	for len(got) < 3 {
+		select {
+		case ev := <-events:
+			got[ev.key] = ev.typ
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events %v, want three", got)
+		}
+	}
+	want := map[string]EventType{
+		serviceKey("sfu", "sfu-1"): EventPut,
+		serviceKey("sfu", "sfu-2"): EventDelete,
+		serviceKey("sfu", "sfu-3"): EventPut,
+	}
+	for k, typ := range want {
+		if got[k] != typ {
+			t.Fatalf("events %v, want %v", got, want)
+		}
+	}
+	if _, err := s.Get("ion://config/region"); err != ErrKeyNotFound {
+		t.Fatalf("removed key err = %v", err)
+	}
+
+	// a broken file keeps the last content
+	write("nodes: [")
+	time.Sleep(3 * staticFileSettle)
+	if m, err := s.GetByPrefix(prefix); err != nil || len(m) != 2 {
+		t.Fatalf("after a broken write GetByPrefix = %v, %v", m, err)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("event %+v after a broken write", ev)
+	default:
+	}
+}
+
+func TestStaticFileStoppedWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ion-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.yaml")
+	if err := ioutil.WriteFile(path, []byte("keys: {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStaticFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close = %v", err)
+	}
+
+	// the first watch called stops all others, none of them may fire after
+	var stops []func()
+	stopped := false
+	first := true
+	for i := 0; i < 10; i++ {
+		stop, err := s.Watch("ion://config/", true, func(EventType, string, string) {
+			if stopped {
+				t.Fatal("stopped watch called")
+			}
+			if first {
+				first = false
+				for _, stop := range stops {
+					stop()
+				}
+				stopped = true
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stops = append(stops, stop)
+	}
+	if err := ioutil.WriteFile(path, []byte("keys: {ion://config/region: eu}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.reload()
+	if first {
+		t.Fatal("no watch called")
+	}
+}
@@ -0,0 +1,280 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultSubscribeBuffer = 64
+
+// how long a stopped subscription waits for its reader to take the events
+// already received and the EventStopped, a var for tests
+var subscribeFlushTimeout = time.Second
+
+// Event is a change delivered on the channel of Subscribe, Value is empty
+// on EventDelete and Bytes holds the same value for binary payloads such as
+// those of putBytes. Err is only set, to ErrOverflow, on the last event of a
+// subscription closed by OverflowError, its other fields are then empty.
+//
+// Seq numbers the events of a subscription from 1 without a gap, an event
+// dropped by its OverflowPolicy leaves one. An EventResync restarts it at
+// 1, the keys read afresh follow from 2. Together with Revision it tells a
+// reader fanning events out to workers the order they were sent in.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    string
+	Bytes    []byte
+	Revision int64
+	Seq      uint64
+	Err      error
+}
+
+// OverflowPolicy is what a subscription does with an event once its buffer
+// is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the reader, so no event is ever lost. The
+	// watch stalls meanwhile and a slow reader shows as a growing watch
+	// event lag; events pile up in the etcd client until it reads again.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest evicts the oldest buffered event to make room
+	OverflowDropOldest
+	// OverflowDropNewest drops the event that does not fit
+	OverflowDropNewest
+	// OverflowError ends the subscription with an event carrying
+	// ErrOverflow after the buffered ones
+	OverflowError
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// SubscribeOptions tune one subscription
+type SubscribeOptions struct {
+	// Buffer is how many events the channel holds, SubscribeBuffer when 0
+	Buffer int
+	// Overflow applies once the channel is full, dropped events are counted
+	// by subscribe_dropped_events_total
+	Overflow OverflowPolicy
+	// Progress delivers an EventProgress with the revision the watch reached
+	// whenever etcd sends a progress notification, every 10 minutes of a
+	// quiet watch by default, so a reader can tell an idle watch from a
+	// stuck one and resume after that revision
+	Progress bool
+	// Dedup drops a put of the value last delivered for its key, see Dedup
+	// for Watch; the first value of a key is always delivered
+	Dedup bool
+}
+
+// Subscribe is Watch on prefix delivering the events on a channel, in
+// revision order whatever WatchWorkers. The channel holds SubscribeBuffer
+// events; once it is full the watch waits for the reader, so no event is
+// ever dropped, see SubscribeWithOptions for the other OverflowPolicy. A
+// watch that cannot resume sends EventResync and the current keys.
+//
+// Cancel, or the close of the Etcd, stops reading etcd but not the events
+// already received from it: they are still sent, in order, then the channel
+// ends with an EventStopped. Its Revision is the last one of which every
+// event was sent, so a new watch after it misses nothing, though it may
+// repeat events sent after it; events an OverflowPolicy other than
+// OverflowBlock dropped before are not accounted. Sending waits for the
+// reader up to a second after the stop, then drops the events left, and the
+// oldest ones still on the channel if EventStopped needs their room. A
+// subscription ended by ErrOverflow sends no EventStopped.
+func (e *Etcd) Subscribe(prefix string) (events <-chan Event, cancel func(), err error) {
+	_, events, cancel, err = e.SubscribeWithID(prefix)
+	return events, cancel, err
+}
+
+// SubscribeWithID is Subscribe also returning the id of its watch, see
+// WatchWithID
+func (e *Etcd) SubscribeWithID(prefix string) (id string, events <-chan Event, cancel func(), err error) {
+	return e.SubscribeWithOptions(prefix, SubscribeOptions{})
+}
+
+// SubscribeWithOptions is SubscribeWithID with opts
+func (e *Etcd) SubscribeWithOptions(prefix string, opts SubscribeOptions) (id string, events <-chan Event, cancel func(), err error) {
+	if opts.Buffer == 0 {
+		opts.Buffer = e.cfg.SubscribeBuffer
+	}
+	if opts.Buffer < 0 {
+		return "", nil, nil, fmt.Errorf("negative subscribe buffer %d", opts.Buffer)
+	}
+	if opts.Overflow < OverflowBlock || opts.Overflow > OverflowError {
+		return "", nil, nil, fmt.Errorf("unknown overflow policy %d", opts.Overflow)
+	}
+	defer observe(opWatch, time.Now(), &err)
+	_, span := e.span(e.ctx, "watch", prefix)
+	defer endSpan(span, &err)
+	_, rev, err := e.snapshot(prefix, true, true)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	id, events, cancel = e.subscribeFromRev(prefix, rev, opts)
+	return id, events, cancel, nil
+}
+
+// subscribeFromRev delivers the changes after revision rev on a channel,
+// opts must be valid and have a Buffer
+func (e *Etcd) subscribeFromRev(prefix string, rev int64, opts SubscribeOptions) (id string, events <-chan Event, cancel func()) {
+	id = newWatchID()
+	ctx, cancel := context.WithCancel(e.ctx)
+	capacity := opts.Buffer
+	if opts.Overflow == OverflowError {
+		// room for the ErrOverflow event whatever the reader does
+		capacity++
+	}
+	ch := make(chan Event, capacity)
+	dropped := droppedEvents.WithLabelValues(id)
+	var seen *dedup
+	if opts.Dedup {
+		seen = newDedup()
+	}
+	// the rest is only used by the watch goroutine
+	var seq uint64
+	// sentRev is the revision of the last event on ch, lostRev that of the
+	// first one the flush dropped
+	var sentRev, lostRev int64
+	overflowed := false
+	flushTimeout := subscribeFlushTimeout
+	var flushCtx context.Context
+	flushCancel := func() {}
+	// flush hands ev to the reader within flushTimeout of the stop
+	flush := func(ev Event) bool {
+		if flushCtx == nil {
+			flushCtx, flushCancel = context.WithTimeout(context.Background(), flushTimeout)
+		}
+		select {
+		case ch <- ev:
+			return true
+		default:
+		}
+		select {
+		case ch <- ev:
+			return true
+		case <-flushCtx.Done():
+			return false
+		}
+	}
+	put := func(ev Event) bool {
+		switch opts.Overflow {
+		case OverflowBlock:
+			select {
+			case ch <- ev:
+				return true
+			case <-ctx.Done():
+				return flush(ev)
+			}
+		case OverflowDropOldest:
+			// the only sender, so a slot freed here cannot be taken by another
+			for {
+				select {
+				case ch <- ev:
+					return true
+				default:
+				}
+				select {
+				case <-ch:
+					dropped.Inc()
+				default:
+				}
+			}
+		case OverflowDropNewest:
+			select {
+			case ch <- ev:
+				return true
+			default:
+				dropped.Inc()
+			}
+		case OverflowError:
+			if overflowed {
+				return false
+			}
+			if ctx.Err() != nil {
+				return flush(ev)
+			}
+			if len(ch) < opts.Buffer {
+				ch <- ev
+				return true
+			}
+			e.log().Errorf("Etcd.Subscribe %s %s buffer of %d full, closing", id, prefix, opts.Buffer)
+			dropped.Inc()
+			ch <- Event{Err: ErrOverflow}
+			overflowed = true
+			cancel()
+		}
+		return false
+	}
+	send := func(ev Event) {
+		seq++
+		ev.Seq = seq
+		if lostRev != 0 {
+			// nothing after an event the flush dropped, so the events up to
+			// sentRev stay all sent
+			return
+		}
+		if put(ev) {
+			sentRev = ev.Revision
+		} else if flushCtx != nil {
+			lostRev = ev.Revision
+		}
+	}
+	deliver := e.timed(id, func(rev int64, eventType EventType, key, value string) {
+		if seen != nil && !seen.fresh(eventType, key, value) {
+			return
+		}
+		ev := Event{Type: eventType, Key: key, Value: value, Revision: rev}
+		if eventType == EventPut {
+			ev.Bytes = []byte(value)
+		}
+		send(ev)
+	})
+	resynced := func(rev int64) {
+		seq = 0
+		if seen != nil {
+			// the keys read afresh are all delivered
+			seen = newDedup()
+		}
+		send(Event{Type: EventResync, Revision: rev})
+	}
+	onClose := func() {
+		defer flushCancel()
+		if !overflowed {
+			stopped := sentRev
+			if lostRev != 0 && lostRev <= stopped {
+				// the revision was only partly sent
+				stopped = lostRev - 1
+			}
+			seq++
+			for !flush(Event{Type: EventStopped, Revision: stopped, Seq: seq}) {
+				// the reader is gone, make room with the oldest event
+				select {
+				case old := <-ch:
+					dropped.Inc()
+					if old.Revision-1 < stopped {
+						stopped = old.Revision - 1
+					}
+				default:
+				}
+			}
+		}
+		droppedEvents.DeleteLabelValues(id)
+		close(ch)
+	}
+	e.startWatch(ctx, prefix, true, rev, deliver, watchHooks{id: id, onClose: onClose, progress: opts.Progress, resynced: resynced})
+	return id, ch, cancel
+}
@@ -0,0 +1,355 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/etcdserver/api/v3rpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSubscribe(t *testing.T) {
+	e := newTestEtcd(t, Config{SubscribeBuffer: 2, WatchWorkers: 4})
+	events, cancel, err := e.Subscribe("ion://test/sub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []Event
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("ion://test/sub/%d", i%3)
+		if i%4 == 3 {
+			if err := e.del(key); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, Event{Type: EventDelete, Key: key})
+			continue
+		}
+		value := fmt.Sprint(i)
+		if err := e.keep(key, value); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, Event{Type: EventPut, Key: key, Value: value})
+	}
+
+	// the puts outran the buffer, every event still comes in order
+	var rev int64
+	for _, w := range want {
+		select {
+		case got := <-events:
+			if got.Type != w.Type || got.Key != w.Key || got.Value != w.Value || got.Revision <= rev {
+				t.Fatalf("event %+v after revision %d, want %+v", got, rev, w)
+			}
+			rev = got.Revision
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event, want %+v", w)
+		}
+	}
+
+	cancel()
+	select {
+	case ev := <-events:
+		if ev.Type != EventStopped || ev.Revision != rev {
+			t.Fatalf("event after cancel %+v, want EventStopped at %d", ev, rev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no EventStopped after cancel")
+	}
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Fatalf("event after EventStopped %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	// each test puts six values of one key while nothing reads a buffer of two
+	saturate := func(t *testing.T, policy OverflowPolicy) (string, <-chan Event) {
+		prefix := "ion://test/overflow/" + policy.String() + "/"
+		id, events, cancel, err := e.SubscribeWithOptions(prefix, SubscribeOptions{Buffer: 2, Overflow: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cancel)
+		for i := 0; i < 6; i++ {
+			if err := e.PutStatic(prefix+"k", fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id, events
+	}
+	waitDropped := func(t *testing.T, id string, want float64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(droppedEvents.WithLabelValues(id)) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v events dropped, want %v", testutil.ToFloat64(droppedEvents.WithLabelValues(id)), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	next := func(t *testing.T, events <-chan Event) Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+	values := func(t *testing.T, events <-chan Event, want ...string) {
+		for _, w := range want {
+			if ev := next(t, events); ev.Value != w || ev.Err != nil {
+				t.Fatalf("event %+v, want value %s", ev, w)
+			}
+		}
+	}
+
+	t.Run("block", func(t *testing.T) {
+		id, events := saturate(t, OverflowBlock)
+		values(t, events, "0", "1", "2", "3", "4", "5")
+		if n := testutil.ToFloat64(droppedEvents.WithLabelValues(id)); n != 0 {
+			t.Fatalf("%v events dropped", n)
+		}
+	})
+	t.Run("drop oldest", func(t *testing.T) {
+		id, events := saturate(t, OverflowDropOldest)
+		waitDropped(t, id, 4)
+		values(t, events, "4", "5")
+	})
+	t.Run("drop newest", func(t *testing.T) {
+		id, events := saturate(t, OverflowDropNewest)
+		waitDropped(t, id, 4)
+		values(t, events, "0", "1")
+	})
+	t.Run("error", func(t *testing.T) {
+		_, events := saturate(t, OverflowError)
+		time.Sleep(200 * time.Millisecond)
+		values(t, events, "0", "1")
+		if ev := next(t, events); !errors.Is(ev.Err, ErrOverflow) || ev.Key != "" {
+			t.Fatalf("event %+v, want ErrOverflow", ev)
+		}
+		select {
+		case ev, ok := <-events:
+			if ok {
+				t.Fatalf("event %+v after ErrOverflow", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not closed after ErrOverflow")
+		}
+	})
+
+	if _, _, _, err := e.SubscribeWithOptions("ion://test/overflow/", SubscribeOptions{Overflow: OverflowError + 1}); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+func TestSubscribeProgress(t *testing.T) {
+	interval := v3rpc.GetProgressReportInterval()
+	v3rpc.SetProgressReportInterval(200 * time.Millisecond)
+	t.Cleanup(func() { v3rpc.SetProgressReportInterval(interval) })
+	e := newTestEtcd(t, Config{})
+	_, events, cancel, err := e.SubscribeWithOptions("ion://test/progress/idle/", SubscribeOptions{Progress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	_, quiet, cancelQuiet, err := e.SubscribeWithID("ion://test/progress/idle/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelQuiet()
+
+	// the store moves on outside the watched prefix only
+	var rev int64
+	for i := 0; i < 3; i++ {
+		if err := e.PutStatic("ion://test/progress/busy", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+		// a notification sent before the put may still repeat rev
+		for advanced := false; !advanced; {
+			select {
+			case ev := <-events:
+				if ev.Type != EventProgress || ev.Key != "" || ev.Revision < rev {
+					t.Fatalf("event %+v after revision %d, want progress", ev, rev)
+				}
+				advanced, rev = ev.Revision > rev, ev.Revision
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no progress notification past revision %d", rev)
+			}
+		}
+	}
+	select {
+	case ev := <-quiet:
+		t.Fatalf("event %+v without Progress", ev)
+	default:
+	}
+}
+
+func TestSubscribeSeq(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	prefix := "ion://test/seq/"
+	next := func(events <-chan Event) Event {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	_, events, cancel, err := e.SubscribeWithOptions(prefix, SubscribeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		if err := e.keep(prefix+fmt.Sprint(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for want := uint64(1); want <= 5; want++ {
+		if ev := next(events); ev.Seq != want {
+			t.Fatalf("event %+v, want seq %d", ev, want)
+		}
+	}
+
+	// a subscription resuming from a compacted revision
+	_, rev, err := e.snapshot(prefix, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.update(prefix+"0", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.cli().Compact(context.Background(), rev+1); err != nil {
+		t.Fatal(err)
+	}
+	_, events, cancel = e.subscribeFromRev(prefix, rev-1, SubscribeOptions{Buffer: 16, Dedup: true})
+	defer cancel()
+	marker := next(events)
+	if marker.Type != EventResync || marker.Seq != 1 || marker.Revision < rev+1 {
+		t.Fatalf("first event %+v, want the resync marker", marker)
+	}
+	keys := make(map[string]string)
+	for want := uint64(2); want <= 6; want++ {
+		ev := next(events)
+		if ev.Type != EventPut || ev.Seq != want || ev.Revision != marker.Revision {
+			t.Fatalf("event %+v after the marker, want a put at seq %d", ev, want)
+		}
+		keys[ev.Key] = ev.Value
+	}
+	if len(keys) != 5 || keys[prefix+"0"] != "w" {
+		t.Fatalf("keys after resync %v", keys)
+	}
+	if err := e.del(prefix + "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(events); ev.Type != EventDelete || ev.Seq != 7 {
+		t.Fatalf("event %+v, want a delete at seq 7", ev)
+	}
+}
+
+func TestSubscribeFlush(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	// burst puts single keys then ten keys in one revision, all before the
+	// subscription reads any of them
+	burst := func(t *testing.T, prefix string) int64 {
+		_, rev, err := e.snapshot(prefix, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			if err := e.PutStatic(fmt.Sprintf("%s%d", prefix, i), "v"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		kv := make(map[string]string)
+		for i := 5; i < 15; i++ {
+			kv[fmt.Sprintf("%s%d", prefix, i)] = "v"
+		}
+		if err := e.PutAll(context.Background(), kv); err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+	full := func(t *testing.T, events <-chan Event) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(events) < cap(events) {
+			if time.Now().After(deadline) {
+				t.Fatal("buffer never filled")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	drain := func(t *testing.T, events <-chan Event) []Event {
+		var got []Event
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return got
+				}
+				got = append(got, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("channel not closed after %v", got)
+			}
+		}
+	}
+
+	t.Run("reader drains", func(t *testing.T) {
+		prefix := "ion://test/flush/drain/"
+		rev := burst(t, prefix)
+		_, events, cancel := e.subscribeFromRev(prefix, rev, SubscribeOptions{Buffer: 2})
+		full(t, events)
+		cancel()
+		got := drain(t, events)
+		// the events received before cancel are all sent, more than the buffer
+		if len(got) < 4 {
+			t.Fatalf("%d events after cancel, want the buffer and more", len(got))
+		}
+		for i, ev := range got {
+			if ev.Seq != uint64(i+1) {
+				t.Fatalf("event %d %+v out of sequence", i, ev)
+			}
+		}
+		last, stopped := got[len(got)-2], got[len(got)-1]
+		if stopped.Type != EventStopped || stopped.Revision != last.Revision {
+			t.Fatalf("last event %+v, want EventStopped at revision %d", stopped, last.Revision)
+		}
+	})
+	t.Run("reader gone", func(t *testing.T) {
+		defer func(d time.Duration) { subscribeFlushTimeout = d }(subscribeFlushTimeout)
+		subscribeFlushTimeout = 100 * time.Millisecond
+		prefix := "ion://test/flush/gone/"
+		rev := burst(t, prefix)
+		_, events, cancel := e.subscribeFromRev(prefix, rev, SubscribeOptions{Buffer: 2})
+		full(t, events)
+		cancel()
+		time.Sleep(4 * subscribeFlushTimeout)
+		got := drain(t, events)
+		// the oldest event made room for EventStopped
+		if len(got) != 2 || got[0].Seq != 2 || got[1].Type != EventStopped || got[1].Revision != rev {
+			t.Fatalf("events %+v, want the second one and EventStopped at %d", got, rev)
+		}
+
+		// a subscription after the revision stopped at misses nothing
+		_, events, cancel = e.subscribeFromRev(prefix, got[1].Revision, SubscribeOptions{Buffer: 16})
+		defer cancel()
+		keys := make(map[string]bool)
+		for len(keys) < 15 {
+			select {
+			case ev := <-events:
+				keys[ev.Key] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("resumed with %d of 15 keys", len(keys))
+			}
+		}
+	})
+}
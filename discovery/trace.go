@@ -0,0 +1,36 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/pion/ion/discovery"
+
+// span starts a child of the span in ctx for op on key, ended by endSpan
+func (e *Etcd) span(ctx context.Context, op, key string) (context.Context, trace.Span) {
+	tp := e.cfg.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName).Start(ctx, "discovery."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("discovery.op", op),
+			attribute.String("discovery.key", key),
+		))
+}
+
+// endSpan is deferred with a pointer to the op's error, a missing key is
+// not an error
+func endSpan(span trace.Span, err *error) {
+	if *err != nil && !errors.Is(*err, ErrKeyNotFound) {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
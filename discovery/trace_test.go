@@ -0,0 +1,73 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	e := newTestEtcd(t, Config{TracerProvider: tp})
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "signal")
+	e.keepCtx(ctx, "ion://test/trace/a", "v")
+	e.getCtx(ctx, "ion://test/trace/missing")
+	e.getByPrefixCtx(ctx, "ion://test/trace/")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	e.delCtx(canceled, "ion://test/trace/a")
+	parent.End()
+
+	spans := rec.Ended()
+	want := []struct {
+		name, key string
+		failed    bool
+	}{
+		{"discovery.keep", "ion://test/trace/a", false},
+		{"discovery.get", "ion://test/trace/missing", false},
+		{"discovery.getByPrefix", "ion://test/trace/", false},
+		{"discovery.del", "ion://test/trace/a", true},
+	}
+	if len(spans) != len(want)+1 {
+		t.Fatalf("%d spans ended, want %d", len(spans), len(want)+1)
+	}
+	for i, w := range want {
+		s := spans[i]
+		if s.Name() != w.name {
+			t.Fatalf("span %d = %s, want %s", i, s.Name(), w.name)
+		}
+		if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("%s is not a child of the caller span", s.Name())
+		}
+		var key string
+		for _, a := range s.Attributes() {
+			if a.Key == attribute.Key("discovery.key") {
+				key = a.Value.AsString()
+			}
+		}
+		if key != w.key {
+			t.Fatalf("%s key = %q, want %q", s.Name(), key, w.key)
+		}
+		if failed := s.Status().Code == codes.Error; failed != w.failed {
+			t.Fatalf("%s status %v", s.Name(), s.Status())
+		}
+	}
+}
+
+func TestEndSpanWrappedNotFound(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	_, span := tp.Tracer("test").Start(context.Background(), "discovery.get")
+	err := fmt.Errorf("get ion://test/trace/missing: %w", ErrKeyNotFound)
+	endSpan(span, &err)
+	if s := rec.Ended()[0]; s.Status().Code == codes.Error {
+		t.Fatalf("status %v for a missing key", s.Status())
+	}
+}
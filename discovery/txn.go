@@ -0,0 +1,275 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// CompareAndSwap puts value only if key currently holds expected, it
+// returns false without error when the stored value did not match. A key
+// kept by this instance stays on its lease.
+func (e *Etcd) CompareAndSwap(key, expected, value string) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	if err := e.checkValue(key, value); err != nil {
+		return false, err
+	}
+	var opts []clientv3.OpOption
+	e.liveKeyIDLock.RLock()
+	if lk, ok := e.liveKeyID[key]; ok {
+		opts = append(opts, clientv3.WithLease(lk.lease.id))
+	}
+	e.liveKeyIDLock.RUnlock()
+
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", e.encodeValue(expected))).
+		Then(clientv3.OpPut(key, e.encodeValue(value), opts...)).
+		Commit()
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.CompareAndSwap %s %v", key, err)
+		return false, etcdError(err)
+	}
+	if resp.Succeeded {
+		e.liveKeyIDLock.Lock()
+		if lk, ok := e.liveKeyID[key]; ok {
+			lk.value = value
+		}
+		e.liveKeyIDLock.Unlock()
+	}
+	return resp.Succeeded, nil
+}
+
+// CompareAndDelete deletes key only if it currently holds expected
+func (e *Etcd) CompareAndDelete(key, expected string) (bool, error) {
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	ctx, cancel := e.opContext(context.Background())
+	resp, err := e.cli().Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", e.encodeValue(expected))).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	cancel()
+	if err != nil {
+		e.log().Errorf("Etcd.CompareAndDelete %s %v", key, err)
+		return false, etcdError(err)
+	}
+	if resp.Succeeded {
+		e.dropPending(key)
+		e.liveKeyIDLock.Lock()
+		e.untrack(key)
+		e.liveKeyIDLock.Unlock()
+	}
+	return resp.Succeeded, nil
+}
+
+// DeleteIf removes a key this node registered only if it still holds
+// expected, the node's own identity, so a slow shutdown cannot delete the
+// key of a replacement that took over the same slot. The key is no longer
+// kept by this instance either way, false means it was left to its new owner.
+func (e *Etcd) DeleteIf(key, expected string) (bool, error) {
+	ok, err := e.CompareAndDelete(key, expected)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		e.dropPending(key)
+		e.liveKeyIDLock.Lock()
+		e.untrack(key)
+		e.liveKeyIDLock.Unlock()
+	}
+	return ok, nil
+}
+
+// Cmp is a condition of a Txn
+type Cmp struct {
+	// cmp is built on Commit, a value compares encoded like the Etcd stores it
+	cmp func(e *Etcd) clientv3.Cmp
+}
+
+// ValueEquals holds when key exists with value
+func ValueEquals(key, value string) Cmp {
+	return Cmp{func(e *Etcd) clientv3.Cmp {
+		return clientv3.Compare(clientv3.Value(key), "=", e.encodeValue(value))
+	}}
+}
+
+// KeyMissing holds when key does not exist
+func KeyMissing(key string) Cmp {
+	return Cmp{func(*Etcd) clientv3.Cmp {
+		return clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	}}
+}
+
+// KeyExists holds when key exists, whatever its value
+func KeyExists(key string) Cmp {
+	return Cmp{func(*Etcd) clientv3.Cmp {
+		return clientv3.Compare(clientv3.CreateRevision(key), ">", 0)
+	}}
+}
+
+// ModRevisionEquals holds when key was last modified at rev
+func ModRevisionEquals(key string, rev int64) Cmp {
+	return Cmp{func(*Etcd) clientv3.Cmp {
+		return clientv3.Compare(clientv3.ModRevision(key), "=", rev)
+	}}
+}
+
+type opKind int
+
+const (
+	opKindPut opKind = iota
+	opKindPutStatic
+	opKindDelete
+)
+
+// Op is an operation of a Txn
+type Op struct {
+	kind       opKind
+	key, value string
+}
+
+// OpPut keeps key alive like keep once the transaction ran
+func OpPut(key, value string) Op { return Op{opKindPut, key, value} }
+
+// OpPutStatic puts key without a lease
+func OpPutStatic(key, value string) Op { return Op{opKindPutStatic, key, value} }
+
+func OpDelete(key string) Op { return Op{kind: opKindDelete, key: key} }
+
+// Txn runs Then when every If condition holds and Else otherwise, all in one
+// atomic step. Built with Etcd.Txn, it is not safe for concurrent use.
+type Txn struct {
+	etcd      *Etcd
+	cmps      []Cmp
+	then, els []Op
+}
+
+func (e *Etcd) Txn() *Txn {
+	return &Txn{etcd: e}
+}
+
+func (t *Txn) If(cmps ...Cmp) *Txn {
+	t.cmps = append(t.cmps, cmps...)
+	return t
+}
+
+func (t *Txn) Then(ops ...Op) *Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *Txn) Else(ops ...Op) *Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+// Commit runs the transaction and reports whether Then ran. The leased puts
+// of the branch that ran share one new lease, kept alive and tracked like
+// the keys of PutAll.
+func (t *Txn) Commit(ctx context.Context) (bool, error) {
+	e := t.etcd
+	if err := e.writable(); err != nil {
+		return false, err
+	}
+	for _, ops := range [][]Op{t.then, t.els} {
+		for _, op := range ops {
+			if op.kind == opKindDelete {
+				continue
+			}
+			if err := e.checkValue(op.key, op.value); err != nil {
+				return false, err
+			}
+		}
+	}
+	var id clientv3.LeaseID
+	if hasLeasedPut(t.then) || hasLeasedPut(t.els) {
+		if err := e.leaseRoom(); err != nil {
+			return false, err
+		}
+		opCtx, cancel := e.opContext(ctx)
+		resp, err := e.cli().Grant(opCtx, e.grantTTL())
+		cancel()
+		if err != nil {
+			return false, etcdError(err)
+		}
+		id = resp.ID
+	}
+	cmps := make([]clientv3.Cmp, len(t.cmps))
+	for i, c := range t.cmps {
+		cmps[i] = c.cmp(e)
+	}
+	opCtx, cancel := e.opContext(ctx)
+	resp, err := e.cli().Txn(opCtx).If(cmps...).Then(e.txnOps(t.then, id)...).Else(e.txnOps(t.els, id)...).Commit()
+	cancel()
+	if err != nil {
+		if id != 0 {
+			e.revokeLease(id)
+		}
+		e.log().Errorf("Etcd.Txn %v", err)
+		return false, etcdError(err)
+	}
+	ran := t.els
+	if resp.Succeeded {
+		ran = t.then
+	}
+	// a pending update would overwrite what the transaction wrote
+	for _, op := range ran {
+		e.dropPending(op.key)
+	}
+	if !hasLeasedPut(ran) {
+		if id != 0 {
+			e.revokeLease(id)
+		}
+		e.liveKeyIDLock.Lock()
+		for _, op := range ran {
+			e.untrack(op.key)
+		}
+		e.liveKeyIDLock.Unlock()
+		return resp.Succeeded, nil
+	}
+	l, err := e.keepAlive(id, e.grantTTL())
+	if err != nil {
+		// the transaction is applied, its keys expire with the lease
+		e.log().Errorf("Etcd.Txn keepalive lease=%x %v", id, err)
+		return resp.Succeeded, err
+	}
+	e.liveKeyIDLock.Lock()
+	for _, op := range ran {
+		if op.kind == opKindPut {
+			e.track(op.key, op.value, l)
+		} else {
+			e.untrack(op.key)
+		}
+	}
+	e.liveKeyIDLock.Unlock()
+	return resp.Succeeded, nil
+}
+
+func hasLeasedPut(ops []Op) bool {
+	for _, op := range ops {
+		if op.kind == opKindPut {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Etcd) txnOps(ops []Op, id clientv3.LeaseID) []clientv3.Op {
+	r := make([]clientv3.Op, len(ops))
+	for i, op := range ops {
+		switch op.kind {
+		case opKindPut:
+			r[i] = clientv3.OpPut(op.key, e.encodeValue(op.value), clientv3.WithLease(id))
+		case opKindPutStatic:
+			r[i] = clientv3.OpPut(op.key, e.encodeValue(op.value))
+		case opKindDelete:
+			r[i] = clientv3.OpDelete(op.key)
+		}
+	}
+	return r
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/cas"
+	e.keep(key, "0")
+
+	var wins int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := e.CompareAndSwap(key, "0", fmt.Sprint(i+1))
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Fatalf("%d swaps won, want 1", wins)
+	}
+	if ok, _ := e.CompareAndSwap(key, "0", "x"); ok {
+		t.Fatal("swap with stale expected value succeeded")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	key := "ion://test/cad"
+	e.keep(key, "a")
+	if ok, err := e.CompareAndDelete(key, "b"); ok || err != nil {
+		t.Fatalf("mismatched delete = %v, %v", ok, err)
+	}
+	if ok, err := e.CompareAndDelete(key, "a"); !ok || err != nil {
+		t.Fatalf("matched delete = %v, %v", ok, err)
+	}
+	if _, err := e.get(key); err != ErrKeyNotFound {
+		t.Fatalf("get after delete err = %v", err)
+	}
+}
+
+func TestDeleteIf(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	old := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	replacement := newTestEtcd(t, Config{Endpoints: []string{ep}})
+	key := "ion://test/deleteif/slot"
+	old.keep(key, "node-a")
+	replacement.keep(key, "node-b")
+
+	if ok, err := old.DeleteIf(key, "node-a"); ok || err != nil {
+		t.Fatalf("stale DeleteIf = %v, %v", ok, err)
+	}
+	// closing the old node must not take the key of the replacement along
+	old.close()
+	if v, err := replacement.get(key); err != nil || v != "node-b" {
+		t.Fatalf("replacement key = %q, %v", v, err)
+	}
+	if ok, err := replacement.DeleteIf(key, "node-b"); !ok || err != nil {
+		t.Fatalf("own DeleteIf = %v, %v", ok, err)
+	}
+	if _, err := replacement.get(key); err != ErrKeyNotFound {
+		t.Fatalf("key after DeleteIf err = %v", err)
+	}
+}
+
+func TestTxnMove(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	from, to := "ion://test/txn/a/stream1", "ion://test/txn/b/stream1"
+	move := func() (bool, error) {
+		return e.Txn().
+			If(ValueEquals(from, "s"), KeyMissing(to)).
+			Then(OpDelete(from), OpPut(to, "s")).
+			Commit(context.Background())
+	}
+	tracked := func(key string) bool {
+		e.liveKeyIDLock.RLock()
+		defer e.liveKeyIDLock.RUnlock()
+		_, ok := e.liveKeyID[key]
+		return ok
+	}
+
+	// b already holds the stream, nothing changes
+	e.keep(from, "s")
+	e.cli().Put(context.Background(), to, "other")
+	if ok, err := move(); ok || err != nil {
+		t.Fatalf("conflicting move = %v, %v", ok, err)
+	}
+	if v, _ := e.get(from); v != "s" || !tracked(from) {
+		t.Fatalf("source after rollback %q tracked=%v", v, tracked(from))
+	}
+	if v, _ := e.get(to); v != "other" || tracked(to) {
+		t.Fatalf("target after rollback %q", v)
+	}
+
+	e.cli().Delete(context.Background(), to)
+	if ok, err := move(); !ok || err != nil {
+		t.Fatalf("move = %v, %v", ok, err)
+	}
+	if _, err := e.get(from); err != ErrKeyNotFound || tracked(from) {
+		t.Fatalf("source after move err = %v tracked=%v", err, tracked(from))
+	}
+	resp, err := e.cli().Get(context.Background(), to)
+	if err != nil || len(resp.Kvs) != 1 || resp.Kvs[0].Lease == 0 || !tracked(to) {
+		t.Fatalf("target after move %v, %v", resp, err)
+	}
+
+	ok, err := e.Txn().If(KeyExists("ion://test/txn/missing")).
+		Else(OpPutStatic("ion://test/txn/else", "1")).
+		Commit(context.Background())
+	if ok || err != nil {
+		t.Fatalf("else txn = %v, %v", ok, err)
+	}
+	if v, _ := e.get("ion://test/txn/else"); v != "1" || tracked("ion://test/txn/else") {
+		t.Fatalf("else branch put %q", v)
+	}
+}
@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// WaitFor blocks until key holds a value predicate accepts, e.g. until a
+// dependency registered itself at boot. It returns at once when the current
+// value does, and otherwise watches key from the revision of that read so
+// no change in between is missed. A missing key never satisfies predicate.
+// It returns ErrWaitTimeout once the deadline of ctx passed, the error of
+// ctx when it is canceled, and ErrConnClosed when the Etcd is closed.
+func (e *Etcd) WaitFor(ctx context.Context, key string, predicate func(value string) bool) (err error) {
+	if predicate == nil {
+		return errors.New("wait predicate is nil")
+	}
+	ctx, span := e.span(ctx, "wait", key)
+	defer endSpan(span, &err)
+	var resp *clientv3.GetResponse
+	err = e.retry(ctx, func() (err error) {
+		opCtx, cancel := e.opContext(ctx)
+		defer cancel()
+		resp, err = e.cli().Get(opCtx, key, readOpts(ctx)...)
+		return etcdError(err)
+	})
+	if err != nil {
+		return waitError(ctx, key, err)
+	}
+	if len(resp.Kvs) > 0 && predicate(decodeValue(resp.Kvs[0].Value)) {
+		return nil
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	check := func(value string) {
+		if predicate(value) {
+			once.Do(func() { close(done) })
+		}
+	}
+	stop := e.watchFromRev(key, false, resp.Header.Revision, func(eventType EventType, _, value string) {
+		if eventType == EventPut {
+			check(value)
+		}
+	}, func(m map[string]string) {
+		if v, ok := m[key]; ok {
+			check(v)
+		}
+	})
+	defer stop()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return waitError(ctx, key, ctx.Err())
+	case <-e.ctx.Done():
+		return fmt.Errorf("wait for %s: %w", key, ErrConnClosed)
+	}
+}
+
+// waitError is ErrWaitTimeout for an err caused by the deadline of ctx
+func waitError(ctx context.Context, key string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("wait for %s: %w", key, ErrWaitTimeout)
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	ready := func(v string) bool { return v == "ready" }
+
+	t.Run("already satisfied", func(t *testing.T) {
+		key := "ion://test/wait/now"
+		if err := e.keep(key, "ready"); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		start := time.Now()
+		if err := e.WaitFor(ctx, key, ready); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("waited %v for a satisfied key", d)
+		}
+	})
+	t.Run("becomes satisfied", func(t *testing.T) {
+		key := "ion://test/wait/later"
+		if err := e.keep(key, "starting"); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			e.update(key, "still starting")
+			time.Sleep(100 * time.Millisecond)
+			e.update(key, "ready")
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.WaitFor(ctx, key, ready); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := e.get(key); v != "ready" {
+			t.Fatalf("returned while %s = %q", key, v)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		key := "ion://test/wait/never"
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := e.WaitFor(ctx, key, ready); !errors.Is(err, ErrWaitTimeout) {
+			t.Fatalf("err = %v, want ErrWaitTimeout", err)
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+		if err := e.WaitFor(ctx, key, ready); !errors.Is(err, context.Canceled) {
+			t.Fatalf("err = %v, want context.Canceled", err)
+		}
+	})
+}
@@ -0,0 +1,397 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// pause before a closed watch is re-established
+const watchRetryPeriod = time.Millisecond * 100
+
+// EventType is the kind of change delivered to a WatchFunc
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+	// EventProgress only tells a subscription with Progress the revision its
+	// watch reached, it carries no key
+	EventProgress
+	// EventResync is the resync marker of a subscription whose watch could
+	// not resume, e.g. after a compaction: the changes since the last event
+	// are lost and the current keys follow as EventPut, so a reader drops
+	// what it built and rebuilds it from them. It carries no key.
+	EventResync
+	// EventStopped is the last event of a subscription stopped by its cancel
+	// or the close of the Etcd, its Revision the one up to which every event
+	// was sent, see Subscribe. It carries no key.
+	EventStopped
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	case EventProgress:
+		return "PROGRESS"
+	case EventResync:
+		return "RESYNC"
+	case EventStopped:
+		return "STOPPED"
+	}
+	return "UNKNOWN"
+}
+
+// WatchFunc receives decoded watch events, value is empty on EventDelete
+type WatchFunc func(eventType EventType, key, value string)
+
+// revFunc is a WatchFunc also given the revision of the event
+type revFunc func(rev int64, eventType EventType, key, value string)
+
+// eventFunc is a revFunc also given when its watch response was received
+type eventFunc func(received time.Time, rev int64, eventType EventType, key, value string)
+
+// ResyncFunc receives the current keys of a watch whose revision got
+// compacted before it could resume, the changes in between are lost and the
+// watch goes on from the revision of snapshot
+type ResyncFunc func(snapshot map[string]string)
+
+// Watch calls fn for every change of key, or of every key under it when
+// prefix is set. Events are delivered from a single goroutine in revision
+// order until the returned cancel func is called or the Etcd is closed, with
+// WatchWorkers they are in order per key only and concurrent across keys. A
+// watch channel closed by etcd or by a reconnect is re-established from the
+// last revision seen, so no event is missed unless that revision has been
+// compacted meanwhile; the current keys are then delivered as EventPut and
+// the keys it delivered before that are gone as EventDelete, see
+// WatchResync to be told about it instead.
+func (e *Etcd) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	return e.WatchResync(key, prefix, fn, nil)
+}
+
+// WatchWithID is Watch also returning the id of the watch, which its log
+// lines and watch_event_lag_seconds label carry
+func (e *Etcd) WatchWithID(key string, prefix bool, fn WatchFunc) (id string, stop func(), err error) {
+	return e.watchResync(key, prefix, fn, nil)
+}
+
+// WatchResync is Watch calling onResync with a fresh read when the watch
+// cannot resume because its revision has been compacted
+func (e *Etcd) WatchResync(key string, prefix bool, fn WatchFunc, onResync ResyncFunc) (stop func(), err error) {
+	_, stop, err = e.watchResync(key, prefix, fn, onResync)
+	return stop, err
+}
+
+func (e *Etcd) watchResync(key string, prefix bool, fn WatchFunc, onResync ResyncFunc) (id string, stop func(), err error) {
+	if fn == nil {
+		return "", nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	_, span := e.span(e.ctx, "watch", key)
+	defer endSpan(span, &err)
+	// pin the start revision so a resume before the first event loses nothing
+	_, rev, err := e.snapshot(key, prefix, true)
+	if err != nil {
+		return "", nil, err
+	}
+	id = newWatchID()
+	return id, e.watchWithHooks(key, prefix, rev, fn, watchHooks{id: id, onResync: onResync}), nil
+}
+
+// watchSeq numbers the watches of the process
+var watchSeq uint64
+
+// newWatchID returns an id no other watch of the process has
+func newWatchID() string {
+	return fmt.Sprintf("watch-%d", atomic.AddUint64(&watchSeq, 1))
+}
+
+// WatchKeys is Watch on each of keys, exactly them and no other key under a
+// common prefix. The watches share one gRPC stream and start from the same
+// revision. fn is called one event at a time, in revision order per key but
+// not across keys. The returned func stops them all.
+func (e *Etcd) WatchKeys(keys []string, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key to watch")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	_, span := e.span(e.ctx, "watch", keys[0])
+	defer endSpan(span, &err)
+	_, rev, err := e.snapshot(keys[0], false, true)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	serial := func(eventType EventType, key, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fn(eventType, key, value)
+	}
+	seen := make(map[string]bool, len(keys))
+	var cancels []func()
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		cancels = append(cancels, e.watchFromRev(key, false, rev, serial, nil))
+	}
+	return func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}, nil
+}
+
+// SnapshotWatch reads every key under prefix and watches it from the
+// revision of that read, each change after the snapshot is delivered to fn
+// exactly once and none before it, so snapshot plus events is consistent. A
+// replay after a compaction also deletes the keys of m gone meanwhile.
+func (e *Etcd) SnapshotWatch(prefix string, fn WatchFunc) (m map[string]string, stop func(), err error) {
+	if fn == nil {
+		return nil, nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	_, span := e.span(e.ctx, "watch", prefix)
+	defer endSpan(span, &err)
+	m, rev, err := e.snapshot(prefix, true, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, e.watchSnapshot(prefix, m, rev, fn), nil
+}
+
+// watchSnapshot watches prefix after the revision rev its keys m were read at
+func (e *Etcd) watchSnapshot(prefix string, m map[string]string, rev int64, fn WatchFunc) func() {
+	known := make(map[string]struct{}, len(m))
+	for k := range m {
+		known[k] = struct{}{}
+	}
+	return e.watchWithHooks(prefix, true, rev, fn, watchHooks{known: known})
+}
+
+// snapshot reads key and returns the store revision of the read, countOnly
+// skips the values
+func (e *Etcd) snapshot(key string, prefix, countOnly bool) (map[string]string, int64, error) {
+	var opts []clientv3.OpOption
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if countOnly {
+		opts = append(opts, clientv3.WithCountOnly())
+	}
+	ctx, cancel := e.opContext(e.ctx)
+	resp, err := e.cli().Get(ctx, key, opts...)
+	cancel()
+	if err != nil {
+		return nil, 0, etcdError(err)
+	}
+	m := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		m[string(kv.Key)] = decodeValue(kv.Value)
+	}
+	return m, resp.Header.Revision, nil
+}
+
+// watchHooks are told about the life of a watch besides its events
+type watchHooks struct {
+	// id names the watch in its logs and metrics, a new one when empty
+	id string
+	// onResync replaces replaying the keys as EventPut after a compaction
+	onResync ResyncFunc
+	// known are the keys that exist at the start revision, without
+	// onResync those missing from the replay are delivered as EventDelete
+	known map[string]struct{}
+	// onState is called with false when the watch channel closes and with
+	// true once a new one is established, after any resync
+	onState func(connected bool)
+	// onClose is called once the watch stopped, after the last event
+	onClose func()
+	// progress asks etcd for progress notifications, delivered to fn as
+	// EventProgress
+	progress bool
+	// resynced is called with the revision of the fresh read of a watch
+	// that could not resume, before onResync or the replay of its keys
+	resynced func(rev int64)
+}
+
+// watchFromRev delivers the changes after revision rev to fn
+func (e *Etcd) watchFromRev(key string, prefix bool, rev int64, fn WatchFunc, onResync ResyncFunc) func() {
+	return e.watchWithHooks(key, prefix, rev, fn, watchHooks{onResync: onResync})
+}
+
+func (e *Etcd) watchWithHooks(key string, prefix bool, rev int64, fn WatchFunc, hooks watchHooks) func() {
+	if hooks.id == "" {
+		hooks.id = newWatchID()
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	deliver := e.timed(hooks.id, func(_ int64, eventType EventType, key, value string) {
+		fn(eventType, key, value)
+	})
+	if e.cfg.WatchWorkers > 1 {
+		d := newWatchDispatcher(ctx, e.cfg.WatchWorkers, deliver)
+		deliver = d.dispatch
+		if resync := hooks.onResync; resync != nil {
+			hooks.onResync = func(m map[string]string) {
+				d.flush()
+				resync(m)
+			}
+		}
+	}
+	e.startWatch(ctx, key, prefix, rev, deliver, hooks)
+	return cancel
+}
+
+// startWatch delivers the changes after revision rev to fn from a new
+// goroutine until ctx is done, hooks.id must be set
+func (e *Etcd) startWatch(ctx context.Context, key string, prefix bool, rev int64, fn eventFunc, hooks watchHooks) {
+	opts := []clientv3.OpOption{clientv3.WithCreatedNotify()}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if hooks.progress {
+		opts = append(opts, clientv3.WithProgressNotify())
+	}
+	e.log().Infof("Etcd.Watch %s %s after revision %d", hooks.id, key, rev)
+	wch := e.cli().Watch(ctx, key, append([]clientv3.OpOption{clientv3.WithRev(rev + 1)}, opts...)...)
+	go e.watchLoop(ctx, key, prefix, opts, rev, wch, fn, hooks)
+}
+
+// timed calls fn after recording how long the event waited since its watch
+// response was received. etcd keeps no time of its revisions, so the time
+// spent before ion read the response is not part of it.
+func (e *Etcd) timed(id string, fn revFunc) eventFunc {
+	lags := eventLag.WithLabelValues(id)
+	return func(received time.Time, rev int64, eventType EventType, key, value string) {
+		lag := time.Since(received)
+		lags.Observe(lag.Seconds())
+		if e.cfg.OnEventLag != nil {
+			e.cfg.OnEventLag(lag)
+		}
+		fn(rev, eventType, key, value)
+	}
+}
+
+// closedWatchChan makes watchLoop retry after watchRetryPeriod
+var closedWatchChan = func() clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	close(ch)
+	return ch
+}()
+
+func (e *Etcd) watchLoop(ctx context.Context, key string, prefix bool, opts []clientv3.OpOption, rev int64, wch clientv3.WatchChan, fn eventFunc, hooks watchHooks) {
+	defer eventLag.DeleteLabelValues(hooks.id)
+	if hooks.onClose != nil {
+		defer hooks.onClose()
+	}
+	compacted := false
+	switches := e.clusterSwitches()
+	// the keys seen to exist, for the deletes a replay must deliver
+	known := hooks.known
+	if known == nil && hooks.onResync == nil {
+		known = make(map[string]struct{})
+	}
+	for {
+		for resp := range wch {
+			received := time.Now()
+			if resp.Created && resp.CompactRevision == 0 {
+				// its header revision is the current one, not one seen
+				if hooks.onState != nil {
+					hooks.onState(true)
+				}
+				continue
+			}
+			if resp.CompactRevision != 0 {
+				// etcd closes the channel right after
+				compacted = true
+				e.log().Errorf("Etcd.Watch %s %s revision %d compacted at %d", hooks.id, key, rev+1, resp.CompactRevision)
+				continue
+			}
+			if err := resp.Err(); err != nil {
+				e.log().Errorf("Etcd.Watch %s %s %v", hooks.id, key, err)
+				continue
+			}
+			if n := len(resp.Events); n > 0 {
+				rev = resp.Events[n-1].Kv.ModRevision
+			} else {
+				rev = resp.Header.Revision
+			}
+			if hooks.progress && resp.IsProgressNotify() {
+				fn(received, rev, EventProgress, "", "")
+			}
+			for _, ev := range resp.Events {
+				k := string(ev.Kv.Key)
+				if ev.Type == clientv3.EventTypeDelete {
+					if hooks.onResync == nil {
+						delete(known, k)
+					}
+					fn(received, ev.Kv.ModRevision, EventDelete, k, "")
+				} else {
+					if hooks.onResync == nil {
+						known[k] = struct{}{}
+					}
+					fn(received, ev.Kv.ModRevision, EventPut, k, decodeValue(ev.Kv.Value))
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if hooks.onState != nil {
+			hooks.onState(false)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryPeriod):
+		}
+		if s := e.clusterSwitches(); s != switches {
+			// the revisions seen belong to the other cluster
+			e.log().Errorf("Etcd.Watch %s %s switched cluster, resyncing", hooks.id, key)
+			switches, compacted = s, true
+		}
+		if compacted {
+			m, r, err := e.snapshot(key, prefix, false)
+			if err != nil {
+				e.log().Errorf("Etcd.Watch %s %s resync %v", hooks.id, key, err)
+				wch = closedWatchChan
+				continue
+			}
+			rev, compacted = r, false
+			if hooks.resynced != nil {
+				hooks.resynced(rev)
+			}
+			if hooks.onResync != nil {
+				hooks.onResync(m)
+			} else {
+				received := time.Now()
+				for k, v := range m {
+					fn(received, rev, EventPut, k, v)
+				}
+				// deleted in the changes lost
+				for k := range known {
+					if _, ok := m[k]; !ok {
+						fn(received, rev, EventDelete, k, "")
+					}
+				}
+				known = make(map[string]struct{}, len(m))
+				for k := range m {
+					known[k] = struct{}{}
+				}
+			}
+		}
+		e.log().Errorf("Etcd.Watch %s %s channel closed, resuming after revision %d", hooks.id, key, rev)
+		wch = e.cli().Watch(ctx, key, append([]clientv3.OpOption{clientv3.WithRev(rev + 1)}, opts...)...)
+	}
+}
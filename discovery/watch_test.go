@@ -0,0 +1,389 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type watchEvent struct {
+	typ   EventType
+	key   string
+	value string
+}
+
+func collectEvents() (WatchFunc, <-chan watchEvent) {
+	ch := make(chan watchEvent, 100)
+	return func(t EventType, key, value string) {
+		ch <- watchEvent{t, key, value}
+	}, ch
+}
+
+func expectEvent(t *testing.T, ch <-chan watchEvent, want watchEvent) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("event = %+v, want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event, want %+v", want)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	fn, ch := collectEvents()
+	cancel, err := e.Watch("ion://test/watch/", true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.keep("ion://test/watch/a", "1")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://test/watch/a", "1"})
+	e.del("ion://test/watch/a")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://test/watch/a", ""})
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	e.keep("ion://test/watch/b", "2")
+	select {
+	case ev := <-ch:
+		t.Fatalf("event after cancel %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestSnapshotWatch(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	e.keep("ion://test/snap/a", "1")
+
+	// a write landing between the snapshot and the watch start
+	m, rev, err := e.snapshot("ion://test/snap/", true, false)
+	if err != nil || len(m) != 1 {
+		t.Fatalf("snapshot = %v, %v", m, err)
+	}
+	e.keep("ion://test/snap/b", "2")
+	fn, ch := collectEvents()
+	cancel := e.watchFromRev("ion://test/snap/", true, rev, fn, nil)
+	defer cancel()
+	expectEvent(t, ch, watchEvent{EventPut, "ion://test/snap/b", "2"})
+	select {
+	case ev := <-ch:
+		t.Fatalf("unexpected event %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	m, cancel2, err := e.SnapshotWatch("ion://test/snap/", fn)
+	if err != nil || len(m) != 2 {
+		t.Fatalf("SnapshotWatch = %v, %v", m, err)
+	}
+	defer cancel2()
+	e.del("ion://test/snap/a")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://test/snap/a", ""})
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://test/snap/a", ""})
+}
+
+func TestWatchCompacted(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	e.keep("ion://test/compact/a", "1")
+	_, rev, err := e.snapshot("ion://test/compact/", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.update("ion://test/compact/a", "2")
+	e.keep("ion://test/compact/b", "1")
+	resp, err := e.cli().Get(context.Background(), "ion://test/compact/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.cli().Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// a watch resuming from before the compaction
+	fn, ch := collectEvents()
+	resynced := make(chan map[string]string, 1)
+	cancel := e.watchFromRev("ion://test/compact/", true, rev, fn, func(m map[string]string) {
+		resynced <- m
+	})
+	defer cancel()
+	select {
+	case m := <-resynced:
+		if len(m) != 2 || m["ion://test/compact/a"] != "2" {
+			t.Fatalf("resync snapshot %v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no resync after compaction")
+	}
+	e.keep("ion://test/compact/c", "1")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://test/compact/c", "1"})
+
+	// without a resync func the snapshot is replayed as puts
+	fn, ch = collectEvents()
+	cancel2 := e.watchFromRev("ion://test/compact/", true, rev, fn, nil)
+	defer cancel2()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-ch:
+			if ev.typ != EventPut {
+				t.Fatalf("replayed %v", ev)
+			}
+			seen[ev.key] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("replayed %v", seen)
+		}
+	}
+}
+
+func TestWatchCompactedDelete(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	prefix := "ion://node/sfu/"
+	e.keep(prefix+"a", "1")
+	e.keep(prefix+"b", "1")
+	m, rev, err := e.snapshot(prefix, true, false)
+	if err != nil || len(m) != 2 {
+		t.Fatalf("snapshot = %v, %v", m, err)
+	}
+	// the node leaves while the watch is behind, and the delete is compacted
+	e.del(prefix + "b")
+	e.keep("ion://test/compact/other", "1")
+	resp, err := e.cli().Get(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.cli().Compact(context.Background(), resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	fn, ch := collectEvents()
+	cancel := e.watchSnapshot(prefix, m, rev, fn)
+	defer cancel()
+	got := make(map[watchEvent]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-ch:
+			got[ev] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("replayed %v", got)
+		}
+	}
+	if !got[watchEvent{EventPut, prefix + "a", "1"}] || !got[watchEvent{EventDelete, prefix + "b", ""}] {
+		t.Fatalf("replayed %v, want a put again and b deleted", got)
+	}
+
+	// the keys put after the start count too
+	e.keep(prefix+"c", "1")
+	expectEvent(t, ch, watchEvent{EventPut, prefix + "c", "1"})
+}
+
+func TestWatchWorkers(t *testing.T) {
+	_, ep := startEtcd(t, nil)
+	const keys, perKey = 8, 5
+	run := func(workers int) time.Duration {
+		e := newTestEtcd(t, Config{Endpoints: []string{ep}, WatchWorkers: workers})
+		prefix := fmt.Sprintf("ion://test/workers/%d/", workers)
+		var mu sync.Mutex
+		last := make(map[string]int)
+		done := make(chan struct{})
+		received := 0
+		stop, err := e.Watch(prefix, true, func(_ EventType, key, value string) {
+			time.Sleep(20 * time.Millisecond)
+			n, _ := strconv.Atoi(value)
+			mu.Lock()
+			defer mu.Unlock()
+			if n != last[key]+1 {
+				t.Errorf("%s got %d after %d", key, n, last[key])
+			}
+			last[key] = n
+			if received++; received == keys*perKey {
+				close(done)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+		start := time.Now()
+		for i := 1; i <= perKey; i++ {
+			for k := 0; k < keys; k++ {
+				e.cli().Put(context.Background(), fmt.Sprintf("%s%d", prefix, k), strconv.Itoa(i))
+			}
+		}
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d workers: %d events received", workers, received)
+		}
+		return time.Since(start)
+	}
+	serial := run(0)
+	pooled := run(4)
+	if pooled > serial*2/3 {
+		t.Fatalf("4 workers took %v, serial %v", pooled, serial)
+	}
+}
+
+func TestWatchEventLag(t *testing.T) {
+	lags := make(chan time.Duration, 10)
+	e := newTestEtcd(t, Config{OnEventLag: func(d time.Duration) { lags <- d }})
+	done := make(chan struct{}, 10)
+	_, err := e.Watch("ion://test/lag/", true, func(EventType, string, string) {
+		time.Sleep(50 * time.Millisecond)
+		done <- struct{}{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one revision, so the three events come in one response
+	_, err = e.cli().Txn(context.Background()).Then(
+		clientv3.OpPut("ion://test/lag/a", "1"),
+		clientv3.OpPut("ion://test/lag/b", "1"),
+		clientv3.OpPut("ion://test/lag/c", "1"),
+	).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []time.Duration
+	for len(got) < 3 {
+		select {
+		case d := <-lags:
+			got = append(got, d)
+			<-done
+		case <-time.After(2 * time.Second):
+			t.Fatalf("lags %v", got)
+		}
+	}
+	if got[0] > 40*time.Millisecond || got[2] < 100*time.Millisecond {
+		t.Fatalf("lags %v, want the third to include two 50ms handlers", got)
+	}
+}
+
+func TestWatchKeys(t *testing.T) {
+	e := newTestEtcd(t, Config{})
+	fn, ch := collectEvents()
+	keys := []string{"ion://test/keys/a", "ion://test/keys/c", "ion://test/keys/a"}
+	cancel, err := e.WatchKeys(keys, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		e.keep("ion://test/keys/"+k, k)
+	}
+	e.del("ion://test/keys/b")
+	e.del("ion://test/keys/c")
+
+	got := map[watchEvent]bool{}
+	for len(got) < 3 {
+		select {
+		case ev := <-ch:
+			got[ev] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("events %v", got)
+		}
+	}
+	for _, want := range []watchEvent{
+		{EventPut, "ion://test/keys/a", "a"},
+		{EventPut, "ion://test/keys/c", "c"},
+		{EventDelete, "ion://test/keys/c", ""},
+	} {
+		if !got[want] {
+			t.Fatalf("events %v, missing %+v", got, want)
+		}
+	}
+	select {
+	case ev := <-ch:
+		t.Fatalf("event of an unwatched or duplicate key %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	e.keep("ion://test/keys/a", "again")
+	select {
+	case ev := <-ch:
+		t.Fatalf("event after cancel %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if _, err := e.WatchKeys(nil, fn); err == nil {
+		t.Fatal("WatchKeys without keys succeeded")
+	}
+}
+
+func TestWatchID(t *testing.T) {
+	l := &recordLogger{}
+	e := newTestEtcd(t, Config{Logger: l})
+	fn, ch := collectEvents()
+	id1, cancel1, err := e.WatchWithID("ion://test/id/", true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, events, cancel2, err := e.SubscribeWithID("ion://test/id/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == "" || id1 == id2 {
+		t.Fatalf("ids %q and %q, want two distinct ones", id1, id2)
+	}
+	e.keep("ion://test/id/a", "1")
+	<-ch
+	<-events
+
+	l.mu.Lock()
+	logged := strings.Join(l.infos, "\n")
+	l.mu.Unlock()
+	for _, id := range []string{id1, id2} {
+		if !strings.Contains(logged, id+" ") {
+			t.Fatalf("no log line with %s in\n%s", id, logged)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(eventLag)
+	observed := func() map[string]uint64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]uint64)
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "watch" {
+						counts[lp.GetValue()] = m.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+		}
+		return counts
+	}
+	counts := observed()
+	if counts[id1] != 1 || counts[id2] != 1 {
+		t.Fatalf("event lag samples %v, want one for %s and %s", counts, id1, id2)
+	}
+
+	cancel1()
+	cancel2()
+	for range events {
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		counts = observed()
+		if _, ok := counts[id1]; !ok {
+			if _, ok := counts[id2]; !ok {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("event lag %v kept the stopped watches", counts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,432 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/pion/ion/log"
+)
+
+const (
+	defaultZooKeeperServer  = "127.0.0.1:2181"
+	defaultZooKeeperRoot    = "/ion"
+	defaultZooKeeperSession = defaultGrantTimeout * time.Second
+	zooKeeperRetryPeriod    = time.Second
+)
+
+// ZooKeeperConfig configures a ZooKeeper backed Registry
+type ZooKeeperConfig struct {
+	// Servers of the ensemble, default 127.0.0.1:2181
+	Servers []string
+	// Root is the znode every key is a child of, default /ion
+	Root string
+	// SessionTimeout bounds how long kept keys outlive a lost connection,
+	// default 5s. NewZooKeeper also gives up connecting after it.
+	SessionTimeout time.Duration
+}
+
+// ZooKeeper is a Registry on a ZooKeeper ensemble. Every key is one child of
+// Root named after the escaped key, so prefixes match like in etcd rather
+// than by path. Kept keys are ephemeral znodes of the session, which the
+// ensemble removes when the session expires like an etcd lease, and they
+// are created again once a new session is established.
+type ZooKeeper struct {
+	cfg  ZooKeeperConfig
+	conn *zk.Conn
+
+	mu   sync.Mutex
+	kept map[string]string
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+var _ Registry = (*ZooKeeper)(nil)
+
+// zkLogger sends the client logs to the ion log
+type zkLogger struct{}
+
+func (zkLogger) Printf(format string, args ...interface{}) {
+	log.Infof("ZooKeeper "+format, args...)
+}
+
+func NewZooKeeper(cfg ZooKeeperConfig) (*ZooKeeper, error) {
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = []string{defaultZooKeeperServer}
+	}
+	if cfg.Root == "" {
+		cfg.Root = defaultZooKeeperRoot
+	}
+	if cfg.SessionTimeout == 0 {
+		cfg.SessionTimeout = defaultZooKeeperSession
+	}
+	if !strings.HasPrefix(cfg.Root, "/") || (len(cfg.Root) > 1 && strings.HasSuffix(cfg.Root, "/")) {
+		return nil, fmt.Errorf("zookeeper root %q must start and not end with /", cfg.Root)
+	}
+	conn, events, err := zk.Connect(cfg.Servers, cfg.SessionTimeout, zk.WithLogger(zkLogger{}))
+	if err != nil {
+		log.Errorf("NewZooKeeper err=%v", err)
+		return nil, err
+	}
+	if err := waitSession(events, cfg.SessionTimeout); err != nil {
+		conn.Close()
+		log.Errorf("NewZooKeeper err=%v", err)
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	z := &ZooKeeper{
+		cfg:  cfg,
+		conn: conn,
+		kept: make(map[string]string),
+		ctx:  ctx,
+		stop: stop,
+	}
+	if err := z.createRoot(); err != nil {
+		z.Close()
+		log.Errorf("NewZooKeeper err=%v", err)
+		return nil, err
+	}
+	z.wg.Add(1)
+	go z.sessions(events)
+	return z, nil
+}
+
+// waitSession waits for the first session of a new connection
+func waitSession(events <-chan zk.Event, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.State == zk.StateHasSession {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("zookeeper: no session within %v", timeout)
+		}
+	}
+}
+
+// createRoot creates Root and its parents as persistent znodes
+func (z *ZooKeeper) createRoot() error {
+	if z.cfg.Root == "/" {
+		return nil
+	}
+	path := ""
+	for _, part := range strings.Split(strings.TrimPrefix(z.cfg.Root, "/"), "/") {
+		path += "/" + part
+		if _, err := z.conn.Create(path, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessions creates the kept keys again whenever a session is established,
+// those still there from a session that survived are just updated
+func (z *ZooKeeper) sessions(events <-chan zk.Event) {
+	defer z.wg.Done()
+	for {
+		select {
+		case <-z.ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.State != zk.StateHasSession {
+				continue
+			}
+			z.mu.Lock()
+			for k, v := range z.kept {
+				if err := z.put(k, v); err != nil {
+					log.Errorf("ZooKeeper.restore %s %v", k, err)
+				}
+			}
+			z.mu.Unlock()
+		}
+	}
+}
+
+// zkName is the child of Root holding key, escaped since keys contain /
+func zkName(key string) string {
+	return url.PathEscape(key)
+}
+
+func zkKey(name string) (string, error) {
+	return url.PathUnescape(name)
+}
+
+func (z *ZooKeeper) path(key string) string {
+	if z.cfg.Root == "/" {
+		return "/" + zkName(key)
+	}
+	return z.cfg.Root + "/" + zkName(key)
+}
+
+// put writes key as an ephemeral znode of the current session, replacing
+// one left by another session
+func (z *ZooKeeper) put(key, value string) error {
+	path := z.path(key)
+	_, err := z.conn.Create(path, []byte(value), zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	if err != zk.ErrNodeExists {
+		return err
+	}
+	_, stat, err := z.conn.Exists(path)
+	if err != nil {
+		return err
+	}
+	if stat.EphemeralOwner == z.conn.SessionID() {
+		_, err = z.conn.Set(path, []byte(value), -1)
+		return err
+	}
+	if err := z.conn.Delete(path, -1); err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	_, err = z.conn.Create(path, []byte(value), zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+	return err
+}
+
+func (z *ZooKeeper) Keep(key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if err := z.put(key, value); err != nil {
+		return err
+	}
+	z.kept[key] = value
+	return nil
+}
+
+// Update sets the data of a kept key, keeping it if it is not
+func (z *ZooKeeper) Update(key, value string) (err error) {
+	defer observe(opPut, time.Now(), &err)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.kept[key]; ok {
+		if _, err := z.conn.Set(z.path(key), []byte(value), -1); err == nil {
+			z.kept[key] = value
+			return nil
+		}
+	}
+	if err := z.put(key, value); err != nil {
+		return err
+	}
+	z.kept[key] = value
+	return nil
+}
+
+func (z *ZooKeeper) Del(key string) (err error) {
+	defer observe(opDelete, time.Now(), &err)
+	z.mu.Lock()
+	delete(z.kept, key)
+	z.mu.Unlock()
+	if err := z.conn.Delete(z.path(key), -1); err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	return nil
+}
+
+func (z *ZooKeeper) Get(key string) (v string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	data, _, err := z.conn.Get(z.path(key))
+	if err == zk.ErrNoNode {
+		return "", ErrKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (z *ZooKeeper) GetByPrefix(prefix string) (m map[string]string, err error) {
+	defer observe(opGet, time.Now(), &err)
+	names, _, err := z.conn.Children(z.cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	m = make(map[string]string)
+	for _, name := range names {
+		key, err := zkKey(name)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		data, _, err := z.conn.Get(z.path(key))
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = string(data)
+	}
+	return m, nil
+}
+
+// zkWatch follows the keys of one Watch. ZooKeeper watches fire once, so
+// each one that fired is set again by the next sync, the others stay armed.
+type zkWatch struct {
+	z      *ZooKeeper
+	ctx    context.Context
+	key    string
+	prefix bool
+	// fired receives the key whose watch fired, "" for the children of Root
+	fired    chan string
+	children bool
+	armed    map[string]bool
+	prev     map[string]string
+}
+
+// Watch sets a children watch on Root for a prefix and a data watch on
+// every matching key, and diffs the keys again each time one fires
+func (z *ZooKeeper) Watch(key string, prefix bool, fn WatchFunc) (stop func(), err error) {
+	if fn == nil {
+		return nil, errors.New("watch func is nil")
+	}
+	defer observe(opWatch, time.Now(), &err)
+	ctx, cancel := context.WithCancel(z.ctx)
+	w := &zkWatch{
+		z:      z,
+		ctx:    ctx,
+		key:    key,
+		prefix: prefix,
+		fired:  make(chan string),
+		armed:  make(map[string]bool),
+		prev:   make(map[string]string),
+	}
+	if err := w.sync(nil); err != nil {
+		cancel()
+		return nil, err
+	}
+	z.wg.Add(1)
+	go func() {
+		defer z.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case k := <-w.fired:
+				if k == "" {
+					w.children = false
+				} else {
+					delete(w.armed, k)
+				}
+			}
+			for {
+				err := w.sync(fn)
+				if err == nil {
+					break
+				}
+				log.Errorf("ZooKeeper.Watch %s %v", key, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(zooKeeperRetryPeriod):
+				}
+			}
+		}
+	}()
+	return cancel, nil
+}
+
+// sync reads the keys whose watch is not armed, arms it and reports the
+// differences to fn, none when fn is nil
+func (w *zkWatch) sync(fn WatchFunc) error {
+	conn := w.z.conn
+	var keys []string
+	if w.prefix {
+		var names []string
+		var err error
+		if w.children {
+			names, _, err = conn.Children(w.z.cfg.Root)
+		} else {
+			var ch <-chan zk.Event
+			names, _, ch, err = conn.ChildrenW(w.z.cfg.Root)
+			if err == nil {
+				w.children = true
+				w.forward("", ch)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if k, err := zkKey(name); err == nil && strings.HasPrefix(k, w.key) {
+				keys = append(keys, k)
+			}
+		}
+	} else {
+		keys = []string{w.key}
+	}
+
+	cur := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if w.armed[k] {
+			if v, ok := w.prev[k]; ok {
+				cur[k] = v
+			}
+			continue
+		}
+		path := w.z.path(k)
+		data, _, ch, err := conn.GetW(path)
+		found := err == nil
+		if err == zk.ErrNoNode && !w.prefix {
+			// a missing key is watched for its creation, ExistsW also fires
+			// on its changes if it got created in between
+			var exists bool
+			if exists, _, ch, err = conn.ExistsW(path); err == nil && exists {
+				data, _, err = conn.Get(path)
+				found = err == nil
+				if err == zk.ErrNoNode {
+					err = nil
+				}
+			}
+		}
+		if err == zk.ErrNoNode {
+			// gone since the listing, the children watch reports it
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w.armed[k] = true
+		w.forward(k, ch)
+		if found {
+			cur[k] = string(data)
+		}
+	}
+	if fn != nil {
+		diffValues(w.prev, cur, fn)
+	}
+	w.prev = cur
+	return nil
+}
+
+// forward reports on fired when ch fires
+func (w *zkWatch) forward(key string, ch <-chan zk.Event) {
+	go func() {
+		select {
+		case <-ch:
+		case <-w.ctx.Done():
+			return
+		}
+		select {
+		case w.fired <- key:
+		case <-w.ctx.Done():
+		}
+	}()
+}
+
+// Close closes the session, which removes every kept key at once
+func (z *ZooKeeper) Close() error {
+	z.stop()
+	z.conn.Close()
+	z.wg.Wait()
+	return nil
+}
@@ -0,0 +1,601 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+func TestZooKeeperPath(t *testing.T) {
+	for _, root := range []string{"/ion", "/"} {
+		z := &ZooKeeper{cfg: ZooKeeperConfig{Root: root}}
+		for _, key := range []string{"ion://node/sfu/10.0.0.1:5000", "a b%c"} {
+			path := z.path(key)
+			name := path[strings.LastIndex(path, "/")+1:]
+			if strings.Count(path, "/") != strings.Count(strings.TrimSuffix(root, "/"), "/")+1 {
+				t.Fatalf("path %q of %q is not a child of %s", path, key, root)
+			}
+			if got, err := zkKey(name); err != nil || got != key {
+				t.Fatalf("zkKey(%q) = %q, %v, want %q", name, got, err, key)
+			}
+		}
+	}
+}
+
+func TestNewZooKeeperRoot(t *testing.T) {
+	for _, root := range []string{"ion", "/ion/"} {
+		if _, err := NewZooKeeper(ZooKeeperConfig{Root: root}); err == nil {
+			t.Fatalf("root %q accepted", root)
+		}
+	}
+}
+
+// zkTestServer speaks enough of the ZooKeeper wire protocol for the client
+// the registry uses: sessions, the znode operations and one shot watches.
+// It keeps a single version of every znode and expires sessions only when
+// told to.
+type zkTestServer struct {
+	t *testing.T
+	l net.Listener
+
+	mu       sync.Mutex
+	zxid     int64
+	nextID   int64
+	nodes    map[string]*zkTestNode
+	sessions map[int64]net.Conn
+	// data and exist watches share a table like on a real server
+	dataWatches  map[string]map[int64]bool
+	childWatches map[string]map[int64]bool
+}
+
+type zkTestNode struct {
+	data []byte
+	stat zk.Stat
+}
+
+const (
+	zkTestOpCreate      = 1
+	zkTestOpDelete      = 2
+	zkTestOpExists      = 3
+	zkTestOpGetData     = 4
+	zkTestOpSetData     = 5
+	zkTestOpPing        = 11
+	zkTestOpChildren2   = 12
+	zkTestOpClose       = -11
+	zkTestOpSetWatches  = 101
+	zkTestErrUnimpl     = -6
+	zkTestErrNoNode     = -101
+	zkTestErrBadVersion = -103
+	zkTestErrEphemeral  = -108
+	zkTestErrNodeExists = -110
+	zkTestErrNotEmpty   = -111
+)
+
+func startZKTestServer(t *testing.T) *zkTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &zkTestServer{
+		t:            t,
+		l:            l,
+		nodes:        map[string]*zkTestNode{"/": {}},
+		sessions:     make(map[int64]net.Conn),
+		dataWatches:  make(map[string]map[int64]bool),
+		childWatches: make(map[string]map[int64]bool),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		s.mu.Lock()
+		for _, c := range s.sessions {
+			c.Close()
+		}
+		s.mu.Unlock()
+	})
+	return s
+}
+
+func (s *zkTestServer) addr() string {
+	return s.l.Addr().String()
+}
+
+// jute is the big endian encoding of the protocol
+type jute struct {
+	b   []byte
+	err bool
+}
+
+// next consumes n bytes, a short packet reads as zeros and sets err
+func (j *jute) next(n int) []byte {
+	if len(j.b) < n {
+		j.err = true
+		j.b = nil
+		return make([]byte, 8)
+	}
+	b := j.b[:n]
+	j.b = j.b[n:]
+	return b
+}
+
+func (j *jute) int32() int32   { return int32(binary.BigEndian.Uint32(j.next(4))) }
+func (j *jute) int64() int64   { return int64(binary.BigEndian.Uint64(j.next(8))) }
+func (j *jute) bool() bool     { return j.next(1)[0] != 0 }
+func (j *jute) string() string { return string(j.bytes()) }
+
+// bytes reads a length prefixed buffer, -1 being nil
+func (j *jute) bytes() []byte {
+	n := int(j.int32())
+	if n < 0 {
+		return nil
+	}
+	return j.next(n)
+}
+
+func (j *jute) strings() []string {
+	var ss []string
+	for n := j.int32(); n > 0 && !j.err; n-- {
+		ss = append(ss, j.string())
+	}
+	return ss
+}
+
+func (j *jute) putInt32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	j.b = append(j.b, b[:]...)
+}
+
+func (j *jute) putInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	j.b = append(j.b, b[:]...)
+}
+
+func (j *jute) putBytes(v []byte) {
+	j.putInt32(int32(len(v)))
+	j.b = append(j.b, v...)
+}
+
+func (j *jute) putStat(st zk.Stat) {
+	for _, v := range []int64{st.Czxid, st.Mzxid, st.Ctime, st.Mtime} {
+		j.putInt64(v)
+	}
+	j.putInt32(st.Version)
+	j.putInt32(st.Cversion)
+	j.putInt32(st.Aversion)
+	j.putInt64(st.EphemeralOwner)
+	j.putInt32(st.DataLength)
+	j.putInt32(st.NumChildren)
+	j.putInt64(st.Pzxid)
+}
+
+func zkReadPacket(c net.Conn) (*jute, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	return &jute{b: b}, nil
+}
+
+func zkWritePacket(c net.Conn, body []byte) {
+	out := &jute{}
+	out.putBytes(body)
+	c.Write(out.b)
+}
+
+func (s *zkTestServer) serve(c net.Conn) {
+	defer c.Close()
+	req, err := zkReadPacket(c)
+	if err != nil {
+		return
+	}
+	req.int32() // protocol version
+	req.int64() // last zxid seen
+	timeout := req.int32()
+	id := req.int64()
+
+	s.mu.Lock()
+	if old, ok := s.sessions[id]; ok {
+		old.Close()
+	} else if id != 0 {
+		// unknown and so expired, the client starts over
+		id = -1
+	} else {
+		s.nextID++
+		id = s.nextID
+	}
+	res := &jute{}
+	res.putInt32(0)
+	res.putInt32(timeout)
+	if id == -1 {
+		res.putInt64(0)
+		res.putBytes(make([]byte, 16))
+		zkWritePacket(c, res.b)
+		s.mu.Unlock()
+		return
+	}
+	res.putInt64(id)
+	res.putBytes(make([]byte, 16))
+	zkWritePacket(c, res.b)
+	s.sessions[id] = c
+	s.mu.Unlock()
+
+	for {
+		req, err := zkReadPacket(c)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.sessions[id] != c {
+			s.mu.Unlock()
+			return
+		}
+		quit := s.handle(id, c, req)
+		s.mu.Unlock()
+		if quit {
+			return
+		}
+	}
+}
+
+// handle runs one request of session id and writes its response, with mu
+// held so watch events go out before the response that triggered them
+func (s *zkTestServer) handle(id int64, c net.Conn, req *jute) (quit bool) {
+	xid := req.int32()
+	op := req.int32()
+	res := &jute{}
+	code := int32(0)
+	switch op {
+	case zkTestOpPing:
+	case zkTestOpCreate:
+		path, data := req.string(), req.bytes()
+		for n := req.int32(); n > 0 && !req.err; n-- {
+			req.int32()
+			req.string()
+			req.string()
+		}
+		flags := req.int32()
+		code = s.create(id, path, data, flags)
+		if code == 0 {
+			res.putBytes([]byte(path))
+		}
+	case zkTestOpDelete:
+		code = s.delete(req.string(), req.int32())
+	case zkTestOpExists, zkTestOpGetData:
+		path, watch := req.string(), req.bool()
+		n, ok := s.nodes[path]
+		if watch && (ok || op == zkTestOpExists) {
+			zkAddWatch(s.dataWatches, path, id)
+		}
+		if !ok {
+			code = zkTestErrNoNode
+			break
+		}
+		if op == zkTestOpGetData {
+			res.putBytes(n.data)
+		}
+		res.putStat(n.stat)
+	case zkTestOpSetData:
+		path, data, version := req.string(), req.bytes(), req.int32()
+		n, ok := s.nodes[path]
+		switch {
+		case !ok:
+			code = zkTestErrNoNode
+		case version != -1 && version != n.stat.Version:
+			code = zkTestErrBadVersion
+		default:
+			s.zxid++
+			n.data = data
+			n.stat.Version++
+			n.stat.Mzxid = s.zxid
+			n.stat.DataLength = int32(len(data))
+			s.fire(s.dataWatches, path, zk.EventNodeDataChanged)
+			res.putStat(n.stat)
+		}
+	case zkTestOpChildren2:
+		path, watch := req.string(), req.bool()
+		n, ok := s.nodes[path]
+		if !ok {
+			code = zkTestErrNoNode
+			break
+		}
+		if watch {
+			zkAddWatch(s.childWatches, path, id)
+		}
+		children := s.children(path)
+		res.putInt32(int32(len(children)))
+		for _, name := range children {
+			res.putBytes([]byte(name))
+		}
+		res.putStat(n.stat)
+	case zkTestOpSetWatches:
+		// changes made while the client was away are not replayed
+		req.int64()
+		for _, p := range append(req.strings(), req.strings()...) {
+			zkAddWatch(s.dataWatches, p, id)
+		}
+		for _, p := range req.strings() {
+			zkAddWatch(s.childWatches, p, id)
+		}
+	case zkTestOpClose:
+		s.expireLocked(id)
+		quit = true
+	default:
+		code = zkTestErrUnimpl
+	}
+	out := &jute{}
+	out.putInt32(xid)
+	out.putInt64(s.zxid)
+	out.putInt32(code)
+	if code == 0 {
+		out.b = append(out.b, res.b...)
+	}
+	zkWritePacket(c, out.b)
+	return quit
+}
+
+func zkParent(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+func (s *zkTestServer) children(path string) []string {
+	var names []string
+	for p := range s.nodes {
+		if p != "/" && zkParent(p) == path {
+			names = append(names, p[strings.LastIndex(p, "/")+1:])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *zkTestServer) create(id int64, path string, data []byte, flags int32) int32 {
+	if _, ok := s.nodes[path]; ok {
+		return zkTestErrNodeExists
+	}
+	parent, ok := s.nodes[zkParent(path)]
+	if !ok {
+		return zkTestErrNoNode
+	}
+	if parent.stat.EphemeralOwner != 0 {
+		return zkTestErrEphemeral
+	}
+	s.zxid++
+	n := &zkTestNode{data: data}
+	n.stat.Czxid, n.stat.Mzxid = s.zxid, s.zxid
+	n.stat.DataLength = int32(len(data))
+	if flags&zk.FlagEphemeral != 0 {
+		n.stat.EphemeralOwner = id
+	}
+	s.nodes[path] = n
+	parent.stat.Cversion++
+	parent.stat.NumChildren++
+	s.fire(s.dataWatches, path, zk.EventNodeCreated)
+	s.fire(s.childWatches, zkParent(path), zk.EventNodeChildrenChanged)
+	return 0
+}
+
+func (s *zkTestServer) delete(path string, version int32) int32 {
+	n, ok := s.nodes[path]
+	switch {
+	case !ok:
+		return zkTestErrNoNode
+	case version != -1 && version != n.stat.Version:
+		return zkTestErrBadVersion
+	case n.stat.NumChildren > 0:
+		return zkTestErrNotEmpty
+	}
+	s.zxid++
+	delete(s.nodes, path)
+	parent := s.nodes[zkParent(path)]
+	parent.stat.Cversion++
+	parent.stat.NumChildren--
+	s.fire(s.dataWatches, path, zk.EventNodeDeleted)
+	s.fire(s.childWatches, path, zk.EventNodeDeleted)
+	s.fire(s.childWatches, zkParent(path), zk.EventNodeChildrenChanged)
+	return 0
+}
+
+func zkAddWatch(watches map[string]map[int64]bool, path string, id int64) {
+	if watches[path] == nil {
+		watches[path] = make(map[int64]bool)
+	}
+	watches[path][id] = true
+}
+
+// fire sends ev to the sessions watching path and clears their watches
+func (s *zkTestServer) fire(watches map[string]map[int64]bool, path string, ev zk.EventType) {
+	for id := range watches[path] {
+		c, ok := s.sessions[id]
+		if !ok {
+			continue
+		}
+		out := &jute{}
+		out.putInt32(-1)
+		out.putInt64(s.zxid)
+		out.putInt32(0)
+		out.putInt32(int32(ev))
+		out.putInt32(int32(zk.StateConnected))
+		out.putBytes([]byte(path))
+		zkWritePacket(c, out.b)
+	}
+	delete(watches, path)
+}
+
+// expire ends session id like a missed heartbeat would, its ephemeral
+// znodes are deleted and its connection dropped
+func (s *zkTestServer) expire(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.sessions[id]; ok {
+		c.Close()
+	}
+	s.expireLocked(id)
+}
+
+func (s *zkTestServer) expireLocked(id int64) {
+	delete(s.sessions, id)
+	for _, watches := range []map[string]map[int64]bool{s.dataWatches, s.childWatches} {
+		for _, ids := range watches {
+			delete(ids, id)
+		}
+	}
+	var paths []string
+	for p, n := range s.nodes {
+		if n.stat.EphemeralOwner == id {
+			paths = append(paths, p)
+		}
+	}
+	for _, p := range paths {
+		s.delete(p, -1)
+	}
+}
+
+// owner is the session of the ephemeral znode of key, 0 if there is none
+func (s *zkTestServer) owner(root, key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.nodes[root+"/"+zkName(key)]; ok {
+		return n.stat.EphemeralOwner
+	}
+	return 0
+}
+
+func newTestZooKeeper(t *testing.T, s *zkTestServer) *ZooKeeper {
+	z, err := NewZooKeeper(ZooKeeperConfig{Servers: []string{s.addr()}, Root: "/ion/test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestZooKeeperKeep(t *testing.T) {
+	s := startZKTestServer(t)
+	z := newTestZooKeeper(t, s)
+	other := newTestZooKeeper(t, s)
+	defer other.Close()
+
+	if err := z.Keep("ion://node/a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if id := s.owner("/ion/test", "ion://node/a"); id != z.conn.SessionID() {
+		t.Fatalf("owner = %d, want session %d", id, z.conn.SessionID())
+	}
+	if v, err := other.Get("ion://node/a"); err != nil || v != "1" {
+		t.Fatalf("get = %q, %v", v, err)
+	}
+	if err := z.Update("ion://node/a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	z.Keep("ion://room/a", "x")
+	if kv, err := other.GetByPrefix("ion://node/"); err != nil || len(kv) != 1 || kv["ion://node/a"] != "2" {
+		t.Fatalf("prefix read = %v, %v", kv, err)
+	}
+	if err := z.Del("ion://room/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get("ion://room/a"); err != ErrKeyNotFound {
+		t.Fatalf("deleted key err = %v", err)
+	}
+
+	// a key left by another session is taken over
+	if err := other.Keep("ion://node/a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if id := s.owner("/ion/test", "ion://node/a"); id != other.conn.SessionID() {
+		t.Fatalf("owner = %d, want session %d", id, other.conn.SessionID())
+	}
+	z.Keep("ion://node/b", "1")
+	z.Close()
+	if s.owner("/ion/test", "ion://node/b") != 0 {
+		t.Fatal("ephemeral key survived Close")
+	}
+	if v, err := other.Get("ion://node/a"); err != nil || v != "3" {
+		t.Fatalf("taken over key = %q, %v", v, err)
+	}
+}
+
+func TestZooKeeperExpire(t *testing.T) {
+	s := startZKTestServer(t)
+	z := newTestZooKeeper(t, s)
+	defer z.Close()
+	z.Keep("ion://node/a", "1")
+	z.Update("ion://node/a", "2")
+	old := z.conn.SessionID()
+
+	s.expire(old)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		id := s.owner("/ion/test", "ion://node/a")
+		if id != 0 && id != old {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("kept key not created again in a new session")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if v, err := z.Get("ion://node/a"); err != nil || v != "2" {
+		t.Fatalf("restored key = %q, %v", v, err)
+	}
+}
+
+func TestZooKeeperWatch(t *testing.T) {
+	s := startZKTestServer(t)
+	z := newTestZooKeeper(t, s)
+	defer z.Close()
+	watcher := newTestZooKeeper(t, s)
+	defer watcher.Close()
+
+	z.Keep("ion://node/a", "1")
+	fn, ch := collectEvents()
+	stop, err := watcher.Watch("ion://node/", true, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	keyFn, keyCh := collectEvents()
+	stopKey, err := watcher.Watch("ion://node/b", false, keyFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopKey()
+
+	z.Keep("ion://room/a", "x")
+	z.Keep("ion://node/b", "1")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/b", "1"})
+	expectEvent(t, keyCh, watchEvent{EventPut, "ion://node/b", "1"})
+	z.Update("ion://node/a", "2")
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "2"})
+	z.Del("ion://node/b")
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/b", ""})
+	expectEvent(t, keyCh, watchEvent{EventDelete, "ion://node/b", ""})
+
+	// the ephemeral key goes with the session and comes back with the next
+	s.expire(z.conn.SessionID())
+	expectEvent(t, ch, watchEvent{EventDelete, "ion://node/a", ""})
+	expectEvent(t, ch, watchEvent{EventPut, "ion://node/a", "2"})
+}